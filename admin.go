@@ -1,20 +1,17 @@
 package autotown
 
 import (
-	"bytes"
 	"compress/gzip"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"net/url"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 
-	"crypto/sha256"
-
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
@@ -23,73 +20,12 @@ import (
 )
 
 func init() {
-	http.HandleFunc("/admin/rewriteUUIDs", handleRewriteUUIDs)
 	http.HandleFunc("/admin/updateControllers", handleUpdateControllers)
 	http.HandleFunc("/admin/exportBoards", handleExportBoards)
-	http.HandleFunc("/batch/asyncRollup", handleAsyncRollup)
-}
-
-func handleRewriteUUIDs(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	q := datastore.NewQuery("TuneResults").Order("-timestamp").Limit(50)
-	res := []TuneResults{}
-	if err := fillKeyQuery(c, q, &res); err != nil {
-		log.Errorf(c, "Error fetching tune results: %v", err)
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	var keys []*datastore.Key
-	var toUpdate []TuneResults
-	for _, x := range res {
-		if len(x.UUID) == 64 {
-			continue
-		}
-		prevuuid := x.UUID
-		if err := x.uncompress(); err != nil {
-			log.Errorf(c, "Error uncompressing %q: %v", x.UUID, err)
-			continue
-		}
-		d := json.NewDecoder(bytes.NewReader(x.Data))
-		d.UseNumber()
-		m := map[string]interface{}{}
-		err := d.Decode(&m)
-		if err != nil {
-			log.Errorf(c, "Error updating %q: %v", x.UUID, err)
-			continue
-		}
-		x.UUID = fmt.Sprintf("%x", sha256.Sum256([]byte(x.UUID)))
-		m["uniqueId"] = x.UUID
-		x.Data, err = json.Marshal(m)
-		if err != nil {
-			log.Errorf(c, "Error encoding %q: %v", x.UUID, err)
-			continue
-		}
-		if err := x.compress(); err != nil {
-			log.Errorf(c, "Error compressing %q: %v", x.UUID, err)
-			continue
-		}
-		log.Infof(c, "Updating %q -> %q for %v", prevuuid, x.UUID, x.Key.Encode())
-		keys = append(keys, x.Key)
-		toUpdate = append(toUpdate, x)
-	}
-
-	if len(keys) > 0 {
-		log.Infof(c, "Updating %v items", len(keys))
-		if err := datastore.RunInTransaction(c, func(tc context.Context) error {
-			_, err := datastore.PutMulti(tc, keys, toUpdate)
-			return err
-		}, &datastore.TransactionOptions{XG: true}); err != nil {
-			log.Errorf(c, "Error udpating tune records: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
-		}
-	} else {
-		log.Debugf(c, "No items to update")
-	}
+	http.HandleFunc("/batch/asyncRollup", deadLetters(handleAsyncRollup))
 
-	w.WriteHeader(204)
+	registerMapper(kindMapper{name: "gcRollupMarkers", kinds: []string{rollupMarkerKind},
+		batchSize: 100, concurrency: 5, mutates: true, f: mapGCRollupMarkers})
 }
 
 func handleUpdateControllers(w http.ResponseWriter, r *http.Request) {
@@ -103,7 +39,7 @@ func handleUpdateControllers(w http.ResponseWriter, r *http.Request) {
 	grp, _ := errgroup.WithContext(c)
 	for t := q.Run(c); ; {
 		var st UsageStat
-		_, err := t.Next(&st)
+		k, err := t.Next(&st)
 		if err == datastore.Done {
 			break
 		} else if err != nil {
@@ -118,10 +54,12 @@ func handleUpdateControllers(w http.ResponseWriter, r *http.Request) {
 
 		rm := json.RawMessage(st.Data)
 		data := &asyncUsageData{
+			Key:       k.Encode(),
 			IP:        st.Addr,
 			Country:   st.Country,
 			Region:    st.Region,
 			City:      st.City,
+			GeoSource: st.GeoSource,
 			Lat:       st.Lat,
 			Lon:       st.Lon,
 			Timestamp: st.Timestamp,
@@ -195,18 +133,18 @@ func handleAsyncRollup(w http.ResponseWriter, r *http.Request) {
 	br, err := gzip.NewReader(r.Body)
 	if err != nil {
 		log.Errorf(c, "Error initializing ungzip: %v", err)
-		http.Error(w, "error ungzipping", 500)
+		http.Error(w, "error ungzipping", 400)
 		return
 	}
 	if err := json.NewDecoder(br).Decode(&d); err != nil {
 		log.Errorf(c, "Error decoding async json data: %v", err)
-		http.Error(w, "error decoding json", 500)
+		http.Error(w, "error decoding json", 400)
 		return
 	}
 
 	if err := asyncRollup(c, &d); err != nil {
 		log.Errorf(c, "Error doing async rollup: %v", err)
-		http.Error(w, "error doing async rollup", 500)
+		http.Error(w, "error doing async rollup: "+err.Error(), errorStatus(err))
 		return
 	}
 
@@ -228,6 +166,20 @@ func olderTime(a, b time.Time) time.Time {
 	}
 }
 
+// seenUUID is the controller a board in a usage report is rolled up
+// into, if it can be told.  Raw IDs are hashed on the way in.
+func seenUUID(b usageSeenBoard) string {
+	switch {
+	case isRawUUID(b.UUID):
+		return hashUUID(b.UUID)
+	case b.UUID != "":
+		return b.UUID
+	case b.CPU != "":
+		return hashUUID(b.CPU)
+	}
+	return ""
+}
+
 func asyncRollup(c context.Context, d *asyncUsageData) error {
 	rec := struct {
 		BoardsSeen             []usageSeenBoard
@@ -237,37 +189,27 @@ func asyncRollup(c context.Context, d *asyncUsageData) error {
 	}{}
 	if err := json.Unmarshal([]byte(*d.RawData), &rec); err != nil {
 		log.Warningf(c, "Couldn't parse %s: %v", *d.RawData, err)
+		return permanent(err)
+	}
+
+	boards, err := loadBoards(c)
+	if err != nil {
 		return err
 	}
 
 	seenBoards := map[string]usageSeenBoard{}
 	for _, b := range rec.BoardsSeen {
-		uuid := b.UUID
+		uuid := seenUUID(b)
 		if uuid == "" {
-			if b.CPU == "" {
-				log.Infof(c, "No UUID or CPU ID found for %v", b)
-				continue
-			}
-			uuid = fmt.Sprintf("%x", sha256.Sum256([]byte(b.CPU)))
+			log.Infof(c, "No UUID or CPU ID found for %v", b)
+			continue
 		}
 
-		b.Name = canonicalBoard(b.Name)
 		seenBoards[uuid] = b
 	}
 
 	items := map[string]FoundController{}
-	for _, b := range seenBoards {
-		uuid := b.UUID
-		if uuid == "" {
-			if b.CPU == "" {
-				log.Infof(c, "No UUID or CPU ID found for %v", b)
-				continue
-			}
-			uuid = fmt.Sprintf("%x", sha256.Sum256([]byte(b.CPU)))
-		}
-
-		b.Name = canonicalBoard(b.Name)
-
+	for uuid, b := range seenBoards {
 		fc := items[uuid]
 		if d.Timestamp.After(fc.Timestamp) {
 			fc.UUID = uuid
@@ -279,12 +221,14 @@ func asyncRollup(c context.Context, d *asyncUsageData) error {
 			fc.GCSOS = rec.CurrentOS
 			fc.GCSArch = rec.CurrentArch
 			fc.GCSVersion = rec.GCSVersion
+			fc.Platform = parsePlatform(rec.CurrentOS, rec.CurrentArch, rec.GCSVersion)
 			fc.Addr = d.IP
 			fc.Country = d.Country
 			fc.Region = d.Region
 			fc.City = d.City
 			fc.Lat = d.Lat
 			fc.Lon = d.Lon
+			fc.GeoSource = d.GeoSource
 			fc.Timestamp = d.Timestamp
 			fc.Oldest = d.Timestamp
 			if rec.ShareIP != "true" {
@@ -299,70 +243,123 @@ func asyncRollup(c context.Context, d *asyncUsageData) error {
 		items[uuid] = fc
 	}
 
-	newBoard := ""
-	var keys []*datastore.Key
-	var toUpdate []FoundController
+	g, _ := errgroup.WithContext(c)
 	for k, v := range items {
 		key := datastore.NewKey(c, "FoundController", k, 0, nil)
-		prev := &FoundController{}
-		err := datastore.Get(c, key, prev)
-		switch err {
-		case datastore.ErrNoSuchEntity:
-			newBoard = canonicalBoard(v.Name)
-		case nil:
-		default:
-			return err
-		}
-
-		v.Oldest = olderTime(olderTime(prev.Oldest, v.Oldest), prev.Timestamp)
-		v.Counted = v.Counted || prev.Counted
+		v := v
+		g.Go(func() error {
+			return rollupController(c, key, &v, d.Key, boards)
+		})
+	}
 
-		keys = append(keys, key)
-		toUpdate = append(toUpdate, v)
+	err = g.Wait()
+	if len(items) > 0 {
+		memcache.Delete(c, resultsStatsKey)
 	}
+	return err
+}
+
+// rollupMarker records that a UsageStat has been applied to a
+// FoundController.  It lives in the controller's entity group so it
+// can be checked in the same transaction as the update.  Reports from
+// before markers need them seeded by processUsage before they're
+// replayed, and gcRollupMarkers drops those of deleted reports.
+type rollupMarker struct {
+	Timestamp time.Time `datastore:"timestamp,noindex"`
+}
+
+const rollupMarkerKind = "RollupApplied"
 
+// mapGCRollupMarkers deletes rollup markers whose UsageStat is gone.
+// Nothing can replay a deleted report, so they only take up space.
+func mapGCRollupMarkers(c context.Context, params url.Values, keys []*datastore.Key) error {
+	var mks, uks []*datastore.Key
+	for _, k := range keys {
+		uk, err := datastore.DecodeKey(k.StringID())
+		if err != nil {
+			log.Infof(c, "Rollup marker %v doesn't name a report: %v", k.Encode(), err)
+			continue
+		}
+		mks, uks = append(mks, k), append(uks, uk)
+	}
+	// Only whether they exist matters, so don't load the reports.
+	exists := make([]bool, len(uks))
 	g, _ := errgroup.WithContext(c)
-	if len(keys) > 0 {
+	for i, uk := range uks {
+		i, uk := i, uk
 		g.Go(func() error {
-			log.Infof(c, "Updating %v items", len(keys))
-			err := datastore.RunInTransaction(c, func(tc context.Context) error {
-				_, err := datastore.PutMulti(tc, keys, toUpdate)
-				return err
-			}, &datastore.TransactionOptions{XG: true})
-			memcache.Delete(c, resultsStatsKey)
+			n, err := datastore.NewQuery("UsageStat").Filter("__key__ =", uk).KeysOnly().Count(c)
+			exists[i] = n > 0
 			return err
 		})
 	}
-
-	if newBoard != "" {
-		log.Infof(c, "New board: %v", newBoard)
+	if err := g.Wait(); err != nil {
+		return err
 	}
-
-	return g.Wait()
-}
-
-func abbrevOS(s string) string {
-	switch {
-	case strings.HasPrefix(s, "Windows"):
-		return "Windows"
-	case strings.HasPrefix(s, "OS X"):
-		return "Mac"
-	case strings.HasPrefix(s, "macOS"):
-		return "Mac"
-	default:
-		return "Linux"
+	var gone []*datastore.Key
+	for i, ok := range exists {
+		if !ok {
+			gone = append(gone, mks[i])
+		}
 	}
+	changed(c, gone...)
+	if len(gone) == 0 || isDryRun(c) {
+		return nil
+	}
+	log.Infof(c, "Deleting %v of %v rollup markers", len(gone), len(keys))
+	return datastore.DeleteMulti(c, gone)
 }
 
-func canonicalBoard(b string) string {
-	switch b {
-	default:
-		return b
-	case "CopterControl":
-		return "CC3D"
-	case "Revolution", "RevoMini":
-		return "Revo"
-	}
+// rollupController folds a single sighting into a FoundController.
+// usageKey identifies the UsageStat the sighting came from; if it's
+// already been applied this does nothing.  The merge doesn't depend
+// on the order sightings arrive in, so replaying history produces
+// the same result.
+func rollupController(c context.Context, key *datastore.Key, v *FoundController, usageKey string, boards *boardCatalog) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var mk *datastore.Key
+		if usageKey != "" {
+			mk = datastore.NewKey(tc, rollupMarkerKind, usageKey, 0, key)
+			switch err := datastore.Get(tc, mk, &rollupMarker{}); err {
+			case nil:
+				log.Debugf(c, "%v already applied to %v", usageKey, key.StringID())
+				return nil
+			case datastore.ErrNoSuchEntity:
+			default:
+				return err
+			}
+		}
+
+		prev := &FoundController{}
+		switch err := datastore.Get(tc, key, prev); err {
+		case datastore.ErrNoSuchEntity:
+			log.Infof(c, "New board: %v", v.Name)
+		case nil:
+		default:
+			return err
+		}
+
+		fc := *prev
+		if v.Timestamp.After(prev.Timestamp) {
+			fc = *v
+			fc.Counted = prev.Counted
+			fc.CountedIn, fc.CountedDay, fc.CountedBoard = prev.CountedIn, prev.CountedDay, prev.CountedBoard
+			fc.Summary = prev.Summary
+		}
+		fc.Count = prev.Count + v.Count
+		fc.Oldest = olderTime(olderTime(prev.Oldest, v.Oldest), prev.Timestamp)
+		deltas := summaryDeltas(&fc, boards)
+
+		if _, err := datastore.Put(tc, key, &fc); err != nil {
+			return err
+		}
+		if mk != nil {
+			if _, err := datastore.Put(tc, mk, &rollupMarker{v.Timestamp}); err != nil {
+				return err
+			}
+		}
+		return addCounters(tc, usageSummaryKind, usageSummaryGroup, usageSummaryShards, deltas)
+	}, &datastore.TransactionOptions{XG: true})
 }
 
 func handleExportBoards(w http.ResponseWriter, r *http.Request) {
@@ -372,6 +369,12 @@ func handleExportBoards(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Warningf(c, "Couldn't resolve git labels: %v", err)
 	}
+	boards, err := loadBoards(c)
+	if err != nil {
+		log.Errorf(c, "Error loading boards: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
 
@@ -379,6 +382,7 @@ func handleExportBoards(w http.ResponseWriter, r *http.Request) {
 		"uuid", "name", "hwrev", "git_hash", "git_tag", "ref", "uavo_hash",
 		"gcs_os", "gcs_os_abbrev", "gcs_arch", "gcs_version",
 		"country", "region", "city", "lat", "lon",
+		"hwrev_name", "manufacturer",
 	}
 
 	cw := csv.NewWriter(w)
@@ -387,6 +391,7 @@ func handleExportBoards(w http.ResponseWriter, r *http.Request) {
 
 	q := datastore.NewQuery("FoundController").Order("-timestamp")
 
+	privacy := currentPrivacy()
 	for t := q.Run(c); ; {
 		var x FoundController
 		_, err := t.Next(&x)
@@ -400,13 +405,19 @@ func handleExportBoards(w http.ResponseWriter, r *http.Request) {
 		if lbls := gitDescribe(x.GitHash, gitl); lbls != nil {
 			ref = lbls[0].Label
 		}
+		x.Lat, x.Lon = privacy.coords(x.Lat, x.Lon)
+		bn, manufacturer := boards.canonical(x.Name), ""
+		if b := boards.info(bn); b != nil {
+			manufacturer = b.Manufacturer
+		}
 
 		cw.Write(append([]string{
 			x.Timestamp.Format(time.RFC3339), x.Oldest.Format(time.RFC3339),
 			fmt.Sprint(x.Count),
-			x.UUID, canonicalBoard(x.Name), fmt.Sprint(x.HardwareRev), x.GitHash, x.GitTag, ref, x.UAVOHash,
+			x.UUID, bn, fmt.Sprint(x.HardwareRev), x.GitHash, x.GitTag, ref, x.UAVOHash,
 			x.GCSOS, abbrevOS(x.GCSOS), x.GCSArch, x.GCSVersion,
-			x.Country, x.Region, x.City, fmt.Sprint(x.Lat), fmt.Sprint(x.Lon)},
+			x.Country, x.Region, x.City, fmt.Sprint(x.Lat), fmt.Sprint(x.Lon),
+			boards.revName(bn, x.HardwareRev), manufacturer},
 		))
 	}
 
@@ -0,0 +1,600 @@
+package autotown
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/search"
+)
+
+const (
+	anonymizeRunKind    = "AnonymizeRun"
+	anonymizeCountsKind = "AnonymizeCounts"
+	anonymizeShards     = 10
+
+	// How many rollup markers are read or written at a time.
+	markerBatch = 500
+)
+
+// Each kind holding controller IDs, and the search index that copies
+// them, if any.
+var anonymizeKinds = map[string]string{
+	"TuneResults":     "tunes",
+	"UsageStat":       "usage",
+	"FoundController": "",
+}
+
+func init() {
+	var kinds []string
+	for k := range anonymizeKinds {
+		kinds = append(kinds, k)
+	}
+	// Tunes and usage are written in one XG transaction per batch,
+	// so stay under its 25 entity group limit.
+	registerMapper(kindMapper{name: "anonymize", kinds: kinds,
+		batchSize: 20, concurrency: 5, mutates: true, f: mapAnonymize})
+
+	http.HandleFunc("/admin/anonymize", handleAnonymize)
+	http.HandleFunc("/admin/anonymize/status", handleAnonymizeStatus)
+}
+
+// An anonymizeRun hashes every raw controller ID left in the archive.
+// It starts as a dry run of each kind, and its Token runs them for
+// real.  Any real job that didn't finish can be resumed; since hashed
+// IDs are left alone, that only does what's left.
+//
+// Only the datastore and search indexes are covered.  Backups and
+// retention archives in the bucket from before a run still hold raw
+// IDs; delete them, and take a fresh backup, once the run's done.
+type anonymizeRun struct {
+	Started   time.Time        `datastore:"started" json:"started"`
+	Token     string           `datastore:"token" json:"-"`
+	Previews  []*datastore.Key `datastore:"previews,noindex" json:"-"`
+	Jobs      []*datastore.Key `datastore:"jobs,noindex" json:"-"`
+	Confirmed time.Time        `datastore:"confirmed,noindex" json:"confirmed"`
+	Resumed   int              `datastore:"resumed,noindex" json:"resumed"`
+
+	Name string `datastore:"-" json:"name"`
+}
+
+func isRawUUID(s string) bool {
+	return s != "" && len(s) != 64
+}
+
+// mapAnonymize hashes the raw IDs in a batch and reindexes anything
+// whose search document still has one.  Real runs count their
+// progress under the run, by kind.
+//
+// Params:
+// - run: the anonymizeRun the job belongs to
+func mapAnonymize(c context.Context, params url.Values, keys []*datastore.Key) error {
+	kind := keys[0].Kind()
+	counts := map[string]int64{}
+	var err error
+	if kind == "FoundController" {
+		err = anonymizeControllers(c, keys, counts)
+	} else {
+		err = anonymizeReports(c, kind, keys, counts)
+	}
+	if err != nil || isDryRun(c) {
+		return err
+	}
+
+	deltas := map[string]int64{kind + "|scanned": int64(len(keys))}
+	for k, v := range counts {
+		deltas[kind+"|"+k] = v
+	}
+	if err := incrCounters(c, anonymizeCountsKind, params.Get("run"), anonymizeShards, deltas); err != nil {
+		log.Warningf(c, "Error counting anonymization progress: %v", err)
+	}
+	return nil
+}
+
+// staleDocs returns the keys whose search documents have a raw ID in
+// a uuid field.
+func staleDocs(c context.Context, indexName string, keys []*datastore.Key) (map[*datastore.Key]bool, error) {
+	index, err := search.Open(indexName)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[*datastore.Key]bool{}
+	for _, k := range keys {
+		var fl search.FieldList
+		err := index.Get(c, k.Encode(), &fl)
+		if err == search.ErrNoSuchDocument {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range fl {
+			if s, ok := f.Value.(string); ok && f.Name == "uuid" && isRawUUID(s) {
+				rv[k] = true
+			}
+		}
+	}
+	return rv, nil
+}
+
+// anonymizeReports hashes the IDs in a batch of tunes or usage
+// reports, then has their documents reindexed from the result.
+func anonymizeReports(c context.Context, kind string, keys []*datastore.Key, counts map[string]int64) error {
+	reindex := mapIndexUsage
+	hash := hashUsageUUIDs
+	if kind == "TuneResults" {
+		reindex = mapIndexTunes
+		hash = func(ps []datastore.Property) ([]datastore.Property, bool, error) {
+			if uuid, _ := getProp(ps, "uuid").(string); !isRawUUID(uuid) {
+				return ps, false, nil
+			}
+			ps, _, err := migrateProps(kind, ps)
+			if err != nil {
+				return nil, false, err
+			}
+			if ps, err = hashTuneUUID(ps); err != nil {
+				return nil, false, err
+			}
+			return versioned(kind, ps), true, nil
+		}
+	}
+
+	stale, err := staleDocs(c, anonymizeKinds[kind], keys)
+	if err != nil {
+		return err
+	}
+
+	var hashed []*datastore.Key
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		ents, err := getPropertyLists(tc, keys)
+		if err != nil {
+			return err
+		}
+		hashed = nil
+		var upents []datastore.PropertyList
+		for i, ps := range ents {
+			if len(ps) == 0 {
+				continue
+			}
+			ps, did, err := hash(ps)
+			if err != nil {
+				log.Errorf(c, "Error anonymizing %v: %v", keys[i].Encode(), err)
+				continue
+			}
+			if did {
+				hashed = append(hashed, keys[i])
+				upents = append(upents, ps)
+			}
+		}
+		if len(hashed) == 0 || isDryRun(c) {
+			return nil
+		}
+		_, err = datastore.PutMulti(tc, hashed, upents)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+
+	toIndex := hashed
+	for _, k := range hashed {
+		delete(stale, k)
+	}
+	for k := range stale {
+		toIndex = append(toIndex, k)
+	}
+	changed(c, toIndex...)
+	counts["hashed"], counts["reindexed"] = int64(len(hashed)), int64(len(toIndex))
+	if len(toIndex) == 0 || isDryRun(c) {
+		return nil
+	}
+	log.Infof(c, "Anonymized %v and reindexed %v of %v %v records", len(hashed), len(toIndex), len(keys), kind)
+	return reindex(c, nil, toIndex)
+}
+
+// hashUsageUUIDs hashes the IDs of the boards a usage report saw.  A
+// board reported only by CPU ID gets that ID's hash as its UUID, which
+// is what the rollup would've keyed it by, and loses the CPU ID.
+func hashUsageUUIDs(ps []datastore.Property) ([]datastore.Property, bool, error) {
+	var data *datastore.Property
+	for i := range ps {
+		if ps[i].Name == "data" {
+			data = &ps[i]
+		}
+	}
+	if data == nil {
+		return ps, false, nil
+	}
+	b, _ := data.Value.([]byte)
+	d, err := ungz(b)
+	if err != nil {
+		return nil, false, err
+	}
+	d, changed, err := hashSeenUUIDs(d)
+	if err != nil || !changed {
+		return ps, false, err
+	}
+	if data.Value, err = gz(d); err != nil {
+		return nil, false, err
+	}
+	return ps, true, nil
+}
+
+// hashSeenUUIDs does the work of hashUsageUUIDs on a report's JSON,
+// returning it rewritten if anything changed.
+func hashSeenUUIDs(d []byte) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	m := map[string]interface{}{}
+	if err := dec.Decode(&m); err != nil {
+		// Nothing readable to anonymize.
+		return d, false, nil
+	}
+
+	changed := false
+	for k, v := range m {
+		if !strings.EqualFold(k, "boardsSeen") {
+			continue
+		}
+		boards, _ := v.([]interface{})
+		for _, bv := range boards {
+			board, ok := bv.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// The rollup decodes these into a struct, so any case
+			// will do.
+			uuidKey, uuid, cpuKey, cpu := "UUID", "", "", ""
+			for bk, bv := range board {
+				switch s, _ := bv.(string); strings.ToLower(bk) {
+				case "uuid":
+					uuidKey, uuid = bk, s
+				case "cpu":
+					cpuKey, cpu = bk, s
+				}
+			}
+			switch {
+			case isRawUUID(uuid):
+				board[uuidKey] = hashUUID(uuid)
+			case uuid == "" && cpu != "":
+				board[uuidKey] = hashUUID(cpu)
+			case cpuKey == "":
+				continue
+			}
+			delete(board, cpuKey)
+			changed = true
+		}
+	}
+	if !changed {
+		return d, false, nil
+	}
+	rv, err := json.Marshal(m)
+	if err != nil {
+		return nil, false, err
+	}
+	return rv, true, nil
+}
+
+// anonymizeControllers moves controllers keyed by a raw ID to its
+// hash, merging into the hashed controller if there already is one,
+// the same way the rollup merges sightings.  Each gets its own
+// transaction, since a move spans the two controllers' groups and the
+// summary counters.
+//
+// Rollup markers keep replays from counting a report twice, so they
+// move too, but there can be any number of them: they're copied in
+// batches before the move and the old ones deleted after it.  A
+// replay in between skips reports the raw controller had seen, which
+// is what it'd do after the move anyway.
+//
+// Where both controllers had been counted, the daily counts count
+// them twice until the counts are recomputed.
+func anonymizeControllers(c context.Context, keys []*datastore.Key, counts map[string]int64) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !isRawUUID(k.StringID()) {
+			continue
+		}
+		nk := datastore.NewKey(c, "FoundController", hashUUID(k.StringID()), 0, nil)
+
+		var mks []*datastore.Key
+		if !isDryRun(c) {
+			var err error
+			if mks, err = moveRollupMarkers(c, k, nk); err != nil {
+				return err
+			}
+		}
+
+		found, merged := false, false
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			dup := &FoundController{}
+			if err := datastore.Get(tc, k, dup); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			found = true
+			fc := *dup
+			deltas := map[string]int64{}
+			prev := &FoundController{}
+			switch err := datastore.Get(tc, nk, prev); err {
+			case nil:
+				merged = true
+				if prev.Timestamp.After(dup.Timestamp) {
+					fc = *prev
+				}
+				fc.Count = prev.Count + dup.Count
+				fc.Oldest = olderTime(prev.Oldest, dup.Oldest)
+				fc.Counted = prev.Counted || dup.Counted
+				if prev.Counted {
+					fc.CountedIn, fc.CountedDay, fc.CountedBoard = prev.CountedIn, prev.CountedDay, prev.CountedBoard
+				} else {
+					fc.CountedIn, fc.CountedDay, fc.CountedBoard = dup.CountedIn, dup.CountedDay, dup.CountedBoard
+				}
+				for _, s := range dup.Summary {
+					deltas[s]--
+				}
+				fc.Summary = prev.Summary
+				mergeDeltas(deltas, summaryDeltas(&fc, boards))
+			case datastore.ErrNoSuchEntity:
+			default:
+				return err
+			}
+			fc.UUID = nk.StringID()
+			if isDryRun(tc) {
+				return nil
+			}
+			if _, err := datastore.Put(tc, nk, &fc); err != nil {
+				return err
+			}
+			if err := datastore.Delete(tc, k); err != nil {
+				return err
+			}
+			return addCounters(tc, usageSummaryKind, usageSummaryGroup, usageSummaryShards, deltas)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return err
+		}
+		for len(mks) > 0 {
+			n := len(mks)
+			if n > markerBatch {
+				n = markerBatch
+			}
+			if err := datastore.DeleteMulti(c, mks[:n]); err != nil {
+				return err
+			}
+			mks = mks[n:]
+		}
+		if !found {
+			continue
+		}
+		changed(c, k)
+		counts["hashed"]++
+		if merged {
+			counts["merged"]++
+		}
+	}
+	return nil
+}
+
+// moveRollupMarkers copies the rollup markers under one controller to
+// another, returning the ones copied.
+func moveRollupMarkers(c context.Context, from, to *datastore.Key) ([]*datastore.Key, error) {
+	mks, err := datastore.NewQuery(rollupMarkerKind).Ancestor(from).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(mks); i += markerBatch {
+		batch := mks[i:]
+		if len(batch) > markerBatch {
+			batch = batch[:markerBatch]
+		}
+		ms := make([]rollupMarker, len(batch))
+		if err := datastore.GetMulti(c, batch, ms); err != nil {
+			return nil, err
+		}
+		nmks := make([]*datastore.Key, len(batch))
+		for j, mk := range batch {
+			nmks[j] = datastore.NewKey(c, rollupMarkerKind, mk.StringID(), 0, to)
+		}
+		if _, err := datastore.PutMulti(c, nmks, ms); err != nil {
+			return nil, err
+		}
+	}
+	return mks, nil
+}
+
+func getAnonymizeRun(c context.Context, name string) (*datastore.Key, *anonymizeRun, error) {
+	k := datastore.NewKey(c, anonymizeRunKind, name, 0, nil)
+	run := &anonymizeRun{}
+	if err := datastore.Get(c, k, run); err != nil {
+		return nil, nil, err
+	}
+	run.Name = name
+	return k, run, nil
+}
+
+// startAnonymize starts a run's dry runs.
+func startAnonymize(c context.Context) (*anonymizeRun, error) {
+	run := &anonymizeRun{Started: time.Now()}
+	run.Name = run.Started.UTC().Format("20060102-150405")
+
+	var err error
+	if run.Token, err = newToken(); err != nil {
+		return nil, err
+	}
+	for kind := range anonymizeKinds {
+		k, err := startPreview(c, mapSpec{Kind: kind, Mapper: "anonymize",
+			Params: url.Values{"run": []string{run.Name}}.Encode()})
+		if err != nil {
+			return nil, err
+		}
+		run.Previews = append(run.Previews, k)
+	}
+
+	_, err = datastore.Put(c, datastore.NewKey(c, anonymizeRunKind, run.Name, 0, nil), run)
+	return run, err
+}
+
+// confirmAnonymize runs a finished run's dry runs for real.
+func confirmAnonymize(c context.Context, token string) (*anonymizeRun, error) {
+	var runs []*anonymizeRun
+	keys, err := datastore.NewQuery(anonymizeRunKind).Filter("token =", token).Limit(1).GetAll(c, &runs)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no anonymization run with that token")
+	}
+	run := runs[0]
+	run.Name = keys[0].StringID()
+	if !run.Confirmed.IsZero() {
+		return nil, fmt.Errorf("run %v was already confirmed", run.Name)
+	}
+
+	for _, pk := range run.Previews {
+		p, err := getBatchJob(c, pk)
+		if err != nil {
+			return nil, err
+		}
+		k, err := confirmPreview(c, p.Token)
+		if err != nil {
+			return nil, fmt.Errorf("anonymizing %v: %v", p.Kind, err)
+		}
+		run.Jobs = append(run.Jobs, k)
+	}
+
+	run.Confirmed = time.Now()
+	_, err = datastore.Put(c, keys[0], run)
+	return run, err
+}
+
+// resumeAnonymize restarts each of a run's real jobs that hasn't
+// finished cleanly, cancelling it first if it's still going.
+func resumeAnonymize(c context.Context, name string) (*anonymizeRun, error) {
+	rk, run, err := getAnonymizeRun(c, name)
+	if err != nil {
+		return nil, err
+	}
+	if run.Confirmed.IsZero() {
+		return nil, fmt.Errorf("run %v hasn't been confirmed", name)
+	}
+
+	for i, jk := range run.Jobs {
+		j, err := getBatchJob(c, jk)
+		if err != nil {
+			return nil, err
+		}
+		if err := j.loadCounts(c); err != nil {
+			return nil, err
+		}
+		if j.State == "done" && j.Failed == 0 {
+			continue
+		}
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			if j.State == "running" {
+				if err := cancelBatchJob(tc, jk); err != nil {
+					return err
+				}
+			}
+			k, err := startBatchJob(tc, j.mapSpec)
+			run.Jobs[i] = k
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return nil, fmt.Errorf("resuming %v: %v", j.Kind, err)
+		}
+		log.Infof(c, "Resumed anonymizing %v as job %v", j.Kind, run.Jobs[i].IntID())
+	}
+
+	run.Resumed++
+	_, err = datastore.Put(c, rk, run)
+	return run, err
+}
+
+// Params:
+// - confirm: the token of a finished dry run to run for real
+// - resume: the name of a confirmed run to pick up where it left off
+//
+// Without either it starts a dry run, which changes nothing.
+func handleAnonymize(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var run *anonymizeRun
+	var err error
+	switch {
+	case r.FormValue("confirm") != "":
+		run, err = confirmAnonymize(c, r.FormValue("confirm"))
+	case r.FormValue("resume") != "":
+		run, err = resumeAnonymize(c, r.FormValue("resume"))
+	default:
+		run, err = startAnonymize(c)
+	}
+	if err != nil {
+		log.Errorf(c, "Error starting anonymization: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	log.Infof(c, "Anonymization run %v", run.Name)
+	rv := map[string]interface{}{"run": run}
+	if run.Confirmed.IsZero() {
+		rv["confirm"] = run.Token
+	}
+	mustEncode(c, w, r, rv)
+}
+
+// Params:
+// - run: the run to report on
+//
+// Reports each of the run's jobs, preview or real, and what the real
+// ones have done so far.
+func handleAnonymizeStatus(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	_, run, err := getAnonymizeRun(c, r.FormValue("run"))
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such run", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	jobs := run.Jobs
+	if run.Confirmed.IsZero() {
+		jobs = run.Previews
+	}
+	var js []*batchJob
+	for _, k := range jobs {
+		j, err := getBatchJob(c, k)
+		if err == nil {
+			err = j.loadCounts(c)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		js = append(js, j)
+	}
+
+	counts, err := readCounters(c, anonymizeCountsKind, run.Name, anonymizeShards)
+	if err != nil {
+		log.Errorf(c, "Error reading anonymization counts: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	mustEncode(c, w, r, map[string]interface{}{"run": run, "jobs": js, "progress": counts})
+}
@@ -0,0 +1,650 @@
+package autotown
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	restoreCountsKind   = "RestoreCounts"
+	restoreCountsShards = 10
+	restoreBatch        = 100
+)
+
+// What a backup takes when it's not told otherwise, along with the
+// live daily count kind if a recompute left it somewhere else.  The
+// counts, their config and the rollup and debug log markers go with
+// the reports, so a restored copy neither miscounts nor counts replays
+// twice.
+var backupKinds = []string{"TuneResults", "UsageStat", "CrashData", "FoundController",
+	"DailyCounts", dailyCountShardKind, usageSummaryKind, countsConfigKind, rollupMarkerKind,
+	debugCountsKind, debugTemplateKind, debugLogMarkerKind, controllerOwnerKind,
+	"Board", "GitBlob", "GitTree"}
+
+// Search indexes restored kinds are reindexed into.
+var restoreIndexers = map[string]func(c context.Context, params url.Values, keys []*datastore.Key) error{
+	"TuneResults": mapIndexTunes,
+	"UsageStat":   mapIndexUsage,
+}
+
+func init() {
+	registerMapper(kindMapper{name: "backup", batchSize: 100, concurrency: 1, f: mapBackup})
+
+	http.HandleFunc("/admin/backup", handleBackup)
+	http.HandleFunc("/admin/restore", handleRestore)
+	http.HandleFunc("/admin/restore/status", handleRestoreStatus)
+	http.HandleFunc("/batch/restoreObject", deadLetters(handleRestoreObject))
+}
+
+// Backups are gzipped NDJSON, one object per chunk of keys, under
+// backups/<name>/<kind>/.  Each line is a backupEntity.  Keys are
+// stored as paths rather than encoded, so they can be restored into
+// another app, and compressed []byte properties are stored
+// uncompressed, as text where they're UTF-8.
+type backupEntity struct {
+	Key   *backupKey   `json:"key"`
+	Props []backupProp `json:"props"`
+}
+
+type backupKey struct {
+	Namespace string          `json:"namespace,omitempty"`
+	Path      []backupKeyElem `json:"path"`
+}
+
+type backupKeyElem struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+	ID   int64  `json:"id,omitempty"`
+}
+
+type backupProp struct {
+	Name string `json:"name"`
+	// One of int, bool, string, float, bytestring, key, time,
+	// blobkey, geo, text, bytes, entity or null.
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	GZ       bool            `json:"gz,omitempty"`
+	NoIndex  bool            `json:"noindex,omitempty"`
+	Multiple bool            `json:"multiple,omitempty"`
+}
+
+func backupPrefix(name string) string {
+	return "backups/" + name + "/"
+}
+
+func encodeBackupKey(k *datastore.Key) *backupKey {
+	if k == nil {
+		return nil
+	}
+	rv := &backupKey{Namespace: k.Namespace()}
+	for ; k != nil; k = k.Parent() {
+		rv.Path = append([]backupKeyElem{{k.Kind(), k.StringID(), k.IntID()}}, rv.Path...)
+	}
+	return rv
+}
+
+func (bk *backupKey) key(c context.Context) (*datastore.Key, error) {
+	if bk == nil {
+		return nil, nil
+	}
+	c, err := appengine.Namespace(c, bk.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	var k *datastore.Key
+	for _, e := range bk.Path {
+		k = datastore.NewKey(c, e.Kind, e.Name, e.ID, k)
+	}
+	if k == nil {
+		return nil, fmt.Errorf("empty key path")
+	}
+	return k, nil
+}
+
+func encodeBackupProps(ps []datastore.Property) ([]backupProp, error) {
+	var rv []backupProp
+	for _, p := range ps {
+		bp := backupProp{Name: p.Name, NoIndex: p.NoIndex, Multiple: p.Multiple}
+		var v interface{}
+		switch pv := p.Value.(type) {
+		case nil:
+			bp.Type = "null"
+		case int64:
+			bp.Type, v = "int", pv
+		case bool:
+			bp.Type, v = "bool", pv
+		case string:
+			bp.Type, v = "string", pv
+		case float64:
+			bp.Type, v = "float", pv
+		case datastore.ByteString:
+			bp.Type, v = "bytestring", []byte(pv)
+		case *datastore.Key:
+			bp.Type, v = "key", encodeBackupKey(pv)
+		case time.Time:
+			bp.Type, v = "time", pv.UTC().Format(time.RFC3339Nano)
+		case appengine.BlobKey:
+			bp.Type, v = "blobkey", string(pv)
+		case appengine.GeoPoint:
+			bp.Type, v = "geo", pv
+		case []byte:
+			// Anything that looks gzipped but isn't is kept as is.
+			d, err := ungz(pv)
+			if err != nil {
+				d = pv
+			}
+			bp.GZ = !bytes.Equal(d, pv)
+			if utf8.Valid(d) {
+				bp.Type, v = "text", string(d)
+			} else {
+				bp.Type, v = "bytes", d
+			}
+		case *datastore.Entity:
+			sub, err := encodeBackupProps(pv.Properties)
+			if err != nil {
+				return nil, err
+			}
+			bp.Type, v = "entity", backupEntity{encodeBackupKey(pv.Key), sub}
+		default:
+			return nil, fmt.Errorf("property %v: can't back up %T", p.Name, p.Value)
+		}
+		if v != nil {
+			j, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			bp.Value = j
+		}
+		rv = append(rv, bp)
+	}
+	return rv, nil
+}
+
+func decodeBackupProps(c context.Context, bps []backupProp) ([]datastore.Property, error) {
+	var rv []datastore.Property
+	for _, bp := range bps {
+		p := datastore.Property{Name: bp.Name, NoIndex: bp.NoIndex, Multiple: bp.Multiple}
+		var err error
+		switch bp.Type {
+		case "null":
+		case "int":
+			var v int64
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = v
+		case "bool":
+			var v bool
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = v
+		case "string":
+			var v string
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = v
+		case "float":
+			var v float64
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = v
+		case "bytestring":
+			var v []byte
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = datastore.ByteString(v)
+		case "key":
+			var bk backupKey
+			if err = json.Unmarshal(bp.Value, &bk); err == nil {
+				p.Value, err = bk.key(c)
+			}
+		case "time":
+			var v string
+			if err = json.Unmarshal(bp.Value, &v); err == nil {
+				p.Value, err = time.Parse(time.RFC3339Nano, v)
+			}
+		case "blobkey":
+			var v string
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = appengine.BlobKey(v)
+		case "geo":
+			var v appengine.GeoPoint
+			err = json.Unmarshal(bp.Value, &v)
+			p.Value = v
+		case "text", "bytes":
+			var v []byte
+			if bp.Type == "text" {
+				var s string
+				err = json.Unmarshal(bp.Value, &s)
+				v = []byte(s)
+			} else {
+				err = json.Unmarshal(bp.Value, &v)
+			}
+			if err == nil && bp.GZ {
+				v, err = gz(v)
+			}
+			p.Value = v
+		case "entity":
+			var be backupEntity
+			if err = json.Unmarshal(bp.Value, &be); err == nil {
+				e := &datastore.Entity{}
+				if e.Key, err = be.Key.key(c); err == nil {
+					e.Properties, err = decodeBackupProps(c, be.Props)
+				}
+				p.Value = e
+			}
+		default:
+			err = fmt.Errorf("unknown type %q", bp.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("property %v: %v", bp.Name, err)
+		}
+		rv = append(rv, p)
+	}
+	return rv, nil
+}
+
+func storageBucket(c context.Context, client *storage.Client, name string) (*storage.BucketHandle, error) {
+	if name == "" {
+		var err error
+		if name, err = file.DefaultBucketName(c); err != nil {
+			return nil, err
+		}
+	}
+	return client.Bucket(name), nil
+}
+
+// mapBackup writes a batch of entities to their own object in the
+// backup named by the name param, in the bucket param's bucket or the
+// app's default one.  A redelivered batch overwrites its object.
+func mapBackup(c context.Context, params url.Values, keys []*datastore.Key) error {
+	name := params.Get("name")
+	if name == "" {
+		return permanent(fmt.Errorf("no backup name given"))
+	}
+
+	ents, err := getPropertyLists(c, keys)
+	if err != nil {
+		return err
+	}
+
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, params.Get("bucket"))
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s%s/%s.ndjson.gz", backupPrefix(name), keys[0].Kind(), chunkID(keys))
+	n, err := writeNDJSON(c, bucket, filename, keys, ents)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf(c, "Backed up %v %v entities to %v", n, keys[0].Kind(), filename)
+	return nil
+}
+
+// getPropertyLists fetches entities that may since have been deleted,
+// which come back empty.
+func getPropertyLists(c context.Context, keys []*datastore.Key) ([]datastore.PropertyList, error) {
+	ents := make([]datastore.PropertyList, len(keys))
+	err := datastore.GetMulti(c, keys, ents)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ents, nil
+}
+
+// writeNDJSON writes entities to a gzipped NDJSON object, skipping any
+// that are empty, and returns how many it wrote.
+func writeNDJSON(c context.Context, bucket *storage.BucketHandle, filename string,
+	keys []*datastore.Key, ents []datastore.PropertyList) (int, error) {
+
+	// Cancelling the writer's context throws away a half written
+	// object instead of finishing it.
+	wctx, cancel := context.WithCancel(c)
+	defer cancel()
+	ow := bucket.Object(filename).NewWriter(wctx)
+	ow.ContentType = "application/x-ndjson"
+
+	z := gzip.NewWriter(ow)
+	e := json.NewEncoder(z)
+	n := 0
+	for i, ps := range ents {
+		if len(ps) == 0 {
+			continue
+		}
+		bps, err := encodeBackupProps(ps)
+		if err != nil {
+			return 0, fmt.Errorf("%v: %v", keys[i], err)
+		}
+		if err := e.Encode(backupEntity{encodeBackupKey(keys[i]), bps}); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := z.Close(); err != nil {
+		return 0, err
+	}
+	return n, ow.Close()
+}
+
+// Params:
+// - kind: a kind to back up (repeatable, defaults to backupKinds)
+// - name: what to call the backup (default the current time)
+// - bucket: bucket to write to (default the app's)
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	r.ParseForm()
+	kinds := r.Form["kind"]
+	if len(kinds) == 0 {
+		kinds = backupKinds
+		cfg, err := loadCountsConfig(c)
+		if err != nil {
+			log.Errorf(c, "Error loading counts config: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if cfg.Live != dailyCountShardKind {
+			kinds = append(kinds, cfg.Live)
+		}
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = time.Now().UTC().Format("20060102-150405")
+	}
+	if strings.Contains(name, "/") {
+		http.Error(w, "backup names can't contain /", 400)
+		return
+	}
+	params := url.Values{"name": []string{name}}
+	if b := r.FormValue("bucket"); b != "" {
+		params.Set("bucket", b)
+	}
+
+	jobs := map[string]string{}
+	for _, kind := range kinds {
+		k, err := startBatchJob(c, mapSpec{Kind: kind, Mapper: "backup", Params: params.Encode()})
+		if err != nil {
+			log.Errorf(c, "Error starting backup of %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jobs[kind] = k.Encode()
+	}
+
+	log.Infof(c, "Started backup %v of %v", name, kinds)
+	mustEncode(c, w, r, map[string]interface{}{"name": name, "jobs": jobs})
+}
+
+// Params:
+// - name: the backup to restore
+// - kind: only restore this kind (repeatable)
+// - bucket: bucket the backup's in (default the app's)
+//
+// Entities are written back with their original keys, replacing
+// anything already there.
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	r.ParseForm()
+	name := r.FormValue("name")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "invalid backup name", 400)
+		return
+	}
+	prefixes := []string{backupPrefix(name)}
+	if kinds := r.Form["kind"]; len(kinds) > 0 {
+		prefixes = nil
+		for _, kind := range kinds {
+			prefixes = append(prefixes, backupPrefix(name)+kind+"/")
+		}
+	}
+
+	client, err := storage.NewClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting cloud store interface: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, r.FormValue("bucket"))
+	if err != nil {
+		log.Errorf(c, "Error getting bucket: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var tasks []*taskqueue.Task
+	for _, prefix := range prefixes {
+		it := bucket.Objects(c, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				log.Errorf(c, "Error listing %v: %v", prefix, err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !strings.HasSuffix(attrs.Name, ".ndjson.gz") {
+				continue
+			}
+			tasks = append(tasks, taskqueue.NewPOSTTask("/batch/restoreObject", url.Values{
+				"name":   []string{name},
+				"bucket": []string{r.FormValue("bucket")},
+				"object": []string{attrs.Name},
+			}))
+		}
+	}
+	if len(tasks) == 0 {
+		http.Error(w, "no backup objects found", 404)
+		return
+	}
+
+	if err := queueMany(c, mapStage2, tasks); err != nil {
+		log.Errorf(c, "Error queueing restore: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof(c, "Restoring %v objects from backup %v", len(tasks), name)
+	mustEncode(c, w, r, map[string]interface{}{"name": name, "objects": len(tasks)})
+}
+
+func handleRestoreObject(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	name, object := r.FormValue("name"), r.FormValue("object")
+
+	client, err := storage.NewClient(c)
+	if err != nil {
+		log.Errorf(c, "Error getting cloud store interface: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, r.FormValue("bucket"))
+	if err != nil {
+		log.Errorf(c, "Error getting bucket: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rc, err := bucket.Object(object).NewReader(c)
+	if err != nil {
+		log.Errorf(c, "Error opening %v: %v", object, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rc.Close()
+
+	n, err := restoreEntities(c, rc)
+	if err != nil {
+		log.Errorf(c, "Error restoring %v: %v", object, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := incrCounters(c, restoreCountsKind, name, restoreCountsShards,
+		map[string]int64{"objects": 1, "entities": int64(n)}); err != nil {
+		log.Warningf(c, "Error counting restore of %v: %v", name, err)
+	}
+
+	log.Debugf(c, "Restored %v entities from %v", n, object)
+	w.WriteHeader(204)
+}
+
+// reserveIDs keeps the datastore from handing out the numeric IDs of
+// restored entities to new ones.  A range that's already allocated, or
+// has entities in it, is as reserved as it's going to get.
+func reserveIDs(c context.Context, keys []*datastore.Key) error {
+	type group struct {
+		kind   string
+		parent *datastore.Key
+	}
+	ranges := map[string]*[2]int64{}
+	groups := map[string]group{}
+	for _, k := range keys {
+		id := k.IntID()
+		if id == 0 {
+			continue
+		}
+		g := k.Kind()
+		if k.Parent() != nil {
+			g += "@" + k.Parent().Encode()
+		}
+		r, ok := ranges[g]
+		if !ok {
+			ranges[g] = &[2]int64{id, id}
+			groups[g] = group{k.Kind(), k.Parent()}
+			continue
+		}
+		if id < r[0] {
+			r[0] = id
+		}
+		if id > r[1] {
+			r[1] = id
+		}
+	}
+	for g, r := range ranges {
+		err := datastore.AllocateIDRange(c, groups[g].kind, groups[g].parent, r[0], r[1])
+		switch err.(type) {
+		case nil, *datastore.KeyRangeCollisionError, *datastore.KeyRangeContentionError:
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreEntities puts every entity in a backup object, reserving
+// their IDs and reindexing them, and returns how many there were.  An
+// object that doesn't parse is a permanent error.
+func restoreEntities(c context.Context, r io.Reader) (int, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, permanent(err)
+	}
+	// Payloads are stored uncompressed, so lines can be much bigger
+	// than the entities were; a decoder doesn't limit their length.
+	dec := json.NewDecoder(z)
+
+	var keys []*datastore.Key
+	var ents []datastore.PropertyList
+	n := 0
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := reserveIDs(c, keys); err != nil {
+			return err
+		}
+		if _, err := datastore.PutMulti(c, keys, ents); err != nil {
+			return err
+		}
+		if f := restoreIndexers[keys[0].Kind()]; f != nil {
+			if err := f(c, nil, keys); err != nil {
+				return err
+			}
+		}
+		n += len(keys)
+		keys, ents = nil, nil
+		return nil
+	}
+
+	for {
+		var be backupEntity
+		err := dec.Decode(&be)
+		if err == io.EOF {
+			break
+		}
+		switch err.(type) {
+		case nil:
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			return n, permanent(err)
+		default:
+			if err == io.ErrUnexpectedEOF {
+				return n, permanent(err)
+			}
+			return n, err
+		}
+		k, err := be.Key.key(c)
+		if err != nil {
+			return n, permanent(err)
+		}
+		ps, err := decodeBackupProps(c, be.Props)
+		if err != nil {
+			return n, permanent(fmt.Errorf("%v: %v", k, err))
+		}
+		// Batches stay one kind, to be reindexed together.
+		if len(keys) > 0 && keys[0].Kind() != k.Kind() {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+		keys, ents = append(keys, k), append(ents, ps)
+		if len(keys) == restoreBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+// Params:
+// - name: the backup being restored
+func handleRestoreStatus(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	counts, err := readCounters(c, restoreCountsKind, r.FormValue("name"), restoreCountsShards)
+	if err != nil {
+		log.Errorf(c, "Error reading restore counts: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	mustEncode(c, w, r, counts)
+}
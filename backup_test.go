@@ -0,0 +1,123 @@
+package autotown
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+type backupPropTest struct {
+	name string
+	prop datastore.Property
+}
+
+// roundTripBackupProps encodes each property as a backup would, then
+// decodes it and checks it comes back the same.
+func roundTripBackupProps(t *testing.T, c context.Context, tests []backupPropTest) {
+	var all []datastore.Property
+	for _, test := range tests {
+		all = append(all, test.prop)
+	}
+	tests = append(tests, backupPropTest{"all", datastore.Property{Name: "all", Value: &datastore.Entity{Properties: all}}})
+
+	for _, test := range tests {
+		in := []datastore.Property{test.prop}
+		bps, err := encodeBackupProps(in)
+		if err != nil {
+			t.Errorf("%v: encoding: %v", test.name, err)
+			continue
+		}
+		// Go through JSON, as a backup does.
+		j, err := json.Marshal(bps)
+		if err != nil {
+			t.Errorf("%v: marshalling: %v", test.name, err)
+			continue
+		}
+		bps = nil
+		if err := json.Unmarshal(j, &bps); err != nil {
+			t.Errorf("%v: unmarshalling %s: %v", test.name, j, err)
+			continue
+		}
+		out, err := decodeBackupProps(c, bps)
+		if err != nil {
+			t.Errorf("%v: decoding %s: %v", test.name, j, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("%v: got %#v from %s, want %#v", test.name, out, j, in)
+		}
+	}
+}
+
+// Nothing here has a key, so no App Engine context is needed.
+func TestBackupPropsRoundTrip(t *testing.T) {
+	mustGz := func(d []byte) []byte {
+		z, err := gz(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(z, d) {
+			t.Fatalf("%d bytes didn't compress", len(d))
+		}
+		return z
+	}
+	text := []byte(strings.Repeat(`{"currentOS": "Linux"}`, 50))
+	binary := bytes.Repeat([]byte{0xff, 0x00, 0x80}, 100)
+
+	roundTripBackupProps(t, context.Background(), []backupPropTest{
+		{"null", datastore.Property{Name: "none"}},
+		{"int", datastore.Property{Name: "count", Value: int64(-42)}},
+		{"bool", datastore.Property{Name: "counted", Value: true, NoIndex: true}},
+		{"string", datastore.Property{Name: "name", Value: "Sparky2"}},
+		{"float", datastore.Property{Name: "lat", Value: -41.2865}},
+		{"bytestring", datastore.Property{Name: "short", Value: datastore.ByteString{0x00, 0xff, 'a'}}},
+		{"time", datastore.Property{Name: "timestamp", Value: time.Date(2017, 4, 12, 3, 4, 5, 678900000, time.UTC)}},
+		{"blobkey", datastore.Property{Name: "blob", Value: appengine.BlobKey("AMIfv94")}},
+		{"geo", datastore.Property{Name: "geo", Value: appengine.GeoPoint{Lat: -41.2865, Lng: 174.7762}}},
+		{"text", datastore.Property{Name: "data", Value: text, NoIndex: true}},
+		{"gzipped text", datastore.Property{Name: "data", Value: mustGz(text), NoIndex: true}},
+		{"bytes", datastore.Property{Name: "raw", Value: binary, NoIndex: true}},
+		{"gzipped bytes", datastore.Property{Name: "raw", Value: mustGz(binary), NoIndex: true}},
+		{"multiple", datastore.Property{Name: "summary", Value: "Sparky2", Multiple: true}},
+		{"entity", datastore.Property{Name: "nested", Value: &datastore.Entity{
+			Properties: []datastore.Property{
+				{Name: "name", Value: "Revolution"},
+				{Name: "hw", Value: int64(3), Multiple: true},
+				{Name: "hw", Value: int64(4), Multiple: true},
+			},
+		}}},
+	})
+}
+
+// Keys need an App Engine context to be made, so this needs the SDK's
+// dev_appserver.py.
+func TestBackupKeysRoundTrip(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Skipf("no App Engine context: %v", err)
+	}
+	defer done()
+
+	nc, err := appengine.Namespace(c, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := datastore.NewKey(nc, "Board", "Sparky2", 0, nil)
+
+	roundTripBackupProps(t, c, []backupPropTest{
+		{"key", datastore.Property{Name: "board", Value: datastore.NewKey(nc, "TuneResults", "", 1234, parent)}},
+		{"keyed entity", datastore.Property{Name: "nested", Value: &datastore.Entity{
+			Key:        parent,
+			Properties: []datastore.Property{{Name: "name", Value: "Sparky2"}},
+		}}},
+	})
+}
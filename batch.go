@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -31,16 +33,21 @@ func init() {
 	http.HandleFunc("/admin/batchForm", handleBatchForm)
 	http.HandleFunc("/admin/submitMap", handleSubmitMap)
 
-	http.HandleFunc("/batch/map", batchMap)
-	http.HandleFunc("/batch/destroy", batchDestroy)
-
-	http.HandleFunc("/batch/logkeys", handleLogKeys)
-	http.HandleFunc("/batch/indexTunes", handleIndexTunes)
-	http.HandleFunc("/batch/indexUsage", handleIndexUsage)
-	http.HandleFunc("/batch/countUsage", handleCountUsage)
-	http.HandleFunc("/batch/clearCountFlag", handleClearCountFlag)
-
-	http.HandleFunc("/batch/processUsage", handleProcessUsage)
+	http.HandleFunc("/batch/map", deadLetters(batchMap))
+
+	registerMapper(destroyMapper{kindMapper{name: "destroy", batchSize: 100, concurrency: 1,
+		mutates: true, f: mapDestroy}})
+	registerMapper(kindMapper{name: "logkeys", batchSize: 100, concurrency: 1, f: mapLogKeys})
+	registerMapper(kindMapper{name: "indexTunes", kinds: []string{"TuneResults"},
+		batchSize: 10, concurrency: 10, f: mapIndexTunes})
+	registerMapper(kindMapper{name: "indexUsage", kinds: []string{"UsageStat"},
+		batchSize: 10, concurrency: 10, f: mapIndexUsage})
+	registerMapper(kindMapper{name: "countUsage", kinds: []string{"FoundController"},
+		batchSize: 10, concurrency: 10, mutates: true, f: mapCountUsage})
+	registerMapper(kindMapper{name: "clearCountFlag", kinds: []string{"FoundController"},
+		batchSize: 10, concurrency: 10, mutates: true, f: mapClearCountFlag})
+	registerMapper(kindMapper{name: "processUsage", kinds: []string{"UsageStat"},
+		batchSize: 100, concurrency: 1, mutates: true, f: mapProcessUsage})
 
 	http.HandleFunc("/_ah/start", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(204)
@@ -59,35 +66,70 @@ func handleBatchForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	job, err := latestRecompute(c)
+	if err != nil {
+		log.Warningf(c, "Error fetching latest recompute: %v", err)
+	}
+
 	execTemplate(appengine.NewContext(r), w, "batch.html", struct {
-		Kinds   []string
-		Message string
+		Choices   []mapperChoice
+		Message   string
+		Recompute *recomputeJob
 	}{
-		kinds, r.FormValue("msg")})
+		mapperChoices(kinds), r.FormValue("msg"), job})
 }
 
+// Params:
+// - kind, mapper: what to map over and with, or
+// - map: "<mapper>:<kind>" as offered by the batch form
+// - params: query string of parameters for the mapper
+// - filter (repeated) or filters (one per line): property filters
+// - key_start, key_end: key range to map over
+// - limit: maximum number of entities to map
+// - namespace: namespace to query in
+// - confirm: token of a finished preview to run for real instead
+//
+// See mapSpec for details.  Mappers that change data are previewed
+// with a dry run first, unless cron's asking.
 func handleSubmitMap(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	if r.FormValue("kind") == "" {
-		http.Redirect(w, r, "/admin/batchForm?msg=Kind+parameter+is+required", http.StatusFound)
+	if token := r.FormValue("confirm"); token != "" {
+		k, err := confirmPreview(c, token)
+		if err != nil {
+			log.Errorf(c, "Error confirming preview: %v", err)
+			http.Redirect(w, r, "/admin/jobs?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+			return
+		}
+		log.Infof(c, "Confirmed preview as job %v", k.IntID())
+		http.Redirect(w, r, "/admin/jobs?msg=Started", http.StatusFound)
 		return
 	}
 
-	_, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/batch/map", r.Form), mapStage1)
+	spec, err := specFromForm(r)
 	if err != nil {
-		log.Errorf(c, "Error getting queue stats: %v", err)
-		http.Error(w, err.Error(), 500)
+		http.Redirect(w, r, "/admin/batchForm?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+		return
+	}
+
+	start, msg := startBatchJob, "Started"
+	if m, ok := mappers[spec.Mapper]; ok && m.Mutates() && r.Header.Get("X-Appengine-Cron") != "true" {
+		start, msg = startPreview, "Previewing; confirm once the dry run's done"
+	}
+	k, err := start(c, spec)
+	if err != nil {
+		log.Errorf(c, "Error starting job: %v", err)
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
 	if r.Header.Get("X-Appengine-Cron") == "true" {
-		log.Infof(c, "Submitted on behalf of cron.")
+		log.Infof(c, "Submitted job %v on behalf of cron.", k.IntID())
 		w.WriteHeader(204)
 		return
 	}
 
-	http.Redirect(w, r, "/admin/batchForm?msg=Started", http.StatusFound)
+	http.Redirect(w, r, "/admin/jobs?msg="+url.QueryEscape(msg), http.StatusFound)
 }
 
 func maybePanic(err error) {
@@ -126,21 +168,71 @@ func queueMany(c context.Context, queue string, tasks []*taskqueue.Task) error {
 	return g.Wait()
 }
 
-// Params:
-// - kind: The kind of thing to query
-// - next: http path to process data
+// Params are those of mapSpec.form, plus:
+// - job: the batchJob this is part of, if any
+// - cursor: where the previous pass left off
+// - next: the mapper's path, from tasks queued before mapSpec
+//
+// limit counts down as passes go by.
 func batchMap(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
 	start := time.Now()
 
+	if err := legacyNext(r); err != nil {
+		log.Errorf(c, "Invalid map: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	spec, err := specFromForm(r)
+	if err != nil {
+		log.Errorf(c, "Invalid map: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	m, ok := mappers[spec.Mapper]
+	if !ok {
+		log.Errorf(c, "No such mapper: %q", spec.Mapper)
+		http.Error(w, "No such mapper", 400)
+		return
+	}
+	next := mapperPath(m.Name())
+	if spec.Params != "" {
+		next += "?" + spec.Params
+	}
+
+	var jobKey *datastore.Key
+	if js := r.FormValue("job"); js != "" {
+		var err error
+		if jobKey, err = datastore.DecodeKey(js); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		j, err := getBatchJob(c, jobKey)
+		if err != nil {
+			log.Errorf(c, "Error fetching job %v: %v", jobKey.IntID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if j.State == "cancelled" {
+			log.Infof(c, "Job %v was cancelled, not listing more", jobKey.IntID())
+			w.WriteHeader(204)
+			return
+		}
+	}
+
 	if !queueMore(c) {
 		log.Debugf(c, "Too many jobs queued, backing off")
 		http.Error(w, "Busy", 503)
 		return
 	}
 
-	q := datastore.NewQuery(r.FormValue("kind")).KeysOnly()
+	q, qc, err := spec.query(c)
+	if err != nil {
+		log.Errorf(c, "Error building query: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	if cstr := r.FormValue("cursor"); cstr != "" {
 		cursor, err := datastore.DecodeCursor(cstr)
 		maybePanic(err)
@@ -148,10 +240,15 @@ func batchMap(w http.ResponseWriter, r *http.Request) {
 		q = q.Start(cursor)
 	}
 
+	want := 10000
+	if spec.Limit > 0 && spec.Limit < want {
+		want = spec.Limit
+	}
+
 	keys := []string{}
 	finished := false
-	t := q.Run(c)
-	for i := 0; i < 10000; i++ {
+	t := q.Run(qc)
+	for i := 0; i < want; i++ {
 		k, err := t.Next(nil)
 		if err == datastore.Done {
 			finished = true
@@ -163,11 +260,23 @@ func batchMap(w http.ResponseWriter, r *http.Request) {
 		keys = append(keys, k.Encode())
 	}
 
+	nkeys := len(keys)
+	if spec.Limit > 0 && !finished {
+		spec.Limit -= nkeys
+		finished = spec.Limit <= 0
+		r.Form.Set("limit", strconv.Itoa(spec.Limit))
+	}
+
 	log.Infof(c, "Got %v %v keys in %v, finished=%v",
-		len(keys), r.FormValue("kind"), time.Since(start), finished)
+		nkeys, spec.Kind, time.Since(start), finished)
+
+	var hdr http.Header
+	if jobKey != nil {
+		hdr = http.Header{batchJobHeader: []string{jobKey.Encode()}}
+	}
 
 	var tasks []*taskqueue.Task
-	for len(keys) > 0 && r.FormValue("next") != "" {
+	for len(keys) > 0 {
 		subkeys := keys
 		if len(subkeys) > 100 {
 			subkeys = keys[:100]
@@ -187,8 +296,9 @@ func batchMap(w http.ResponseWriter, r *http.Request) {
 			mapStage2, len(subkeys), buf.Len())
 
 		tasks = append(tasks, &taskqueue.Task{
-			Path:    r.FormValue("next"),
+			Path:    next,
 			Payload: buf.Bytes(),
+			Header:  hdr,
 		})
 	}
 
@@ -198,6 +308,12 @@ func batchMap(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if jobKey != nil {
+		if err := recordListed(c, jobKey, nkeys, len(tasks), finished); err != nil {
+			log.Warningf(c, "Error recording progress of job %v: %v", jobKey.IntID(), err)
+		}
+	}
+
 	if !finished {
 		cursor, err := t.Cursor()
 		maybePanic(err)
@@ -210,40 +326,31 @@ func batchMap(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(201)
 }
 
-var destructionWhitelist = map[string]bool{"DailyCounts": true, "FoundController": true}
+var destructionWhitelist = map[string]bool{
+	"ChangedKeys":     true,
+	"DailyCounts":     true,
+	"DailyCountShard": true,
+	"FoundController": true,
+	"RollupApplied":   true,
+	"UsageSummary":    true,
+}
 
-func batchDestroy(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+// destroyMapper only accepts kinds we're willing to lose.
+type destroyMapper struct {
+	kindMapper
+}
 
-	keys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	if len(keys) == 0 {
-		log.Debugf(c, "nothing to do")
-		w.WriteHeader(204)
-		return
-	}
+func (destroyMapper) Accepts(kind string) bool {
+	return destructionWhitelist[kind] || isCountShardKind(kind)
+}
 
+func mapDestroy(c context.Context, params url.Values, keys []*datastore.Key) error {
 	log.Infof(c, "Got %v %v keys to destroy", len(keys), keys[0].Kind())
-
-	for _, k := range keys {
-		if !destructionWhitelist[k.Kind()] {
-			log.Errorf(c, "Refusing to destroy non-whitelisted %v", k.Kind())
-			http.Error(w, "Not whitelisted: "+k.Kind(), 400)
-			return
-		}
-	}
-
-	err = datastore.DeleteMulti(c, keys)
-	if err != nil {
-		log.Infof(c, "Error deleting things: %v", err)
-		http.Error(w, err.Error(), 500)
-		return
+	changed(c, keys...)
+	if isDryRun(c) {
+		return nil
 	}
-
-	w.WriteHeader(204)
+	return datastore.DeleteMulti(c, keys)
 }
 
 func decodeKeys(r io.Reader) ([]*datastore.Key, error) {
@@ -268,18 +375,12 @@ func decodeKeys(r io.Reader) ([]*datastore.Key, error) {
 	return keys, nil
 }
 
-func handleLogKeys(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	keys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+func mapLogKeys(c context.Context, params url.Values, keys []*datastore.Key) error {
 	log.Debugf(c, "Got %v keys to process", len(keys))
 	for _, k := range keys {
 		log.Debugf(c, "%v", k)
 	}
+	return nil
 }
 
 func jraw(c context.Context, m *json.RawMessage, path string) []byte {
@@ -320,237 +421,265 @@ func jptrf(c context.Context, m *json.RawMessage, path string) float64 {
 	return 0
 }
 
-func handleIndexTunes(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	keys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+func mapIndexTunes(c context.Context, params url.Values, keys []*datastore.Key) error {
 	for _, k := range keys {
 		tune, err := getTune(c, k)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
 		if err := tune.uncompress(); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
 		if err := indexDoc(c, tune); err != nil {
 			log.Errorf(c, "Error indexing: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
 	}
+	return nil
 }
 
-func handleIndexUsage(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	keys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+func mapIndexUsage(c context.Context, params url.Values, keys []*datastore.Key) error {
 	for _, k := range keys {
 		usage := &UsageStat{}
 		if err := datastore.Get(c, k, usage); err != nil {
 			log.Errorf(c, "Error fetching stat details: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
 		usage.Key = k
 
 		if err := indexUsage(c, k.Encode(), usage); err != nil {
 			log.Errorf(c, "Error indexing: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
+			return err
 		}
 	}
+	return nil
 }
 
-func countSomeUsage(c context.Context, fckeys []*datastore.Key) error {
+// countedInto says whether fc has been counted into a daily count
+// kind.  Controllers counted before CountedIn was kept were counted
+// into whatever was live.
+func countedInto(fc *FoundController, kind string, cfg *countsConfig) bool {
+	if len(fc.CountedIn) == 0 {
+		return fc.Counted && kind == cfg.Live
+	}
+	for _, k := range fc.CountedIn {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// countSomeUsage counts controllers into a daily count kind, either
+// the live one or the one a recompute is building.  Each kind only
+// counts a controller once, and counting into one doesn't disturb
+// what's recorded about the other.  It returns the controllers it
+// counted, or in a dry run would have.
+func countSomeUsage(c context.Context, fckeys []*datastore.Key, boards *boardCatalog, into string, cfg *countsConfig) ([]*datastore.Key, error) {
 	fcs := make([]*FoundController, len(fckeys))
 	if err := datastore.GetMulti(c, fckeys, fcs); err != nil {
-		return err
+		return nil, err
 	}
 
 	incrs := map[string]map[string]int64{}
+	summary := map[string]int64{}
 	var fckup []*datastore.Key
 	var fcup []*FoundController
 	for i, fc := range fcs {
-		if fc.Counted {
+		if countedInto(fc, into, cfg) {
 			continue
 		}
 		fckup = append(fckup, fckeys[i])
 		fcup = append(fcup, fc)
-		fc.Counted = true
+		in := []string{}
+		for _, k := range fc.CountedIn {
+			if k == cfg.Live || k == cfg.Building {
+				in = append(in, k)
+			}
+		}
+		if len(fc.CountedIn) == 0 && fc.Counted {
+			in = append(in, cfg.Live)
+		}
+		fc.Counted, fc.CountedIn = true, append(in, into)
+		mergeDeltas(summary, summaryDeltas(fc, boards))
 		ds := fc.Oldest.Format(dayFmt)
+		fc.CountedDay, fc.CountedBoard = ds, boards.canonical(fc.Name)
 		if _, ok := incrs[ds]; !ok {
 			incrs[ds] = map[string]int64{}
 		}
 
-		incrs[ds][fc.Name]++
+		for _, n := range dailyCountNames(fc, boards) {
+			incrs[ds][n]++
+		}
 	}
 
-	keys := []*datastore.Key{}
-	for k := range incrs {
-		keys = append(keys, datastore.NewKey(c, "DailyCounts", k, 0, nil))
-	}
-	if len(keys) == 0 {
+	if len(fckup) == 0 {
 		log.Debugf(c, "Nothing to do")
-		return nil
+		return nil, nil
 	}
-
-	counts := make([]DailyCounts, len(keys))
-	err := datastore.GetMulti(c, keys, counts)
-	if merr, ok := err.(appengine.MultiError); ok {
-		for i, e := range merr {
-			if e == datastore.ErrNoSuchEntity {
-				counts[i].Counts = map[string]int64{}
-			}
-		}
-		err = nil
-	}
-	if err != nil {
-		return err
-	}
-	for i, e := range counts {
-		i := incrs[keys[i].StringID()]
-		for k, v := range i {
-			e.Counts[k] += v
-		}
-	}
-	if len(fckup)+len(keys) == 0 {
-		log.Debugf(c, "Nothing to do")
-		return nil
+	if isDryRun(c) {
+		return fckup, nil
 	}
 
-	log.Infof(c, "Updating %v FoundControllers and %v DailyCounts",
-		len(fckup), len(keys))
+	log.Infof(c, "Updating %v FoundControllers across %v days",
+		len(fckup), len(incrs))
 
-	if len(keys) > 0 {
-		if _, err := datastore.PutMulti(c, keys, counts); err != nil {
-			return err
-		}
+	if _, err := datastore.PutMulti(c, fckup, fcup); err != nil {
+		return nil, err
 	}
 
-	if len(fckup) > 0 {
-		if _, err := datastore.PutMulti(c, fckup, fcup); err != nil {
-			return err
+	for day, deltas := range incrs {
+		if err := addCounters(c, into, day, dailyCountShards, deltas); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	return fckup, addCounters(c, usageSummaryKind, usageSummaryGroup, usageSummaryShards, summary)
 }
 
-func handleCountUsage(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	fckeys, err := decodeKeys(r.Body)
+// Params:
+// - into: the DailyCountShard kind to count into, for recomputes
+func mapCountUsage(c context.Context, params url.Values, fckeys []*datastore.Key) error {
+	// Recomputes count into a shadow kind; otherwise counts go to
+	// the live one.
+	cfg, err := loadCountsConfig(c)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return err
 	}
-
-	grp, cc := errgroup.WithContext(c)
-	usageSem := make(chan bool, 3)
-
-	for len(fckeys) > 0 {
-		n := 10
-		if n > len(fckeys) {
-			n = len(fckeys)
-		}
-		todo := fckeys[:n]
-		grp.Go(func() error {
-			// Rate limit this to avoid excessive transaction contention
-			usageSem <- true
-			defer func() { <-usageSem }()
-
-			return datastore.RunInTransaction(cc, func(tc context.Context) error {
-				return countSomeUsage(tc, todo)
-			}, &datastore.TransactionOptions{XG: true, Attempts: 10})
-		})
-		fckeys = fckeys[n:]
+	into := params.Get("into")
+	if into == "" {
+		into = cfg.Live
+	} else if !isCountShardKind(into) {
+		return fmt.Errorf("invalid counts kind: %q", into)
 	}
 
-	if err := grp.Wait(); err != nil {
-		log.Errorf(c, "Error counting usage: %v", err)
-		http.Error(w, err.Error(), 500)
-		return
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
 	}
 
-	w.WriteHeader(204)
+	// Up to 10 controllers, 10 days of counter shards and a summary
+	// shard fits in an XG transaction.
+	var counted []*datastore.Key
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var err error
+		counted, err = countSomeUsage(tc, fckeys, boards, into, cfg)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err == nil {
+		changed(c, counted...)
+	}
+	return err
 }
 
-func handleClearCountFlag(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	fckeys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// Params:
+// - summary: "keep" to leave UsageSummary contributions alone when
+// only the daily counts are being rebuilt
+func mapClearCountFlag(c context.Context, params url.Values, fckeys []*datastore.Key) error {
+	keepSummary := params.Get("summary") == "keep"
+
+	var cleared []*datastore.Key
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		fcs := make([]*FoundController, len(fckeys))
+		if err := datastore.GetMulti(tc, fckeys, fcs); err != nil {
+			return err
+		}
+		cleared = nil
+		for i, fc := range fcs {
+			if fc.Counted || len(fc.CountedIn) > 0 || (!keepSummary && fc.Summary != nil) {
+				cleared = append(cleared, fckeys[i])
+			}
+			fc.Counted, fc.CountedIn = false, nil
+			fc.CountedDay, fc.CountedBoard = "", ""
+			if !keepSummary {
+				fc.Summary = nil
+			}
+		}
+		if isDryRun(tc) {
+			return nil
+		}
+		_, err := datastore.PutMulti(tc, fckeys, fcs)
+		return err
+	}, &datastore.TransactionOptions{XG: true, Attempts: 10})
+	if err == nil {
+		changed(c, cleared...)
 	}
+	return err
+}
 
-	grp, cc := errgroup.WithContext(c)
-	for len(fckeys) > 0 {
-		n := 10
-		if n > len(fckeys) {
-			n = len(fckeys)
+// seedRollupMarkers marks reports as rolled up into every controller
+// they saw.
+func seedRollupMarkers(c context.Context, keys []*datastore.Key, stats []UsageStat) error {
+	var mks []*datastore.Key
+	var marks []rollupMarker
+	for i := range stats {
+		if err := stats[i].uncompress(); err != nil {
+			log.Infof(c, "Failed to decompress %v: %v", keys[i].Encode(), err)
+			continue
+		}
+		var rec struct {
+			BoardsSeen []usageSeenBoard
+		}
+		if err := json.Unmarshal(stats[i].Data, &rec); err != nil {
+			continue
+		}
+		for _, b := range rec.BoardsSeen {
+			uuid := seenUUID(b)
+			if uuid == "" {
+				continue
+			}
+			fk := datastore.NewKey(c, "FoundController", uuid, 0, nil)
+			mks = append(mks, datastore.NewKey(c, rollupMarkerKind, keys[i].Encode(), 0, fk))
+			marks = append(marks, rollupMarker{stats[i].Timestamp})
 		}
-		todo := fckeys[:n]
-		grp.Go(func() error {
-			return datastore.RunInTransaction(cc, func(tc context.Context) error {
-
-				fcs := make([]*FoundController, len(todo))
-				if err := datastore.GetMulti(c, todo, fcs); err != nil {
-					return err
-				}
-				for _, fc := range fcs {
-					fc.Counted = false
-				}
-				if _, err := datastore.PutMulti(c, todo, fcs); err != nil {
-					return err
-				}
-				return nil
-			}, &datastore.TransactionOptions{XG: true, Attempts: 10})
-		})
-		fckeys = fckeys[n:]
 	}
-
-	if err := grp.Wait(); err != nil {
-		log.Errorf(c, "Error counting usage: %v", err)
-		http.Error(w, err.Error(), 500)
-		return
+	changed(c, keys...)
+	if len(mks) == 0 || isDryRun(c) {
+		return nil
 	}
-
-	w.WriteHeader(204)
+	for len(mks) > 0 {
+		n := len(mks)
+		if n > markerBatch {
+			n = markerBatch
+		}
+		if _, err := datastore.PutMulti(c, mks[:n], marks[:n]); err != nil {
+			return err
+		}
+		mks, marks = mks[n:], marks[n:]
+	}
+	return nil
 }
 
-func handleProcessUsage(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	keys, err := decodeKeys(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+// Params:
+// - seed: "true" to only mark the reports as rolled up into their
+// controllers.  Reports stored before markers were kept have been
+// rolled up already, so this needs to run over them once before
+// replaying anything.
+func mapProcessUsage(c context.Context, params url.Values, keys []*datastore.Key) error {
 	log.Debugf(c, "Got %v keys to process", len(keys))
 
 	stats := make([]UsageStat, len(keys))
-	err = datastore.GetMulti(c, keys, stats)
+	err := datastore.GetMulti(c, keys, stats)
 	if err != nil {
 		log.Errorf(c, "Error grabbing all the stats from %v: %v", keys, err)
-		http.Error(w, err.Error(), 500)
-		return
+		return err
+	}
+
+	if params.Get("seed") == "true" {
+		return seedRollupMarkers(c, keys, stats)
+	}
+
+	// Rollups skip whatever they've already applied, so a dry run can
+	// only say which reports would be replayed.
+	if isDryRun(c) {
+		changed(c, keys...)
+		return nil
 	}
 
 	grp, _ := errgroup.WithContext(c)
 	var tasks []*taskqueue.Task
 	total := 0
-	for _, st := range stats {
+	for i, st := range stats {
 		err = st.uncompress()
 		if err != nil {
 			log.Warningf(c, "Failed to decompress record: %v", err)
@@ -559,15 +688,23 @@ func handleProcessUsage(w http.ResponseWriter, r *http.Request) {
 
 		rm := json.RawMessage(st.Data)
 		data := &asyncUsageData{
+			Key:       keys[i].Encode(),
 			IP:        st.Addr,
 			Country:   st.Country,
 			Region:    st.Region,
 			City:      st.City,
+			GeoSource: st.GeoSource,
 			Lat:       st.Lat,
 			Lon:       st.Lon,
 			Timestamp: st.Timestamp,
 			RawData:   &rm,
 		}
+		if unlocated(data.Country) {
+			loc := locate(c, nil, st.Addr)
+			data.Country, data.Region, data.City = loc.Country, loc.Region, loc.City
+			data.Lat, data.Lon = currentPrivacy().coords(loc.Lat, loc.Lon)
+			data.GeoSource = loc.Source
+		}
 
 		j, err := json.Marshal(data)
 		if err != nil {
@@ -609,11 +746,9 @@ func handleProcessUsage(w http.ResponseWriter, r *http.Request) {
 
 	if err := grp.Wait(); err != nil {
 		log.Errorf(c, "Error queueing stuff: %v", err)
-		http.Error(w, "error queueing", 500)
-		return
+		return err
 	}
 
 	log.Debugf(c, "Queued %v entries for batch processing", total)
-
-	w.WriteHeader(202)
+	return nil
 }
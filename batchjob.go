@@ -0,0 +1,410 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	batchJobKind       = "BatchJob"
+	batchJobCountsKind = "BatchJobCounts"
+	batchJobChunkKind  = "BatchJobChunk"
+	batchJobShards     = 10
+	batchJobHeader     = "X-Batch-Job"
+)
+
+func init() {
+	http.HandleFunc("/admin/jobs", handleJobs)
+	http.HandleFunc("/admin/jobs/list", handleJobsList)
+	http.HandleFunc("/admin/jobs/cancel", handleJobCancel)
+}
+
+// A batchJob is one run of /batch/map.  Chunk progress is kept in
+// sharded BatchJobCounts so chunks don't fight over the job.
+type batchJob struct {
+	mapSpec
+
+	State   string    `datastore:"state" json:"state"`
+	Started time.Time `datastore:"started" json:"started"`
+	Updated time.Time `datastore:"updated,noindex" json:"updated"`
+
+	// Reducer jobs go through "map", "reduce" and "done".  They stop
+	// polling while any of their tasks are dead lettered.
+	Phase   string `datastore:"phase,noindex" json:"phase,omitempty"`
+	Stalled bool   `datastore:"stalled,noindex" json:"stalled,omitempty"`
+
+	// A mutating mapper first runs as a dry run, whose Token starts
+	// the real run once it's done.  Each knows the other's key.
+	DryRun    bool           `datastore:"dry_run,noindex" json:"dry_run,omitempty"`
+	Token     string         `datastore:"token" json:"token,omitempty"`
+	Sample    []string       `datastore:"sample,noindex" json:"sample,omitempty"`
+	Confirmed *datastore.Key `datastore:"confirmed,noindex" json:"-"`
+	Preview   *datastore.Key `datastore:"preview,noindex" json:"-"`
+
+	// Keys enumerated and chunks queued so far, and whether the
+	// enumeration has finished.
+	Keys   int  `datastore:"keys,noindex" json:"keys"`
+	Tasks  int  `datastore:"tasks,noindex" json:"tasks"`
+	Listed bool `datastore:"listed,noindex" json:"listed"`
+
+	// Chunk outcomes and the framework's metrics, from the job's
+	// counters.  Failed chunks are those that have failed and not
+	// completed since; discarded ones were dead lettered and thrown
+	// away.
+	Completed int64         `datastore:"-" json:"completed"`
+	Failed    int64         `datastore:"-" json:"failed"`
+	Dead      int64         `datastore:"-" json:"dead"`
+	Discarded int64         `datastore:"-" json:"discarded"`
+	Processed int64         `datastore:"-" json:"processed"`
+	Retries   int64         `datastore:"-" json:"retries"`
+	MapTime   time.Duration `datastore:"-" json:"map_time"`
+
+	// What a mutating job changed, and for a confirmed run whether
+	// that's what its preview said it would.
+	Changed  int64  `datastore:"-" json:"changed"`
+	Digest   int64  `datastore:"-" json:"-"`
+	Verified string `datastore:"-" json:"verified,omitempty"`
+
+	ID  string         `datastore:"-" json:"id"`
+	Key *datastore.Key `datastore:"-" json:"-"`
+}
+
+func batchJobGroup(k *datastore.Key) string {
+	return fmt.Sprint(k.IntID())
+}
+
+func (j *batchJob) loadCounts(c context.Context) error {
+	counts, err := readCounters(c, batchJobCountsKind, batchJobGroup(j.Key), batchJobShards)
+	if err != nil {
+		return err
+	}
+	j.Completed, j.Failed, j.Dead = counts["completed"], counts["failed"], counts["dead"]
+	j.Discarded = counts["discarded"]
+	j.Processed, j.Retries = counts["keys"], counts["retries"]
+	j.MapTime = time.Duration(counts["ms"]) * time.Millisecond
+	j.Changed, j.Digest = counts["changed"], counts["digest"]
+	if (j.State == "running" || j.State == "failed") && j.Listed && j.Phase == "" {
+		// A job whose every chunk has completed or been dead lettered
+		// has failed.  Replaying its dead letters can still finish it.
+		state := j.State
+		switch tasks := int64(j.Tasks); {
+		case j.Completed >= tasks:
+			state = "done"
+		case j.Completed+j.Dead+j.Discarded >= tasks:
+			state = "failed"
+		}
+		if state != j.State {
+			j.State = state
+			if err := j.finish(c); err != nil {
+				return err
+			}
+		}
+	}
+	if j.Preview != nil && j.State == "done" {
+		return j.verify(c)
+	}
+	return nil
+}
+
+// batchJobChunk records that a chunk of a job has been counted, or
+// has failed, so a redelivered chunk isn't counted again.  They're
+// root entities so chunks don't fight over the job's entity group.
+type batchJobChunk struct {
+	Done   time.Time `datastore:"done,noindex"`
+	Failed bool      `datastore:"failed,noindex"`
+}
+
+func batchJobChunkKey(c context.Context, jobKey *datastore.Key, chunk string) *datastore.Key {
+	return datastore.NewKey(c, batchJobChunkKind, fmt.Sprintf("%d-%s", jobKey.IntID(), chunk), 0, nil)
+}
+
+// countChunk adds a completed chunk's counts to its job, unless it's
+// been counted already.  A chunk that failed before stops counting as
+// failed.
+func countChunk(c context.Context, jobKey *datastore.Key, keys []*datastore.Key, counts map[string]int64) error {
+	mk := batchJobChunkKey(c, jobKey, chunkID(keys))
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		ch := &batchJobChunk{}
+		err := datastore.Get(tc, mk, ch)
+		if err == nil && !ch.Done.IsZero() {
+			log.Infof(c, "Chunk %v of job %v was already counted", mk.StringID(), jobKey.IntID())
+			return nil
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		deltas := map[string]int64{}
+		for k, v := range counts {
+			deltas[k] = v
+		}
+		if ch.Failed {
+			deltas["failed"] = -1
+		}
+		ch.Done = time.Now()
+		if _, err := datastore.Put(tc, mk, ch); err != nil {
+			return err
+		}
+		return addCounters(tc, batchJobCountsKind, batchJobGroup(jobKey), batchJobShards, deltas)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// failChunk counts a chunk of a job as failed the first time it fails,
+// so Failed counts chunks rather than attempts.  Its retries are
+// counted every time.
+func failChunk(c context.Context, jobKey *datastore.Key, keys []*datastore.Key, retries int64) error {
+	mk := batchJobChunkKey(c, jobKey, chunkID(keys))
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		deltas := map[string]int64{"retries": retries}
+		switch err := datastore.Get(tc, mk, &batchJobChunk{}); err {
+		case datastore.ErrNoSuchEntity:
+			if _, err := datastore.Put(tc, mk, &batchJobChunk{Failed: true}); err != nil {
+				return err
+			}
+			deltas["failed"] = 1
+		case nil:
+		default:
+			return err
+		}
+		return addCounters(tc, batchJobCountsKind, batchJobGroup(jobKey), batchJobShards, deltas)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// finish saves that a job's done or failed, once its counts say so.
+// A done job's chunk records are thrown away; a failed job keeps them
+// for when its dead letters are replayed.
+func (j *batchJob) finish(c context.Context) error {
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		stored := &batchJob{}
+		if err := datastore.Get(tc, j.Key, stored); err != nil {
+			return err
+		}
+		if stored.State != "running" && stored.State != "failed" {
+			return nil
+		}
+		stored.State, stored.Updated = j.State, time.Now()
+		_, err := datastore.Put(tc, j.Key, stored)
+		return err
+	}, nil)
+	if err != nil || j.State != "done" {
+		return err
+	}
+
+	q := datastore.NewQuery(batchJobChunkKind).KeysOnly().
+		Filter("__key__ >=", batchJobChunkKey(c, j.Key, "")).
+		Filter("__key__ <", datastore.NewKey(c, batchJobChunkKind, fmt.Sprintf("%d.", j.Key.IntID()), 0, nil))
+	keys, err := q.GetAll(c, nil)
+	for err == nil && len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		err = datastore.DeleteMulti(c, keys[:n])
+		keys = keys[n:]
+	}
+	if err != nil {
+		log.Warningf(c, "Error cleaning up chunks of job %v: %v", j.Key.IntID(), err)
+	}
+	return nil
+}
+
+// Progress is the percentage of queued chunks that have completed.
+func (j *batchJob) Progress() int {
+	if j.Tasks == 0 {
+		if j.Listed {
+			return 100
+		}
+		return 0
+	}
+	return int(100 * j.Completed / int64(j.Tasks))
+}
+
+// startBatchJob records a job and queues the map that enumerates its
+// keys.  It can run inside a transaction.
+//
+// Mutating mappers run straight away; admin requests go through
+// startPreview and confirmPreview instead.
+func startBatchJob(c context.Context, spec mapSpec) (*datastore.Key, error) {
+	return startJob(c, &batchJob{mapSpec: spec})
+}
+
+func startJob(c context.Context, j *batchJob) (*datastore.Key, error) {
+	spec := j.mapSpec
+	m, ok := mappers[spec.Mapper]
+	if !ok {
+		return nil, fmt.Errorf("no such mapper: %q", spec.Mapper)
+	}
+	if !m.Accepts(spec.Kind) {
+		return nil, fmt.Errorf("%v doesn't map %v", spec.Mapper, spec.Kind)
+	}
+	if _, _, err := spec.query(c); err != nil {
+		return nil, err
+	}
+	_, isReducer := m.(reducer)
+	switch {
+	case isReducer && spec.Result == "":
+		spec.Result = spec.Mapper
+	case !isReducer && spec.Result != "":
+		return nil, fmt.Errorf("%v doesn't produce a result", spec.Mapper)
+	}
+
+	now := time.Now()
+	j.mapSpec, j.State, j.Started, j.Updated = spec, "running", now, now
+	if isReducer {
+		j.Phase = "map"
+	}
+	k, err := datastore.Put(c, datastore.NewIncompleteKey(c, batchJobKind, nil), j)
+	if err != nil {
+		return nil, err
+	}
+	if isReducer {
+		if err := queueReduce(c, k, reducePoll); err != nil {
+			return nil, err
+		}
+	}
+
+	form := spec.form()
+	form.Set("job", k.Encode())
+	_, err = taskqueue.Add(c, taskqueue.NewPOSTTask("/batch/map", form), mapStage1)
+	return k, err
+}
+
+func getBatchJob(c context.Context, k *datastore.Key) (*batchJob, error) {
+	j := &batchJob{}
+	if err := datastore.Get(c, k, j); err != nil {
+		return nil, err
+	}
+	j.Key, j.ID = k, k.Encode()
+	return j, nil
+}
+
+// recordListed notes the keys and chunks a /batch/map pass produced.
+func recordListed(c context.Context, k *datastore.Key, keys, tasks int, finished bool) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		j := &batchJob{}
+		if err := datastore.Get(tc, k, j); err != nil {
+			return err
+		}
+		j.Keys += keys
+		j.Tasks += tasks
+		j.Listed = finished
+		j.Updated = time.Now()
+		_, err := datastore.Put(tc, k, j)
+		return err
+	}, nil)
+}
+
+func recentBatchJobs(c context.Context, limit int) ([]*batchJob, error) {
+	var jobs []*batchJob
+	keys, err := datastore.NewQuery(batchJobKind).Order("-started").Limit(limit).GetAll(c, &jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	g, _ := errgroup.WithContext(c)
+	for i := range jobs {
+		j := jobs[i]
+		j.Key, j.ID = keys[i], keys[i].Encode()
+		g.Go(func() error { return j.loadCounts(c) })
+	}
+	return jobs, g.Wait()
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	jobs, err := recentBatchJobs(c, 50)
+	if err != nil {
+		log.Errorf(c, "Error fetching jobs: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	execTemplate(c, w, "jobs.html", struct {
+		Jobs    []*batchJob
+		Message string
+	}{jobs, r.FormValue("msg")})
+}
+
+// Params:
+// - id: a single job to report on; otherwise the 50 most recent
+func handleJobsList(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if id := r.FormValue("id"); id != "" {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		j, err := getBatchJob(c, k)
+		if err == nil {
+			err = j.loadCounts(c)
+		}
+		if err != nil {
+			log.Errorf(c, "Error fetching job %v: %v", id, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		mustEncode(c, w, r, j)
+		return
+	}
+
+	jobs, err := recentBatchJobs(c, 50)
+	if err != nil {
+		log.Errorf(c, "Error fetching jobs: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	mustEncode(c, w, r, jobs)
+}
+
+// cancelBatchJob stops a job from listing any more keys and has its
+// outstanding chunks dropped.  Only a running job can be cancelled.
+// It's meant to run in a transaction.
+func cancelBatchJob(c context.Context, k *datastore.Key) error {
+	j := &batchJob{}
+	if err := datastore.Get(c, k, j); err != nil {
+		return err
+	}
+	if j.State != "running" {
+		return permanent(fmt.Errorf("job %v is %v, not running", k.IntID(), j.State))
+	}
+	j.State, j.Updated = "cancelled", time.Now()
+	_, err := datastore.Put(c, k, j)
+	return err
+}
+
+func handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	k, err := datastore.DecodeKey(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		return cancelBatchJob(tc, k)
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "Error cancelling job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	log.Infof(c, "Cancelled job %v", k.IntID())
+	http.Redirect(w, r, "/admin/jobs?msg=Cancelled", http.StatusFound)
+}
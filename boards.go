@@ -0,0 +1,414 @@
+package autotown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/search"
+)
+
+const (
+	boardKind       = "Board"
+	boardCatalogKey = "boardCatalog"
+)
+
+// Boards are all kept in one entity group so reading the catalog is
+// strongly consistent right after an edit.  It's rarely written.
+func boardParent(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "BoardCatalog", "boards", 0, nil)
+}
+
+func boardKey(c context.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, boardKind, name, 0, boardParent(c))
+}
+
+// A boardInfo is what we know about one kind of flight controller.
+// It's keyed by its canonical name; reports naming any of its Aliases
+// are counted, indexed and exported under that name instead.
+type boardInfo struct {
+	Name         string          `datastore:"-" json:"name"`
+	Aliases      []string        `datastore:"aliases" json:"aliases,omitempty"`
+	Manufacturer string          `datastore:"manufacturer,noindex" json:"manufacturer,omitempty"`
+	MCU          string          `datastore:"mcu,noindex" json:"mcu,omitempty"`
+	Revisions    []boardRevision `datastore:"revisions,noindex" json:"revisions,omitempty"`
+	Images       []string        `datastore:"images,noindex" json:"images,omitempty"`
+	Links        []string        `datastore:"links,noindex" json:"links,omitempty"`
+	Updated      time.Time       `datastore:"updated,noindex" json:"updated"`
+}
+
+// A boardRevision names one of a board's hardware revisions, the low
+// byte of the ID it reports.
+type boardRevision struct {
+	Rev  int    `datastore:"rev" json:"rev"`
+	Name string `datastore:"name" json:"name"`
+}
+
+// Everything named after a board that a change of aliases affects.
+var boardReindexKinds = []string{"FoundController", "TuneResults", "UsageStat"}
+
+// What the catalog knows before anyone's edited it.  A stored board of
+// the same name replaces one of these.
+var defaultBoards = []*boardInfo{
+	{Name: "CC3D", Aliases: []string{"CopterControl"}},
+	{Name: "Revo", Aliases: []string{"Revolution", "RevoMini"}},
+}
+
+// A boardCatalog resolves board names.  A nil catalog leaves names
+// alone.
+type boardCatalog struct {
+	boards  map[string]*boardInfo
+	aliases map[string]string
+}
+
+func newBoardCatalog(stored []*boardInfo) *boardCatalog {
+	bc := &boardCatalog{boards: map[string]*boardInfo{}, aliases: map[string]string{}}
+	for _, bs := range [][]*boardInfo{defaultBoards, stored} {
+		for _, b := range bs {
+			bc.boards[b.Name] = b
+		}
+	}
+	for _, b := range bc.boards {
+		for _, a := range b.Aliases {
+			bc.aliases[a] = b.Name
+		}
+	}
+	return bc
+}
+
+func (bc *boardCatalog) canonical(name string) string {
+	if bc == nil {
+		return name
+	}
+	if n, ok := bc.aliases[name]; ok {
+		return n
+	}
+	return name
+}
+
+func (bc *boardCatalog) info(name string) *boardInfo {
+	if bc == nil {
+		return nil
+	}
+	return bc.boards[bc.canonical(name)]
+}
+
+// revName names a board's hardware revision, or just numbers it if
+// the catalog doesn't know it.
+func (bc *boardCatalog) revName(name string, rev int) string {
+	if b := bc.info(name); b != nil {
+		for _, r := range b.Revisions {
+			if r.Rev == rev && r.Name != "" {
+				return r.Name
+			}
+		}
+	}
+	return fmt.Sprint(rev)
+}
+
+func (bc *boardCatalog) list() []*boardInfo {
+	var rv []*boardInfo
+	for _, b := range bc.boards {
+		rv = append(rv, b)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+func fetchBoards(c context.Context) ([]*boardInfo, error) {
+	var rv []*boardInfo
+	keys, err := datastore.NewQuery(boardKind).Ancestor(boardParent(c)).GetAll(c, &rv)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		rv[i].Name = k.StringID()
+	}
+	return rv, nil
+}
+
+// loadBoards returns the board catalog, from memcache if it's there.
+func loadBoards(c context.Context) (*boardCatalog, error) {
+	var stored []*boardInfo
+	_, err := memcache.JSON.Get(c, boardCatalogKey, &stored)
+	if err != nil {
+		log.Debugf(c, "board catalog not found in cache: %v", err)
+		stored, err = fetchBoards(c)
+		if err != nil {
+			return nil, err
+		}
+		memcache.JSON.Set(c, &memcache.Item{
+			Key:        boardCatalogKey,
+			Object:     stored,
+			Expiration: time.Hour,
+		})
+	}
+	return newBoardCatalog(stored), nil
+}
+
+func init() {
+	registerMapper(kindMapper{name: "reindexBoards", kinds: boardReindexKinds,
+		batchSize: 20, concurrency: 5, mutates: true, f: mapReindexBoards})
+
+	http.HandleFunc("/admin/boards", handleBoards)
+	http.HandleFunc("/admin/boards/update", handleBoardUpdate)
+	http.HandleFunc("/admin/boards/delete", handleBoardDelete)
+}
+
+// mapReindexBoards brings what's recorded under board names in line
+// with the catalog: controllers keep the name they reported, but
+// their summary counts move to the board it now resolves to, and
+// search documents are rebuilt.  The daily counts only follow after a
+// recompute.
+func mapReindexBoards(c context.Context, params url.Values, keys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	switch keys[0].Kind() {
+	case "FoundController":
+		return resummarizeControllers(c, boards, keys)
+	case "TuneResults":
+		return reindexBoardDocs(c, "tunes", "board", keys, func(k *datastore.Key) ([]string, error) {
+			t := &TuneResults{}
+			if err := datastore.Get(c, k, t); err != nil {
+				return nil, err
+			}
+			return []string{boards.canonical(t.Board)}, nil
+		}, mapIndexTunes)
+	default:
+		return reindexBoardDocs(c, "usage", "name", keys, func(k *datastore.Key) ([]string, error) {
+			u := &UsageStat{}
+			if err := datastore.Get(c, k, u); err != nil {
+				return nil, err
+			}
+			u.Key = k
+			fields, _, err := (&UsageDoc{u, nil, boards}).Save()
+			return fieldStrings(fields, "name"), err
+		}, mapIndexUsage)
+	}
+}
+
+func resummarizeControllers(c context.Context, boards *boardCatalog, keys []*datastore.Key) error {
+	var upkeys []*datastore.Key
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		fcs := make([]*FoundController, len(keys))
+		if err := datastore.GetMulti(tc, keys, fcs); err != nil {
+			return err
+		}
+		upkeys = nil
+		var upfcs []*FoundController
+		deltas := map[string]int64{}
+		for i, fc := range fcs {
+			if d := summaryDeltas(fc, boards); len(d) > 0 {
+				mergeDeltas(deltas, d)
+				upkeys, upfcs = append(upkeys, keys[i]), append(upfcs, fc)
+			}
+		}
+		if len(upkeys) == 0 || isDryRun(c) {
+			return nil
+		}
+		if _, err := datastore.PutMulti(tc, upkeys, upfcs); err != nil {
+			return err
+		}
+		return addCounters(tc, usageSummaryKind, usageSummaryGroup, usageSummaryShards, deltas)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	changed(c, upkeys...)
+	return nil
+}
+
+func fieldStrings(fields []search.Field, name string) []string {
+	var rv []string
+	for _, f := range fields {
+		if f.Name != name {
+			continue
+		}
+		switch v := f.Value.(type) {
+		case string:
+			rv = append(rv, v)
+		case search.Atom:
+			rv = append(rv, string(v))
+		}
+	}
+	return rv
+}
+
+// reindexBoardDocs rebuilds the documents whose board fields aren't
+// what want says they should be now.
+func reindexBoardDocs(c context.Context, indexName, field string, keys []*datastore.Key,
+	want func(*datastore.Key) ([]string, error),
+	reindex func(context.Context, url.Values, []*datastore.Key) error) error {
+
+	index, err := search.Open(indexName)
+	if err != nil {
+		return err
+	}
+	var stale []*datastore.Key
+	for _, k := range keys {
+		var fl search.FieldList
+		err := index.Get(c, k.Encode(), &fl)
+		if err == search.ErrNoSuchDocument {
+			continue
+		} else if err != nil {
+			return err
+		}
+		w, err := want(k)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if strings.Join(w, "\x00") != strings.Join(fieldStrings(fl, field), "\x00") {
+			stale = append(stale, k)
+		}
+	}
+	changed(c, stale...)
+	if len(stale) == 0 || isDryRun(c) {
+		return nil
+	}
+	return reindex(c, nil, stale)
+}
+
+// startBoardReindex previews bringing everything in line with the
+// catalog after a change of aliases.  The previews are confirmed from
+// the jobs page.
+func startBoardReindex(c context.Context) (map[string]string, error) {
+	jobs := map[string]string{}
+	for _, kind := range boardReindexKinds {
+		k, err := startPreview(c, mapSpec{Kind: kind, Mapper: "reindexBoards"})
+		if err != nil {
+			return nil, err
+		}
+		jobs[kind] = k.Encode()
+	}
+	return jobs, nil
+}
+
+func handleBoards(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	boards, err := loadBoards(c)
+	if err != nil {
+		log.Errorf(c, "Error loading boards: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	mustEncode(c, w, r, boards.list())
+}
+
+func sameStrings(a, b []string) bool {
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+// handleBoardUpdate stores the board in the posted JSON, replacing
+// any of the same name.  If that changes what names resolve to, it
+// previews a reindex.
+func handleBoardUpdate(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	b := &boardInfo{}
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		http.Error(w, "error decoding board: "+err.Error(), 400)
+		return
+	}
+	b.Name = strings.TrimSpace(b.Name)
+	if b.Name == "" {
+		http.Error(w, "board has no name", 400)
+		return
+	}
+
+	stored, err := fetchBoards(c)
+	if err != nil {
+		log.Errorf(c, "Error loading boards: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	prev := newBoardCatalog(stored)
+	for _, a := range b.Aliases {
+		if n := prev.canonical(a); a == b.Name || (n != a && n != b.Name) || prev.boards[a] != nil {
+			http.Error(w, fmt.Sprintf("%v can't be an alias of %v", a, b.Name), 400)
+			return
+		}
+	}
+	if n := prev.canonical(b.Name); n != b.Name {
+		http.Error(w, fmt.Sprintf("%v is already an alias of %v", b.Name, n), 400)
+		return
+	}
+
+	b.Updated = time.Now()
+	if _, err := datastore.Put(c, boardKey(c, b.Name), b); err != nil {
+		log.Errorf(c, "Error storing board %v: %v", b.Name, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	memcache.Delete(c, boardCatalogKey)
+
+	rv := map[string]interface{}{"board": b}
+	// A new board has no aliases to start with.
+	var was []string
+	if old := prev.boards[b.Name]; old != nil {
+		was = old.Aliases
+	}
+	if !sameStrings(was, b.Aliases) {
+		if rv["reindex"], err = startBoardReindex(c); err != nil {
+			log.Errorf(c, "Error starting board reindex: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	log.Infof(c, "Updated board %v", b.Name)
+	mustEncode(c, w, r, rv)
+}
+
+// Params:
+// - name: the board to forget
+//
+// A built in board goes back to its defaults.
+func handleBoardDelete(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	name := r.FormValue("name")
+	k := boardKey(c, name)
+	old := &boardInfo{}
+	if err := datastore.Get(c, k, old); err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such board: "+name, 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := datastore.Delete(c, k); err != nil {
+		log.Errorf(c, "Error deleting board %v: %v", name, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	memcache.Delete(c, boardCatalogKey)
+
+	rv := map[string]interface{}{"deleted": name}
+	if len(old.Aliases) > 0 {
+		var err error
+		if rv["reindex"], err = startBoardReindex(c); err != nil {
+			log.Errorf(c, "Error starting board reindex: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	log.Infof(c, "Deleted board %v", name)
+	mustEncode(c, w, r, rv)
+}
@@ -0,0 +1,406 @@
+package autotown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/search"
+	"google.golang.org/appengine/user"
+)
+
+const (
+	controllerOwnerKind = "ControllerOwner"
+
+	// Controller profiles are cached briefly, as they're only ever
+	// looked at by their owners.
+	controllerProfileAge = 15 * time.Minute
+
+	// The most sightings the usage index returns.
+	maxSightings = 1000
+)
+
+func init() {
+	http.Handle("/api/controller/", corsHandleFunc(handleControllerProfile))
+	http.Handle("/api/claimController", corsHandleFunc(handleClaimController))
+}
+
+// A controllerOwner lists the users who've shown they own the
+// controller whose UUID it's keyed by.  Owning one means knowing its
+// raw CPU ID, which only the GCS it's plugged into does: reports have
+// raw IDs hashed before they're stored, so nothing we serve has them.
+type controllerOwner struct {
+	Users   []string  `datastore:"users"`
+	Claimed time.Time `datastore:"claimed,noindex"`
+}
+
+type controllerSighting struct {
+	Key       string    `json:"key"`
+	Timestamp time.Time `json:"timestamp"`
+	Location  string    `json:"location"`
+	OS        string    `json:"os,omitempty"`
+	Version   string    `json:"gcs_version,omitempty"`
+}
+
+// A firmwareRun is a stretch of sightings of a controller running
+// the same firmware.
+type firmwareRun struct {
+	Hash      string    `json:"hash"`
+	Tag       string    `json:"tag,omitempty"`
+	Label     string    `json:"label"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	Sightings int       `json:"sightings"`
+}
+
+type controllerProfile struct {
+	UUID       string               `json:"uuid"`
+	Controller *FoundController     `json:"controller"`
+	Firmware   []firmwareRun        `json:"firmware"`
+	Tunes      []profileTune        `json:"tunes"`
+	Sightings  []controllerSighting `json:"sightings"`
+	Countries  map[string]int       `json:"countries"`
+	Crashes    []CrashData          `json:"crashes"`
+}
+
+// controllerAccess reports whether the request may see the
+// controller's profile: admins and owners may.
+func controllerAccess(c context.Context, uuid string) (bool, error) {
+	u := user.Current(c)
+	if u == nil {
+		return false, nil
+	}
+	if u.Admin {
+		return true, nil
+	}
+	var o controllerOwner
+	err := datastore.Get(c, datastore.NewKey(c, controllerOwnerKind, uuid, 0, nil), &o)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, id := range o.Users {
+		if id == u.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// firmwareSighting is a controller seen running some firmware.
+type firmwareSighting struct {
+	Hash, Tag string
+	Timestamp time.Time
+}
+
+// firmwareHistory collapses sightings into the runs of firmware a
+// controller went through, oldest first.
+func firmwareHistory(seen []firmwareSighting, gitl []githubRef) []firmwareRun {
+	sort.Slice(seen, func(i, j int) bool { return seen[i].Timestamp.Before(seen[j].Timestamp) })
+	rv := []firmwareRun{}
+	for _, s := range seen {
+		if s.Hash == "" && s.Tag == "" {
+			continue
+		}
+		if n := len(rv); n > 0 && rv[n-1].Hash == s.Hash && rv[n-1].Tag == s.Tag {
+			rv[n-1].Last = s.Timestamp
+			rv[n-1].Sightings++
+			continue
+		}
+		rv = append(rv, firmwareRun{
+			Hash:      s.Hash,
+			Tag:       s.Tag,
+			Label:     refLabel(s.Hash, gitl),
+			First:     s.Timestamp,
+			Last:      s.Timestamp,
+			Sightings: 1,
+		})
+	}
+	return rv
+}
+
+// controllerSightings searches the usage index for reports of the
+// controller, most recent first.
+func controllerSightings(c context.Context, uuid string) ([]controllerSighting, error) {
+	index, err := search.Open("usage")
+	if err != nil {
+		return nil, err
+	}
+	it := index.Search(c, fmt.Sprintf("uuid:%q", uuid), &search.SearchOptions{
+		Limit: maxSightings,
+		Sort: &search.SortOptions{
+			Expressions: []search.SortExpression{
+				{Expr: "timestamp"},
+			},
+		},
+	})
+	rv := []controllerSighting{}
+	for {
+		var doc UsageDoc
+		_, err := it.Next(&doc)
+		if err == search.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		s := func(k string) string { v, _ := doc.m[k].(string); return v }
+		ts, _ := doc.m["timestamp"].(time.Time)
+		rv = append(rv, controllerSighting{s("id"), ts, strings.TrimSpace(s("location")), s("os"), s("version")})
+	}
+	return rv, nil
+}
+
+// sightingFirmware reads the firmware the controller reported in each
+// sighting's usage report, and where it was.  Compacted reports no
+// longer say.
+func sightingFirmware(c context.Context, uuid string, sightings []controllerSighting) ([]firmwareSighting, map[string]int, error) {
+	var keys []*datastore.Key
+	for _, s := range sightings {
+		k, err := datastore.DecodeKey(s.Key)
+		if err != nil {
+			log.Infof(c, "Bad usage key %q in index: %v", s.Key, err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	stats := make([]UsageStat, len(keys))
+	if err := datastore.GetMulti(c, keys, stats); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			for i, e := range me {
+				if e != nil && e != datastore.ErrNoSuchEntity {
+					return nil, nil, e
+				}
+				if e != nil {
+					log.Infof(c, "Usage %v is in the index but gone", keys[i].Encode())
+				}
+			}
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	var seen []firmwareSighting
+	countries := map[string]int{}
+	for _, u := range stats {
+		if u.Timestamp.IsZero() {
+			continue
+		}
+		countries[u.Country]++
+		for _, b := range usageBoards(&u) {
+			if b.UUID == uuid {
+				seen = append(seen, firmwareSighting{b.GitHash, b.GitTag, u.Timestamp})
+			}
+		}
+	}
+	return seen, countries, nil
+}
+
+func buildControllerProfile(c context.Context, uuid string) (*controllerProfile, error) {
+	rv := &controllerProfile{UUID: uuid, Countries: map[string]int{}, Crashes: []CrashData{}}
+	privacy := currentPrivacy()
+
+	var boards *boardCatalog
+	var gitl []githubRef
+	var tunes []TuneResults
+	var tuneKeys []*datastore.Key
+	var usageFirmware []firmwareSighting
+	var usageCountries map[string]int
+
+	g, _ := errgroup.WithContext(c)
+	g.Go(func() error {
+		var fc FoundController
+		err := datastore.Get(c, datastore.NewKey(c, "FoundController", uuid, 0, nil), &fc)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fc.Addr = privacy.exportAddr(fc.Addr)
+		fc.Lat, fc.Lon = privacy.coords(fc.Lat, fc.Lon)
+		rv.Controller = &fc
+		return nil
+	})
+	g.Go(func() error {
+		var err error
+		boards, err = loadBoards(c)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		if gitl, err = gitLabels(c); err != nil {
+			log.Warningf(c, "Couldn't resolve git labels: %v", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		q := datastore.NewQuery("TuneResults").Filter("uuid =", uuid).Order("-timestamp")
+		var err error
+		tuneKeys, err = q.GetAll(c, &tunes)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		if rv.Sightings, err = controllerSightings(c, uuid); err != nil {
+			return err
+		}
+		usageFirmware, usageCountries, err = sightingFirmware(c, uuid, rv.Sightings)
+		return err
+	})
+	g.Go(func() error {
+		q := datastore.NewQuery("CrashData").Filter("uuids =", uuid).Order("-timestamp")
+		for t := q.Run(c); ; {
+			var x CrashData
+			k, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			x.Key = k
+			x.redact(privacy)
+			rv.Crashes = append(rv.Crashes, x)
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if rv.Controller == nil && len(tunes) == 0 && len(rv.Sightings) == 0 {
+		return nil, nil
+	}
+
+	seen := usageFirmware
+	for k, v := range usageCountries {
+		rv.Countries[k] += v
+	}
+	rv.Tunes = []profileTune{}
+	for i, x := range tunes {
+		rv.Tunes = append(rv.Tunes, profileTune{tuneKeys[i], x.Timestamp, boards.canonical(x.Board), x.Tau, x.Country})
+		rv.Countries[x.Country]++
+		if err := x.uncompress(); err != nil {
+			log.Infof(c, "Error decompressing: %v", err)
+			continue
+		}
+		hash, tag := x.firmware()
+		seen = append(seen, firmwareSighting{hash, tag, x.Timestamp})
+	}
+	if fc := rv.Controller; fc != nil {
+		fc.Name = boards.canonical(fc.Name)
+		seen = append(seen, firmwareSighting{fc.GitHash, fc.GitTag, fc.Timestamp})
+	}
+	rv.Firmware = firmwareHistory(seen, gitl)
+	delete(rv.Countries, "")
+
+	return rv, nil
+}
+
+// Returns everything known about the controller whose UUID is the
+// rest of the path, to its owners and admins.  Owners claim their
+// controllers through /api/claimController.
+func handleControllerProfile(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	uuid := strings.TrimPrefix(r.URL.Path, "/api/controller/")
+	if uuid == "" {
+		http.Error(w, "no controller given", 400)
+		return
+	}
+	ok, err := controllerAccess(c, uuid)
+	if err != nil {
+		log.Errorf(c, "Error checking controller owner: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "not your controller", 403)
+		return
+	}
+
+	cacheKey := "controllerProfile." + uuid
+	var cached json.RawMessage
+	if err := gzCacheGet(c, cacheKey, &cached); err == nil && cached != nil {
+		mustEncode(c, w, r, cached)
+		return
+	}
+
+	rv, err := buildControllerProfile(c, uuid)
+	if err != nil {
+		log.Errorf(c, "Error building profile of %v: %v", uuid, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if rv == nil {
+		http.Error(w, "controller not found", 404)
+		return
+	}
+
+	gzCacheSet(c, cacheKey, controllerProfileAge, rv)
+	mustEncode(c, w, r, rv)
+}
+
+// handleClaimController makes the signed in user an owner of the
+// controller whose raw CPU ID is posted as cpu.
+func handleClaimController(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	u := user.Current(c)
+	if u == nil {
+		http.Error(w, "sign in to claim a controller", 401)
+		return
+	}
+	cpu := r.FormValue("cpu")
+	if !isRawUUID(cpu) {
+		http.Error(w, "a raw CPU ID is required", 400)
+		return
+	}
+	uuid := hashUUID(cpu)
+
+	fk := datastore.NewKey(c, "FoundController", uuid, 0, nil)
+	if err := datastore.Get(c, fk, &FoundController{}); err == datastore.ErrNoSuchEntity {
+		http.Error(w, "controller not found", 404)
+		return
+	} else if err != nil {
+		log.Errorf(c, "Error fetching controller %v: %v", uuid, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	ok := datastore.NewKey(c, controllerOwnerKind, uuid, 0, nil)
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var o controllerOwner
+		if err := datastore.Get(tc, ok, &o); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		for _, id := range o.Users {
+			if id == u.ID {
+				return nil
+			}
+		}
+		o.Users = append(o.Users, u.ID)
+		o.Claimed = time.Now()
+		_, err := datastore.Put(tc, ok, &o)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "Error claiming controller %v: %v", uuid, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof(c, "%v claimed controller %v", u.Email, uuid)
+	mustEncode(c, w, r, map[string]string{"uuid": uuid})
+}
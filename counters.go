@@ -0,0 +1,136 @@
+package autotown
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// CounterShard is one slice of a sharded counter group.  Writers
+// pick a random shard to update, readers merge every shard in the
+// group.
+type CounterShard struct {
+	Counts map[string]int64
+}
+
+func (s *CounterShard) Load(ps []datastore.Property) error {
+	s.Counts = map[string]int64{}
+	for _, p := range ps {
+		s.Counts[p.Name] = p.Value.(int64)
+	}
+	return nil
+}
+
+func (s *CounterShard) Save() ([]datastore.Property, error) {
+	rv := []datastore.Property{}
+	for k, v := range s.Counts {
+		rv = append(rv, datastore.Property{
+			Name:    k,
+			Value:   v,
+			NoIndex: true,
+		})
+	}
+	return rv, nil
+}
+
+func shardKey(c context.Context, kind, group string, n int) *datastore.Key {
+	return datastore.NewKey(c, kind, fmt.Sprintf("%s-%d", group, n), 0, nil)
+}
+
+// addCounters applies deltas to a random shard of the given group.
+// It doesn't start its own transaction, so callers can fold it into
+// whatever transaction they're already running.
+func addCounters(c context.Context, kind, group string, shards int, deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	k := shardKey(c, kind, group, rand.Intn(shards))
+	s := &CounterShard{}
+	if err := datastore.Get(c, k, s); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if s.Counts == nil {
+		s.Counts = map[string]int64{}
+	}
+	for name, v := range deltas {
+		s.Counts[name] += v
+		if s.Counts[name] == 0 {
+			delete(s.Counts, name)
+		}
+	}
+
+	_, err := datastore.Put(c, k, s)
+	return err
+}
+
+func incrCounters(c context.Context, kind, group string, shards int, deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		return addCounters(tc, kind, group, shards, deltas)
+	}, nil)
+}
+
+// readCounters merges all the shards of a counter group.
+func readCounters(c context.Context, kind, group string, shards int) (map[string]int64, error) {
+	keys := make([]*datastore.Key, shards)
+	for i := range keys {
+		keys[i] = shardKey(c, kind, group, i)
+	}
+
+	vals := make([]CounterShard, shards)
+	err := datastore.GetMulti(c, keys, vals)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return nil, e
+			}
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]int64{}
+	for _, s := range vals {
+		for k, v := range s.Counts {
+			rv[k] += v
+		}
+	}
+	return rv, nil
+}
+
+// readAllCounters merges the shards of every group of a kind, keyed
+// by group.
+func readAllCounters(c context.Context, kind string) (map[string]map[string]int64, error) {
+	var vals []CounterShard
+	keys, err := datastore.NewQuery(kind).GetAll(c, &vals)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]map[string]int64{}
+	for i, k := range keys {
+		group := k.StringID()
+		if n := strings.LastIndex(group, "-"); n >= 0 {
+			group = group[:n]
+		}
+		m, ok := rv[group]
+		if !ok {
+			m = map[string]int64{}
+			rv[group] = m
+		}
+		for name, v := range vals[i].Counts {
+			m[name] += v
+		}
+	}
+	return rv, nil
+}
@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/dustin/go-jsonpointer"
+
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
@@ -28,8 +33,17 @@ type CrashData struct {
 }
 
 func (c *CrashData) Load(ps []datastore.Property) error {
+	ps, _, err := migrateProps("CrashData", ps)
+	if err != nil {
+		return err
+	}
 	c.properties = map[string]interface{}{}
 	for _, p := range ps {
+		if p.Multiple {
+			l, _ := c.properties[p.Name].([]interface{})
+			c.properties[p.Name] = append(l, p.Value)
+			continue
+		}
 		c.properties[p.Name] = p.Value
 		if os, ok := p.Value.(string); ok && p.Name == "os" {
 			c.properties["os_abbrev"] = abbrevOS(os)
@@ -45,15 +59,26 @@ func (c *CrashData) Save() ([]datastore.Property, error) {
 		if n == "" {
 			n = k
 		}
-		if n == "os_abbrev" {
-			continue
+		switch vs := v.(type) {
+		case []string:
+			for _, x := range vs {
+				rv = append(rv, datastore.Property{Name: n, Value: x, Multiple: true})
+			}
+		case []interface{}:
+			for _, x := range vs {
+				rv = append(rv, datastore.Property{Name: n, Value: x, Multiple: true})
+			}
+		default:
+			if n == "os_abbrev" {
+				continue
+			}
+			rv = append(rv, datastore.Property{
+				Name:  n,
+				Value: v,
+			})
 		}
-		rv = append(rv, datastore.Property{
-			Name:  n,
-			Value: v,
-		})
 	}
-	return rv, nil
+	return versioned("CrashData", rv), nil
 }
 
 func (c CrashData) MarshalJSON() ([]byte, error) {
@@ -66,6 +91,16 @@ func (c *CrashData) setKey(to *datastore.Key) {
 	c.Key = to
 }
 
+func (c *CrashData) redact(p privacyPolicy) {
+	if addr, ok := c.properties["addr"].(string); ok {
+		c.properties["addr"] = p.exportAddr(addr)
+	}
+	if lat, ok := c.properties["lat"].(float64); ok {
+		lon, _ := c.properties["lon"].(float64)
+		c.properties["lat"], c.properties["lon"] = p.coords(lat, lon)
+	}
+}
+
 type timestampedTau struct {
 	Tau       float64        `json:"tau"`
 	Timestamp time.Time      `json:"timestamp"`
@@ -90,9 +125,13 @@ type TuneDoc struct {
 }
 
 func indexDoc(c context.Context, tune *TuneResults) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
 	doc := &TuneDoc{
 		Timestamp:    tune.Timestamp,
-		Board:        search.Atom(canonicalBoard(tune.Board)),
+		Board:        search.Atom(boards.canonical(tune.Board)),
 		VehicleType:  search.Atom(jptrs(c, tune.Orig, "/vehicle/type")),
 		Observation:  jptrs(c, tune.Orig, "/userObservations"),
 		Tau:          tune.Tau * 1000,
@@ -126,6 +165,7 @@ type TuneResults struct {
 	City      string    `datastore:"city"`
 	Lat       float64   `datastore:"lat"`
 	Lon       float64   `datastore:"lon"`
+	GeoSource string    `datastore:"geo_source" json:"-"`
 
 	// Fields raised out of the JSON for querying
 	UUID  string  `datastore:"uuid", json:"-"`
@@ -140,6 +180,14 @@ type TuneResults struct {
 	Experimental interface{} `datastore:"-" json:"experimental,omitempty"`
 }
 
+func (t *TuneResults) Load(ps []datastore.Property) error {
+	return loadMigrated("TuneResults", t, ps)
+}
+
+func (t *TuneResults) Save() ([]datastore.Property, error) {
+	return saveVersioned("TuneResults", t)
+}
+
 func (u *TuneResults) setKey(to *datastore.Key) {
 	u.Key = to
 }
@@ -198,6 +246,14 @@ func (t *TuneResults) uncompress() error {
 	return nil
 }
 
+// firmware returns the commit and tag of the firmware an uncompressed
+// tune was flown with.
+func (t *TuneResults) firmware() (hash, tag string) {
+	jsonpointer.FindDecode(t.Data, "/vehicle/firmware/commit", &hash)
+	jsonpointer.FindDecode(t.Data, "/vehicle/firmware/tag", &tag)
+	return hash, tag
+}
+
 type UsageStat struct {
 	Data      []byte    `datastore:"data" json:"-"`
 	Timestamp time.Time `datastore:"timestamp"`
@@ -207,6 +263,13 @@ type UsageStat struct {
 	City      string    `datastore:"city"`
 	Lat       float64   `datastore:"lat"`
 	Lon       float64   `datastore:"lon"`
+	GeoSource string    `datastore:"geo_source" json:"-"`
+
+	// Set once a retention policy has compacted or archived the
+	// report, in which case Data is gone.
+	Summary   string `datastore:"summary,noindex" json:",omitempty"`
+	Retention string `datastore:"retention,noindex" json:",omitempty"`
+	Archive   string `datastore:"archive,noindex" json:",omitempty"`
 
 	Orig *json.RawMessage `datastore:"-" json:",omitempty"`
 	Key  *datastore.Key   `datastore:"-"`
@@ -235,14 +298,19 @@ func indexUsage(c context.Context, k string, u *UsageStat) error {
 	if err != nil {
 		return err
 	}
-	udoc := &UsageDoc{u, nil}
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	udoc := &UsageDoc{u, nil, boards}
 	_, err = index.Put(c, k, udoc)
 	return err
 }
 
 type UsageDoc struct {
-	s *UsageStat
-	m map[string]interface{}
+	s      *UsageStat
+	m      map[string]interface{}
+	boards *boardCatalog
 }
 
 type uuidboard struct {
@@ -285,11 +353,6 @@ func (u *UsageDoc) Save() ([]search.Field, *search.DocumentMetadata, error) {
 		{Name: "location", Value: u.s.City + " " + u.s.Region + " " + u.s.Country},
 	}
 
-	d, err := ungz(u.s.Data)
-	if err != nil {
-		d = u.s.Data
-	}
-
 	var o struct {
 		Boards []struct {
 			UUID string
@@ -299,15 +362,49 @@ func (u *UsageDoc) Save() ([]search.Field, *search.DocumentMetadata, error) {
 			File, Function, Level, Message string
 		}
 		OS      string `json:"currentOS"`
+		Arch    string `json:"currentArch"`
 		Version string `json:"gcs_version"`
 	}
-	if err := json.Unmarshal(d, &o); err != nil {
+	var summaryBoards []string
+	var err error
+	if u.s.Retention != "" {
+		// Compacted and archived reports only have their summary,
+		// which names boards but not their UUIDs.
+		var sum struct {
+			OS      string   `json:"currentOS"`
+			Arch    string   `json:"currentArch"`
+			Version string   `json:"gcs_version"`
+			Boards  []string `json:"boards"`
+		}
+		err = json.Unmarshal([]byte(u.s.Summary), &sum)
+		o.OS, o.Arch, o.Version = sum.OS, sum.Arch, sum.Version
+		summaryBoards = sum.Boards
+	} else {
+		d, uerr := ungz(u.s.Data)
+		if uerr != nil {
+			d = u.s.Data
+		}
+		err = json.Unmarshal(d, &o)
+	}
+	if err != nil {
 		// Logging seems to fail me here, and I don't
 		// necessarily want to fail the whole thing.
 	} else {
 		fields = append(fields, search.Field{Name: "os", Value: o.OS})
 		fields = append(fields, search.Field{Name: "version", Value: o.Version})
 
+		p := parsePlatform(o.OS, o.Arch, o.Version)
+		fields = append(fields,
+			search.Field{Name: "os_family", Value: search.Atom(p.OSFamily)},
+			search.Field{Name: "os_distro", Value: search.Atom(p.OSDistro)},
+			search.Field{Name: "os_version", Value: search.Atom(p.OSVersion)},
+			search.Field{Name: "os_kernel", Value: search.Atom(p.OSKernel)},
+			search.Field{Name: "os_build", Value: float64(p.OSBuild)},
+			search.Field{Name: "arch", Value: search.Atom(p.Arch)},
+			search.Field{Name: "gcs_semver", Value: search.Atom(p.GCSVersion)},
+			search.Field{Name: "gcs_pre", Value: search.Atom(p.GCSPre)},
+			search.Field{Name: "gcs_commit", Value: search.Atom(p.GCSCommit)})
+
 		seen := map[string]bool{}
 		for _, s := range o.Boards {
 			if seen[s.UUID] {
@@ -315,24 +412,15 @@ func (u *UsageDoc) Save() ([]search.Field, *search.DocumentMetadata, error) {
 			}
 			seen[s.UUID] = true
 			fields = append(fields, search.Field{Name: "uuid", Value: s.UUID})
-			fields = append(fields, search.Field{Name: "name", Value: s.Name})
+			fields = append(fields, search.Field{Name: "name", Value: u.boards.canonical(s.Name)})
+		}
+		for _, n := range summaryBoards {
+			fields = append(fields, search.Field{Name: "name", Value: u.boards.canonical(n)})
 		}
 
 		maxLvl := 0.0
 		for _, d := range o.DebugLog {
-			lvl := 0.0
-			switch d.Level {
-			case "debug":
-				lvl = 1.0
-			case "info":
-				lvl = 2.0
-			case "warning":
-				lvl = 3.0
-			case "critical":
-				lvl = 4.0
-			case "fatal":
-				lvl = 5.0
-			}
+			lvl := float64(debugLevel(d.Level))
 			if lvl > maxLvl {
 				maxLvl = lvl
 			}
@@ -358,21 +446,54 @@ type FoundController struct {
 	UAVOHash    string `datastore:"uavo_hash"`
 
 	GCSOS      string `datastore:"gcs_os"`
-	GCSArch    string `datastore:"gss_arch"`
+	GCSArch    string `datastore:"gcs_arch"`
 	GCSVersion string `datastore:"gcs_version"`
 
+	// Parsed from the GCS fields whenever it's saved.
+	Platform gcsPlatform `datastore:"platform"`
+
 	Addr      string    `datastore:"addr"`
 	Country   string    `datastore:"country"`
 	Region    string    `datastore:"region"`
 	City      string    `datastore:"city"`
 	Lat       float64   `datastore:"lat"`
 	Lon       float64   `datastore:"lon"`
+	GeoSource string    `datastore:"geo_source"`
 	Oldest    time.Time `datastore:"oldest_timestamp"`
 	Timestamp time.Time `datastore:"timestamp"`
 
 	Counted bool `datastore:"counted"`
+	// The daily count kinds the controller has been counted into,
+	// live and being recomputed, and the day and board it was last
+	// counted under.  Oldest can move earlier and aliases can rename
+	// boards afterwards.
+	CountedIn    []string `datastore:"counted_in,noindex"`
+	CountedDay   string   `datastore:"counted_day,noindex"`
+	CountedBoard string   `datastore:"counted_board,noindex"`
+
+	// Summary counters this controller currently contributes to.
+	Summary []string `datastore:"summary,noindex"`
 }
 
+func (f *FoundController) Load(ps []datastore.Property) error {
+	return loadMigrated("FoundController", f, ps)
+}
+
+func (f *FoundController) Save() ([]datastore.Property, error) {
+	return saveVersioned("FoundController", f)
+}
+
+const (
+	dailyCountShardKind = "DailyCountShard"
+	dailyCountShards    = 20
+)
+
+// DailyCounts holds the number of controllers first seen on a day.
+// Plain board names count boards; the other dimensions are stored as
+// "<dimension>|<series...>", see dailyCountNames.
+//
+// New counts go to DailyCountShard counters grouped by day.  Older
+// DailyCounts entities are still read and added in.
 type DailyCounts struct {
 	Day    string           `json:"day"`
 	Counts map[string]int64 `json:"counts"`
@@ -380,6 +501,77 @@ type DailyCounts struct {
 	key *datastore.Key
 }
 
+// Dimensions /api/boardCounts can break counts down by, and the
+// prefix they're stored under.
+var countDimensions = map[string]string{
+	"board":         "",
+	"board_rev":     "rev",
+	"board_country": "country",
+	"board_ref":     "ref",
+	"os_arch":       "os",
+}
+
+// refLabel names the firmware a controller runs the way the counts
+// do, by the first git label at its hash.
+func refLabel(hash string, gitl []githubRef) string {
+	if hash != "" {
+		if lbls := gitDescribe(hash, gitl); lbls != nil {
+			return lbls[0].Label
+		}
+	}
+	return "Unknown"
+}
+
+// commitRE matches a commit hash, full or abbreviated.
+var commitRE = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// dailyCountNames returns the counts a controller adds to.  Firmware
+// is counted by commit, since the label at a commit can move; see
+// labelRefs.
+func dailyCountNames(fc *FoundController, boards *boardCatalog) []string {
+	bn := boards.canonical(fc.Name)
+	ref := fc.GitHash
+	if !commitRE.MatchString(ref) {
+		ref = "Unknown"
+	}
+	return []string{
+		bn,
+		"rev|" + bn + "|" + fmt.Sprint(fc.HardwareRev),
+		"country|" + bn + "|" + fc.Country,
+		"ref|" + bn + "|" + ref,
+		"os|" + abbrevOS(fc.GCSOS) + "|" + fc.GCSArch,
+	}
+}
+
+// labelRefs rewrites a day's firmware counts from commits to the
+// first label at each commit as of now.  Firmware that reported no
+// commit stays "Unknown".
+func labelRefs(counts map[string]int64, gitl []githubRef) map[string]int64 {
+	rv := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		if parts := strings.Split(k, "|"); len(parts) == 3 && parts[0] == "ref" && commitRE.MatchString(parts[2]) {
+			k = "ref|" + parts[1] + "|" + refLabel(parts[2], gitl)
+		}
+		rv[k] += v
+	}
+	return rv
+}
+
+// dimension returns the counts for one dimension, keyed by series.
+func (c DailyCounts) dimension(prefix string) DailyCounts {
+	rv := DailyCounts{Day: c.Day, Counts: map[string]int64{}}
+	for k, v := range c.Counts {
+		parts := strings.Split(k, "|")
+		switch {
+		case prefix == "" && len(parts) == 1:
+			rv.Counts[k] = v
+		case prefix != "" && len(parts) > 1 && parts[0] == prefix:
+			rv.Counts[strings.Join(parts[1:], " / ")] += v
+		}
+	}
+	return rv
+}
+
 func (c *DailyCounts) Load(ps []datastore.Property) error {
 	c.Counts = map[string]int64{}
 	for _, p := range ps {
@@ -0,0 +1,402 @@
+package autotown
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	deadLetterKind = "DeadLetter"
+
+	// A task that's still failing after this many retries is dead
+	// lettered rather than retried until its queue gives up on it.
+	deadLetterRetries = 25
+)
+
+func init() {
+	http.HandleFunc("/admin/deadLetters", handleDeadLetters)
+	http.HandleFunc("/admin/deadLetters/replay", handleDeadLetterReplay)
+	http.HandleFunc("/admin/deadLetters/discard", handleDeadLetterDiscard)
+}
+
+// A deadLetter is a task we gave up on, kept so it can be looked at
+// and either replayed onto its queue or discarded.
+type deadLetter struct {
+	Queue   string   `datastore:"queue" json:"queue"`
+	Task    string   `datastore:"task,noindex" json:"task"`
+	Method  string   `datastore:"method,noindex" json:"method"`
+	Path    string   `datastore:"path,noindex" json:"path"`
+	Headers []string `datastore:"headers,noindex" json:"headers"`
+	Payload []byte   `datastore:"payload,noindex" json:"payload,omitempty"`
+	Size    int      `datastore:"size,noindex" json:"size"`
+
+	Retries int       `datastore:"retries,noindex" json:"retries"`
+	Status  int       `datastore:"status,noindex" json:"status"`
+	Error   string    `datastore:"error,noindex" json:"error"`
+	Created time.Time `datastore:"created" json:"created"`
+
+	ID string `datastore:"-" json:"id"`
+}
+
+// A permanentError is one retrying won't fix, such as a payload that
+// doesn't parse.  Handlers report them with a 4xx, which dead letters
+// the task straight away.
+type permanentError struct {
+	error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func errorStatus(err error) int {
+	if _, ok := err.(permanentError); ok {
+		return 400
+	}
+	return 500
+}
+
+// Headers not worth replaying, as the task queue sets its own.
+var unreplayedHeaders = []string{"X-Appengine-", "X-Google-", "X-Cloud-", "X-Forwarded-",
+	"Content-Length", "Host", "User-Agent", "Accept-Encoding", "Traceparent"}
+
+func (d *deadLetter) task() *taskqueue.Task {
+	h := http.Header{}
+	for _, line := range d.Headers {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		replay := true
+		for _, p := range unreplayedHeaders {
+			if strings.HasPrefix(parts[0], p) {
+				replay = false
+			}
+		}
+		if replay {
+			h.Add(parts[0], parts[1])
+		}
+	}
+	return &taskqueue.Task{
+		Method:  d.Method,
+		Path:    d.Path,
+		Header:  h,
+		Payload: d.Payload,
+	}
+}
+
+// job is the batch job a dead lettered map chunk belongs to, if any.
+func (d *deadLetter) job() *datastore.Key {
+	for _, line := range d.Headers {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 && http.CanonicalHeaderKey(parts[0]) == batchJobHeader {
+			if k, err := datastore.DecodeKey(parts[1]); err == nil {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+// countDead keeps a job's count of dead lettered chunks, so whatever
+// waits on the job can tell it won't finish by itself.
+func (d *deadLetter) countDead(c context.Context, delta int64) error {
+	return d.countJob(c, map[string]int64{"dead": delta})
+}
+
+// countJob adds to the counters of the letter's job, if it has one.
+func (d *deadLetter) countJob(c context.Context, deltas map[string]int64) error {
+	jk := d.job()
+	if jk == nil {
+		return nil
+	}
+	return addCounters(c, batchJobCountsKind, batchJobGroup(jk), batchJobShards, deltas)
+}
+
+// bufferedResponse holds onto a task handler's response until we know
+// whether the task should be dead lettered instead.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) code() int {
+	if b.status == 0 {
+		return 200
+	}
+	return b.status
+}
+
+func (b *bufferedResponse) copyTo(w http.ResponseWriter) {
+	for k, vs := range b.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(b.code())
+	w.Write(b.body.Bytes())
+}
+
+// deadLetters wraps a task handler so a task that fails with a 4xx, or
+// with a 5xx after deadLetterRetries retries, is stored as a
+// deadLetter and acknowledged.  A 503 means the handler is backing off
+// and is always retried.  Requests that aren't tasks pass straight
+// through.
+//
+// A dead lettered map chunk is counted as dead until it's replayed or
+// discarded.  A job left with nothing but dead chunks has failed.
+func deadLetters(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue := r.Header.Get("X-AppEngine-QueueName")
+		if queue == "" {
+			h(w, r)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+
+		res := &bufferedResponse{header: http.Header{}}
+		h(res, r)
+
+		status := res.code()
+		retries, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+		if status < 400 || status == 503 || (status >= 500 && retries < deadLetterRetries) {
+			res.copyTo(w)
+			return
+		}
+
+		c := appengine.NewContext(r)
+		var headers []string
+		for k, vs := range r.Header {
+			for _, v := range vs {
+				headers = append(headers, k+": "+v)
+			}
+		}
+		task := r.Header.Get("X-AppEngine-TaskName")
+		d := &deadLetter{
+			Queue:   queue,
+			Task:    task,
+			Method:  r.Method,
+			Path:    r.URL.RequestURI(),
+			Headers: headers,
+			Payload: payload,
+			Size:    len(payload),
+			Retries: retries,
+			Status:  status,
+			Error:   strings.TrimSpace(res.body.String()),
+			Created: time.Now(),
+		}
+		// Named after the task so a redelivery doesn't make another.
+		k := datastore.NewKey(c, deadLetterKind, queue+"-"+task, 0, nil)
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			switch err := datastore.Get(tc, k, &deadLetter{}); err {
+			case datastore.ErrNoSuchEntity:
+				if err := d.countDead(tc, 1); err != nil {
+					return err
+				}
+			case nil:
+			default:
+				return err
+			}
+			_, err := datastore.Put(tc, k, d)
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			log.Errorf(c, "Error storing dead letter for %v task %v: %v", queue, task, err)
+			res.copyTo(w)
+			return
+		}
+
+		log.Warningf(c, "Dead lettered %v task %v to %v after %v retries (%v: %v)",
+			queue, task, d.Path, retries, status, d.Error)
+		w.WriteHeader(204)
+	}
+}
+
+// deadLetterKeys finds the letters a request is about: either the
+// listed ids or up to 500 from a queue.
+func deadLetterKeys(c context.Context, r *http.Request) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	for _, id := range r.Form["id"] {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if k.Kind() != deadLetterKind {
+			return nil, fmt.Errorf("%v isn't a dead letter", id)
+		}
+		keys = append(keys, k)
+	}
+	if q := r.FormValue("queue"); q != "" {
+		qk, err := datastore.NewQuery(deadLetterKind).Filter("queue =", q).Limit(500).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, qk...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no id or queue given")
+	}
+	return keys, nil
+}
+
+// Params:
+// - id: a single dead letter to report on, payload included
+// - queue: only letters from this queue
+// - limit: how many letters to list (default 100)
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if id := r.FormValue("id"); id != "" {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		d := &deadLetter{}
+		if err := datastore.Get(c, k, d); err != nil {
+			log.Errorf(c, "Error fetching dead letter %v: %v", id, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		d.ID = id
+		mustEncode(c, w, r, d)
+		return
+	}
+
+	limit := 100
+	if ls := r.FormValue("limit"); ls != "" {
+		var err error
+		if limit, err = strconv.Atoi(ls); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	q := datastore.NewQuery(deadLetterKind).Order("-created").Limit(limit)
+	if queue := r.FormValue("queue"); queue != "" {
+		q = q.Filter("queue =", queue)
+	}
+	letters := []*deadLetter{}
+	keys, err := q.GetAll(c, &letters)
+	if err != nil {
+		log.Errorf(c, "Error fetching dead letters: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i, d := range letters {
+		d.ID, d.Payload = keys[i].Encode(), nil
+	}
+	mustEncode(c, w, r, letters)
+}
+
+// Params:
+// - id: a letter to put back on its queue (repeatable)
+// - queue: replay up to 500 letters from this queue
+func handleDeadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	r.ParseForm()
+	keys, err := deadLetterKeys(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	replayed := 0
+	for _, k := range keys {
+		// The task is only added if the letter's deleted, so a letter
+		// can't be replayed twice.
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			d := &deadLetter{}
+			if err := datastore.Get(tc, k, d); err != nil {
+				return err
+			}
+			if _, err := taskqueue.Add(tc, d.task(), d.Queue); err != nil {
+				return err
+			}
+			if err := d.countDead(tc, -1); err != nil {
+				return err
+			}
+			if jk := d.job(); jk != nil {
+				if err := resumeReduce(tc, jk); err != nil {
+					return err
+				}
+			}
+			return datastore.Delete(tc, k)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			log.Errorf(c, "Error replaying dead letter %v: %v", k.StringID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		replayed++
+	}
+
+	log.Infof(c, "Replayed %v dead letters", replayed)
+	mustEncode(c, w, r, map[string]int{"replayed": replayed})
+}
+
+// Params:
+// - id: a letter to throw away (repeatable)
+// - queue: discard up to 500 letters from this queue
+func handleDeadLetterDiscard(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	r.ParseForm()
+	keys, err := deadLetterKeys(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	discarded := 0
+	for _, k := range keys {
+		// A discarded chunk is one its job will never complete.
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			d := &deadLetter{}
+			if err := datastore.Get(tc, k, d); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := d.countJob(tc, map[string]int64{"dead": -1, "discarded": 1}); err != nil {
+				return err
+			}
+			return datastore.Delete(tc, k)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			log.Errorf(c, "Error discarding dead letter %v: %v", k.StringID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		discarded++
+	}
+
+	log.Infof(c, "Discarded %v dead letters", discarded)
+	mustEncode(c, w, r, map[string]int{"discarded": discarded})
+}
@@ -0,0 +1,448 @@
+package autotown
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	debugCountsKind   = "DebugCounts"
+	debugCountsShards = 10
+	debugTemplateKind = "DebugTemplate"
+
+	// Kept under each UsageStat whose debug log has been counted.
+	debugLogMarkerKind = "DebugLogApplied"
+
+	maxDebugDays  = 90
+	maxDebugLimit = 100
+)
+
+func init() {
+	http.Handle("/api/debugLog/top", corsHandleFunc(handleDebugLogTop))
+	registerMapper(kindMapper{name: "debugLog", kinds: []string{"UsageStat"},
+		batchSize: 100, concurrency: 1, mutates: true, f: mapDebugLog})
+}
+
+var (
+	debugHexRE  = regexp.MustCompile(`\b(?:0[xX][0-9a-fA-F]+|[0-9a-fA-F]{8,})\b`)
+	debugPathRE = regexp.MustCompile(`(?:[A-Za-z]:)?(?:[\\/][^\s\\/:"'()]+){2,}[\\/]?`)
+	debugNumRE  = regexp.MustCompile(`[-+]?\d+(?:\.\d+)?`)
+
+	debugLevels = map[string]int{
+		"debug":    1,
+		"info":     2,
+		"warning":  3,
+		"critical": 4,
+		"fatal":    5,
+	}
+)
+
+func debugLevel(s string) int {
+	return debugLevels[s]
+}
+
+// debugTemplate reduces a GCS debug message to something that's the
+// same across occurrences by stripping out paths, hex and numbers.
+func debugTemplate(msg string) string {
+	msg = debugPathRE.ReplaceAllString(msg, "<path>")
+	msg = debugHexRE.ReplaceAllString(msg, "<hex>")
+	msg = debugNumRE.ReplaceAllString(msg, "<n>")
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+func debugTemplateID(file, function, tmpl string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", file, function, tmpl)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+type DebugTemplate struct {
+	Template string `datastore:"template,noindex" json:"template"`
+	// The raw message may hold paths, serials and hostnames, so it
+	// stays out of the public API.
+	Example   string    `datastore:"example,noindex" json:"-"`
+	File      string    `datastore:"file" json:"file"`
+	Function  string    `datastore:"function" json:"function"`
+	Level     int       `datastore:"level" json:"level"`
+	FirstSeen time.Time `datastore:"first_seen" json:"first_seen"`
+}
+
+type debugEntry struct {
+	File, Function, Level, Message string
+}
+
+func debugLogMarkerKey(c context.Context, usageKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, debugLogMarkerKind, "debugLog", 0, usageKey)
+}
+
+// debugLogRollup counts the debug messages from a single usage
+// report, once.  A marker under the report records that it was
+// counted, so retries and replays leave the counts alone.
+func debugLogRollup(c context.Context, usageKey *datastore.Key, ts time.Time, raw []byte) error {
+	var rec struct {
+		DebugLog   []debugEntry
+		CurrentOS  string `json:"currentOS"`
+		GCSVersion string `json:"gcs_version"`
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return permanent(err)
+	}
+	if len(rec.DebugLog) == 0 {
+		return nil
+	}
+
+	os := abbrevOS(rec.CurrentOS)
+	deltas := map[string]int64{}
+	tmpls := map[string]*DebugTemplate{}
+	for _, e := range rec.DebugLog {
+		t := debugTemplate(e.Message)
+		id := debugTemplateID(e.File, e.Function, t)
+		lvl := debugLevel(e.Level)
+		if dt, ok := tmpls[id]; ok {
+			if lvl > dt.Level {
+				dt.Level = lvl
+			}
+		} else {
+			tmpls[id] = &DebugTemplate{
+				Template:  t,
+				Example:   e.Message,
+				File:      e.File,
+				Function:  e.Function,
+				Level:     lvl,
+				FirstSeen: ts,
+			}
+		}
+		deltas[id+"|"+rec.GCSVersion+"|"+os]++
+	}
+
+	g, _ := errgroup.WithContext(c)
+	g.Go(func() error {
+		mk := debugLogMarkerKey(c, usageKey)
+		return datastore.RunInTransaction(c, func(tc context.Context) error {
+			switch err := datastore.Get(tc, mk, &rollupMarker{}); err {
+			case nil:
+				log.Debugf(c, "Debug log of %v already counted", usageKey.StringID())
+				return nil
+			case datastore.ErrNoSuchEntity:
+			default:
+				return err
+			}
+			if err := addCounters(tc, debugCountsKind, ts.Format(dayFmt), debugCountsShards, deltas); err != nil {
+				return err
+			}
+			_, err := datastore.Put(tc, mk, &rollupMarker{ts})
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+	})
+	g.Go(func() error { return recordDebugTemplates(c, tmpls) })
+	return g.Wait()
+}
+
+func debugTemplateCacheKey(id string) string {
+	return "debugtpl@" + id
+}
+
+// recordDebugTemplates makes sure every template has an entity and
+// that its level is the highest we've seen it reported at.
+func recordDebugTemplates(c context.Context, tmpls map[string]*DebugTemplate) error {
+	var ckeys []string
+	for id := range tmpls {
+		ckeys = append(ckeys, debugTemplateCacheKey(id))
+	}
+	known, err := memcache.GetMulti(c, ckeys)
+	if err != nil {
+		log.Infof(c, "Error looking up known debug templates: %v", err)
+		known = map[string]*memcache.Item{}
+	}
+
+	g, _ := errgroup.WithContext(c)
+	for id, t := range tmpls {
+		if it, ok := known[debugTemplateCacheKey(id)]; ok {
+			if lvl, err := strconv.Atoi(string(it.Value)); err == nil && lvl >= t.Level {
+				continue
+			}
+		}
+		id, t := id, t
+		g.Go(func() error {
+			k := datastore.NewKey(c, debugTemplateKind, id, 0, nil)
+			err := datastore.RunInTransaction(c, func(tc context.Context) error {
+				prev := &DebugTemplate{}
+				switch err := datastore.Get(tc, k, prev); err {
+				case datastore.ErrNoSuchEntity:
+				case nil:
+					if prev.Level >= t.Level {
+						t.Level = prev.Level
+						return nil
+					}
+					t.FirstSeen = olderTime(prev.FirstSeen, t.FirstSeen)
+				default:
+					return err
+				}
+				_, err := datastore.Put(tc, k, t)
+				return err
+			}, nil)
+			if err != nil {
+				return err
+			}
+			return memcache.Set(c, &memcache.Item{
+				Key:   debugTemplateCacheKey(id),
+				Value: []byte(strconv.Itoa(t.Level)),
+			})
+		})
+	}
+	return g.Wait()
+}
+
+// Params:
+// - seed: "true" to only mark the reports as counted.  Reports stored
+// before markers were kept have been counted already, so this needs
+// to run over them once before replaying anything.
+func mapDebugLog(c context.Context, params url.Values, keys []*datastore.Key) error {
+	stats := make([]UsageStat, len(keys))
+	if err := datastore.GetMulti(c, keys, stats); err != nil {
+		log.Errorf(c, "Error fetching usage stats: %v", err)
+		return err
+	}
+
+	if params.Get("seed") == "true" {
+		mkeys := make([]*datastore.Key, len(keys))
+		marks := make([]rollupMarker, len(keys))
+		for i, k := range keys {
+			mkeys[i], marks[i] = debugLogMarkerKey(c, k), rollupMarker{stats[i].Timestamp}
+		}
+		changed(c, keys...)
+		if isDryRun(c) {
+			return nil
+		}
+		_, err := datastore.PutMulti(c, mkeys, marks)
+		return err
+	}
+
+	if isDryRun(c) {
+		return debugLogPending(c, keys)
+	}
+
+	for i, st := range stats {
+		if err := st.uncompress(); err != nil {
+			log.Warningf(c, "Failed to decompress %v: %v", keys[i], err)
+			continue
+		}
+		if err := debugLogRollup(c, keys[i], st.Timestamp, st.Data); err != nil {
+			log.Errorf(c, "Error rolling up debug log for %v: %v", keys[i], err)
+			return err
+		}
+	}
+	return nil
+}
+
+// debugLogPending reports the reports whose debug logs haven't been
+// counted yet, which are the ones a real run would count.
+func debugLogPending(c context.Context, keys []*datastore.Key) error {
+	mkeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		mkeys[i] = debugLogMarkerKey(c, k)
+	}
+	err := datastore.GetMulti(c, mkeys, make([]rollupMarker, len(keys)))
+	if err == nil {
+		return nil
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for i, e := range merr {
+		switch e {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			changed(c, keys[i])
+		default:
+			return e
+		}
+	}
+	return nil
+}
+
+type debugLogStat struct {
+	ID string `json:"id"`
+	*DebugTemplate
+
+	Count    int64            `json:"count"`
+	Versions map[string]int64 `json:"versions"`
+	OS       map[string]int64 `json:"os"`
+	Daily    []int64          `json:"daily"`
+
+	// Relative change of the daily rate over the newest half of the
+	// window compared to the older half.
+	Trend float64 `json:"trend"`
+}
+
+type debugLogTop struct {
+	Days      []string        `json:"days"`
+	Templates []*debugLogStat `json:"templates"`
+}
+
+func loadDebugLogTop(c context.Context, days int, version, os, by string, limit int) (*debugLogTop, error) {
+	today := time.Now().UTC()
+	rv := &debugLogTop{}
+	for i := days - 1; i >= 0; i-- {
+		rv.Days = append(rv.Days, today.AddDate(0, 0, -i).Format(dayFmt))
+	}
+
+	perDay := make([]map[string]int64, len(rv.Days))
+	g, _ := errgroup.WithContext(c)
+	for i, d := range rv.Days {
+		i, d := i, d
+		g.Go(func() error {
+			var err error
+			perDay[i], err = readCounters(c, debugCountsKind, d, debugCountsShards)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]*debugLogStat{}
+	for i, counts := range perDay {
+		for name, n := range counts {
+			parts := strings.SplitN(name, "|", 3)
+			if len(parts) != 3 {
+				log.Warningf(c, "Unexpected debug counter: %q", name)
+				continue
+			}
+			if (version != "" && parts[1] != version) || (os != "" && parts[2] != os) {
+				continue
+			}
+			st, ok := stats[parts[0]]
+			if !ok {
+				st = &debugLogStat{
+					ID:       parts[0],
+					Versions: map[string]int64{},
+					OS:       map[string]int64{},
+					Daily:    make([]int64, len(rv.Days)),
+				}
+				stats[parts[0]] = st
+			}
+			st.Count += n
+			st.Versions[parts[1]] += n
+			st.OS[parts[2]] += n
+			st.Daily[i] += n
+		}
+	}
+
+	half := len(rv.Days) / 2
+	for _, st := range stats {
+		var older, newer int64
+		for i, n := range st.Daily {
+			if i < half {
+				older += n
+			} else {
+				newer += n
+			}
+		}
+		olderRate := float64(older) / float64(half)
+		newerRate := float64(newer) / float64(len(rv.Days)-half)
+		if olderRate < 1 {
+			st.Trend = newerRate - olderRate
+		} else {
+			st.Trend = (newerRate - olderRate) / olderRate
+		}
+		rv.Templates = append(rv.Templates, st)
+	}
+
+	if by == "trend" {
+		sort.Slice(rv.Templates, func(i, j int) bool {
+			return rv.Templates[i].Trend > rv.Templates[j].Trend
+		})
+	} else {
+		sort.Slice(rv.Templates, func(i, j int) bool {
+			return rv.Templates[i].Count > rv.Templates[j].Count
+		})
+	}
+	if len(rv.Templates) > limit {
+		rv.Templates = rv.Templates[:limit]
+	}
+
+	keys := make([]*datastore.Key, len(rv.Templates))
+	tmpls := make([]DebugTemplate, len(rv.Templates))
+	for i, st := range rv.Templates {
+		keys[i] = datastore.NewKey(c, debugTemplateKind, st.ID, 0, nil)
+	}
+	err := datastore.GetMulti(c, keys, tmpls)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return nil, e
+			}
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range tmpls {
+		rv.Templates[i].DebugTemplate = &tmpls[i]
+	}
+
+	return rv, nil
+}
+
+// Params:
+// - days: how far back to look (default 14)
+// - version, os: restrict to one GCS version and/or OS
+// - by: "count" (default) or "trend"
+// - limit: how many templates to return (default 25, at most 100)
+func handleDebugLogTop(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	days := 14
+	if n, err := strconv.Atoi(r.FormValue("days")); err == nil && n > 1 && n <= maxDebugDays {
+		days = n
+	}
+	limit := 25
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 && n <= maxDebugLimit {
+		limit = n
+	}
+	version, os, by := r.FormValue("version"), r.FormValue("os"), r.FormValue("by")
+
+	cacheKey := fmt.Sprintf("debugLogTop.%d.%d.%q.%q.%q", days, limit, version, os, by)
+	rv := &debugLogTop{}
+	if _, err := memcache.JSON.Get(c, cacheKey, rv); err == nil {
+		mustEncode(c, w, r, rv)
+		return
+	}
+
+	rv, err := loadDebugLogTop(c, days, version, os, by, limit)
+	if err != nil {
+		log.Errorf(c, "Error loading debug log stats: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := memcache.JSON.Set(c, &memcache.Item{
+		Key:        cacheKey,
+		Object:     rv,
+		Expiration: time.Minute * 10,
+	}); err != nil {
+		log.Warningf(c, "Problem storing stuff in memcache: %v", err)
+	}
+
+	mustEncode(c, w, r, rv)
+}
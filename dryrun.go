@@ -0,0 +1,299 @@
+package autotown
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	changedKeysKind = "ChangedKeys"
+
+	// How many changed keys a preview shows, and how long it can be
+	// confirmed for before the data's likely to have moved on.
+	previewSamples = 20
+	previewTTL     = 24 * time.Hour
+)
+
+func init() {
+	http.HandleFunc("/admin/jobs/verify", handleJobVerify)
+}
+
+// A changeSet collects the keys a mutating mapper changed, or in a
+// dry run would have changed.
+type changeSet struct {
+	mu   sync.Mutex
+	keys []*datastore.Key
+}
+
+func (s *changeSet) merge(from *changeSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, from.keys...)
+}
+
+type changeSetKey struct{}
+type dryRunKey struct{}
+
+// isDryRun reports whether a mutating mapper should leave the data
+// alone and only report what it would change.
+func isDryRun(c context.Context) bool {
+	dry, _ := c.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// changed records keys a mutating mapper changed or, in a dry run,
+// would change.  It does nothing outside of a job.
+func changed(c context.Context, keys ...*datastore.Key) {
+	s, ok := c.Value(changeSetKey{}).(*changeSet)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, keys...)
+}
+
+// keyDigest sums the keys' hashes, so a job's chunks can add up their
+// digests in any order and two jobs that changed the same keys end up
+// with the same one.
+func keyDigest(keys []*datastore.Key) int64 {
+	var d int64
+	for _, k := range keys {
+		h := fnv.New64a()
+		h.Write([]byte(k.Encode()))
+		d += int64(h.Sum64())
+	}
+	return d
+}
+
+// changedKeys is one chunk's share of what a mutating job changed.
+type changedKeys struct {
+	Job  int64  `datastore:"job"`
+	Keys []byte `datastore:"keys,noindex"`
+}
+
+// storeChanged keeps the keys a chunk changed so a preview and its
+// real run can be compared key by key.  Like storeMapOutput, a
+// redelivered chunk replaces its earlier record.
+func storeChanged(c context.Context, jobKey *datastore.Key, chunk []*datastore.Key, s *changeSet) error {
+	var encoded []string
+	for _, k := range s.keys {
+		encoded = append(encoded, k.Encode())
+	}
+	d, err := encodeGz(encoded)
+	if err != nil {
+		return err
+	}
+	k := datastore.NewKey(c, changedKeysKind, fmt.Sprintf("%d-%s", jobKey.IntID(), chunkID(chunk)), 0, nil)
+	_, err = datastore.Put(c, k, &changedKeys{Job: jobKey.IntID(), Keys: d})
+	return err
+}
+
+// loadChanged reads back every key a job recorded as changed.
+func loadChanged(c context.Context, jobKey *datastore.Key) (map[string]bool, error) {
+	rv := map[string]bool{}
+	q := datastore.NewQuery(changedKeysKind).Filter("job =", jobKey.IntID())
+	for t := q.Run(c); ; {
+		var ck changedKeys
+		_, err := t.Next(&ck)
+		if err == datastore.Done {
+			return rv, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if err := decodeGz(ck.Keys, &keys); err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			rv[k] = true
+		}
+	}
+}
+
+// recordSample adds a few of a dry run's changed keys to its job until
+// it has enough to show.
+func recordSample(c context.Context, jobKey *datastore.Key, keys []*datastore.Key) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		j := &batchJob{}
+		if err := datastore.Get(tc, jobKey, j); err != nil {
+			return err
+		}
+		if len(j.Sample) >= previewSamples {
+			return nil
+		}
+		for _, k := range keys {
+			if len(j.Sample) == previewSamples {
+				break
+			}
+			j.Sample = append(j.Sample, k.String())
+		}
+		_, err := datastore.Put(tc, jobKey, j)
+		return err
+	}, nil)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startPreview starts a dry run of a mutating mapper.  Once it's done,
+// its token starts the real thing.
+func startPreview(c context.Context, spec mapSpec) (*datastore.Key, error) {
+	if m, ok := mappers[spec.Mapper]; ok && !m.Mutates() {
+		return nil, fmt.Errorf("%v doesn't change anything, so has nothing to preview", spec.Mapper)
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	return startJob(c, &batchJob{mapSpec: spec, DryRun: true, Token: token})
+}
+
+// confirmPreview starts the real run of the finished preview with the
+// given token.  A token can only be used once.
+func confirmPreview(c context.Context, token string) (*datastore.Key, error) {
+	var previews []*batchJob
+	keys, err := datastore.NewQuery(batchJobKind).Filter("token =", token).Limit(1).GetAll(c, &previews)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no preview with that token")
+	}
+	pk, p := keys[0], previews[0]
+	p.Key = pk
+	if err := p.loadCounts(c); err != nil {
+		return nil, err
+	}
+	switch {
+	case !p.DryRun:
+		return nil, fmt.Errorf("job %v isn't a preview", pk.IntID())
+	case p.State != "done":
+		return nil, fmt.Errorf("preview %v is %v, not done", pk.IntID(), p.State)
+	case p.Failed > 0:
+		return nil, fmt.Errorf("preview %v had %v failed chunks", pk.IntID(), p.Failed)
+	case time.Since(p.Started) > previewTTL:
+		return nil, fmt.Errorf("preview %v is too old, start another", pk.IntID())
+	}
+
+	var k *datastore.Key
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		p := &batchJob{}
+		if err := datastore.Get(tc, pk, p); err != nil {
+			return err
+		}
+		if p.Confirmed != nil {
+			return fmt.Errorf("preview %v was already run as job %v", pk.IntID(), p.Confirmed.IntID())
+		}
+		var err error
+		if k, err = startJob(tc, &batchJob{mapSpec: p.mapSpec, Preview: pk}); err != nil {
+			return err
+		}
+		p.Confirmed, p.Updated = k, time.Now()
+		_, err = datastore.Put(tc, pk, p)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return k, err
+}
+
+// verify compares a finished run's changes with its preview's by
+// count and digest.
+func (j *batchJob) verify(c context.Context) error {
+	counts, err := readCounters(c, batchJobCountsKind, batchJobGroup(j.Preview), batchJobShards)
+	if err != nil {
+		return err
+	}
+	if counts["changed"] == j.Changed && counts["digest"] == j.Digest {
+		j.Verified = "matches preview"
+	} else {
+		j.Verified = fmt.Sprintf("changed %v keys, preview had %v", j.Changed, counts["changed"])
+	}
+	return nil
+}
+
+type keyDiff struct {
+	Preview     string   `json:"preview"`
+	Run         string   `json:"run"`
+	Matches     bool     `json:"matches"`
+	PreviewKeys int      `json:"preview_keys"`
+	RunKeys     int      `json:"run_keys"`
+	OnlyPreview []string `json:"only_preview,omitempty"`
+	OnlyRun     []string `json:"only_run,omitempty"`
+}
+
+func diffSample(a, b map[string]bool) []string {
+	var rv []string
+	for k := range a {
+		if !b[k] {
+			rv = append(rv, k)
+		}
+	}
+	sort.Strings(rv)
+	if len(rv) > previewSamples {
+		rv = rv[:previewSamples]
+	}
+	return rv
+}
+
+// Params:
+// - id: a confirmed job to compare key by key with its preview
+func handleJobVerify(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	k, err := datastore.DecodeKey(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	j, err := getBatchJob(c, k)
+	if err != nil {
+		log.Errorf(c, "Error fetching job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if j.Preview == nil {
+		http.Error(w, "job wasn't run from a preview", 400)
+		return
+	}
+
+	ran, err := loadChanged(c, k)
+	if err != nil {
+		log.Errorf(c, "Error loading changes for job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	previewed, err := loadChanged(c, j.Preview)
+	if err != nil {
+		log.Errorf(c, "Error loading changes for preview %v: %v", j.Preview.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	d := keyDiff{
+		Preview:     j.Preview.Encode(),
+		Run:         k.Encode(),
+		PreviewKeys: len(previewed),
+		RunKeys:     len(ran),
+		OnlyPreview: diffSample(previewed, ran),
+		OnlyRun:     diffSample(ran, previewed),
+	}
+	d.Matches = len(d.OnlyPreview) == 0 && len(d.OnlyRun) == 0
+	mustEncode(c, w, r, d)
+}
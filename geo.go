@@ -0,0 +1,379 @@
+package autotown
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	maxGeoZoom = 20
+
+	// These are public and scan rather than read a summary, so how
+	// far back they go and how much they look at is capped.
+	// Filtering tunes by version means decompressing every one, so
+	// that looks at fewer.
+	maxGeoDays        = 90
+	maxGeoScan        = 10000
+	maxGeoVersionScan = 1000
+)
+
+func init() {
+	http.Handle("/api/geo/points", corsHandleFunc(handleGeoPoints))
+	http.Handle("/api/geo/countries", corsHandleFunc(handleGeoCountries))
+	http.Handle("/api/geo/regions", corsHandleFunc(handleGeoRegions))
+}
+
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Geometry   *geoPoint              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+	// Set when the scan stopped early, so the counts are short and
+	// only cover the newest.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type geoSighting struct {
+	Country, Region, City string
+	Lat, Lon              float64
+}
+
+type geoFilter struct {
+	What    string
+	Board   string
+	Version string
+	Since   time.Time
+}
+
+func parseGeoFilter(r *http.Request) (geoFilter, error) {
+	f := geoFilter{
+		What:    r.FormValue("what"),
+		Board:   r.FormValue("board"),
+		Version: r.FormValue("version"),
+	}
+
+	days := 30
+	if n, err := strconv.Atoi(r.FormValue("days")); err == nil && n > 0 {
+		days = n
+	}
+	if days > maxGeoDays {
+		days = maxGeoDays
+	}
+	f.Since = time.Now().AddDate(0, 0, -days)
+	if t, err := time.Parse(time.RFC3339, r.FormValue("since")); err == nil {
+		f.Since = t
+	}
+	if earliest := time.Now().AddDate(0, 0, -maxGeoDays); f.Since.Before(earliest) {
+		f.Since = earliest
+	}
+
+	switch f.What {
+	case "":
+		f.What = "controllers"
+	case "controllers", "tunes", "crashes":
+	default:
+		return f, fmt.Errorf("invalid value for what: %q", f.What)
+	}
+
+	return f, nil
+}
+
+func matchesVersion(want, hash, tag string, gitl []githubRef) bool {
+	switch {
+	case want == "", want == tag:
+		return true
+	case hash == "":
+		return false
+	case strings.HasPrefix(hash, want):
+		return true
+	}
+	for _, l := range gitDescribe(hash, gitl) {
+		if l.Label == want {
+			return true
+		}
+	}
+	return false
+}
+
+// geoSightings returns where the things matching f were seen, and
+// whether it stopped looking before it ran out of them.
+func geoSightings(c context.Context, f geoFilter) ([]geoSighting, bool, error) {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return nil, false, err
+	}
+	f.Board = boards.canonical(f.Board)
+
+	var gitl []githubRef
+	if f.Version != "" {
+		var err error
+		if gitl, err = gitLabels(c); err != nil {
+			log.Warningf(c, "Couldn't resolve git labels: %v", err)
+		}
+	}
+
+	limit := maxGeoScan
+	if f.What == "tunes" && f.Version != "" {
+		limit = maxGeoVersionScan
+	}
+	scanned := 0
+
+	var rv []geoSighting
+	switch f.What {
+	case "controllers":
+		q := datastore.NewQuery("FoundController").Filter("timestamp >", f.Since).Order("-timestamp").Limit(limit)
+		for t := q.Run(c); ; {
+			var x FoundController
+			_, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, false, err
+			}
+			scanned++
+			if f.Board != "" && boards.canonical(x.Name) != f.Board {
+				continue
+			}
+			if !matchesVersion(f.Version, x.GitHash, x.GitTag, gitl) {
+				continue
+			}
+			rv = append(rv, geoSighting{x.Country, x.Region, x.City, x.Lat, x.Lon})
+		}
+
+	case "tunes":
+		q := datastore.NewQuery("TuneResults").Filter("timestamp >", f.Since).Order("-timestamp").Limit(limit)
+		for t := q.Run(c); ; {
+			var x TuneResults
+			_, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, false, err
+			}
+			scanned++
+			if f.Board != "" && boards.canonical(x.Board) != f.Board {
+				continue
+			}
+			if f.Version != "" {
+				if err := x.uncompress(); err != nil {
+					log.Infof(c, "Error decompressing: %v", err)
+					continue
+				}
+				hash, tag := x.firmware()
+				if !matchesVersion(f.Version, hash, tag, gitl) {
+					continue
+				}
+			}
+			rv = append(rv, geoSighting{x.Country, x.Region, x.City, x.Lat, x.Lon})
+		}
+
+	case "crashes":
+		// Crashes are linked to the boards in use around them,
+		// under their canonical names.
+		q := datastore.NewQuery("CrashData").Filter("timestamp >", f.Since).Order("-timestamp").Limit(limit)
+		if f.Board != "" {
+			q = q.Filter("boards =", f.Board)
+		}
+		for t := q.Run(c); ; {
+			var x CrashData
+			_, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, false, err
+			}
+			scanned++
+			s := func(k string) string { v, _ := x.properties[k].(string); return v }
+			fl := func(k string) float64 { v, _ := x.properties[k].(float64); return v }
+			if !matchesVersion(f.Version, s("gitCommit"), s("gitTag"), gitl) {
+				continue
+			}
+			rv = append(rv, geoSighting{s("country"), s("region"), s("city"), fl("lat"), fl("lon")})
+		}
+	}
+
+	privacy := currentPrivacy()
+	for i := range rv {
+		rv[i].Lat, rv[i].Lon = privacy.coords(rv[i].Lat, rv[i].Lon)
+	}
+
+	if scanned == limit {
+		log.Infof(c, "Stopped looking for %v after %v", f.What, limit)
+	}
+	return rv, scanned == limit, nil
+}
+
+type geoBucket struct {
+	id             string
+	props          map[string]interface{}
+	count, located int
+	latSum, lonSum float64
+}
+
+func (b *geoBucket) add(s geoSighting) {
+	b.count++
+	if s.Lat == 0 && s.Lon == 0 {
+		return
+	}
+	b.located++
+	b.latSum += s.Lat
+	b.lonSum += s.Lon
+}
+
+func (b *geoBucket) feature() geoFeature {
+	b.props["count"] = b.count
+	f := geoFeature{Type: "Feature", ID: b.id, Properties: b.props}
+	if b.located > 0 {
+		f.Geometry = &geoPoint{
+			Type: "Point",
+			Coordinates: [2]float64{
+				b.lonSum / float64(b.located),
+				b.latSum / float64(b.located),
+			},
+		}
+	}
+	return f
+}
+
+func geoCollect(sightings []geoSighting, keyf func(geoSighting) (string, map[string]interface{})) *geoFeatureCollection {
+	buckets := map[string]*geoBucket{}
+	for _, s := range sightings {
+		k, props := keyf(s)
+		if props == nil {
+			continue
+		}
+		b, ok := buckets[k]
+		if !ok {
+			b = &geoBucket{id: k, props: props}
+			buckets[k] = b
+		}
+		b.add(s)
+	}
+
+	rv := &geoFeatureCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+	for _, b := range buckets {
+		rv.Features = append(rv.Features, b.feature())
+	}
+	sort.Slice(rv.Features, func(i, j int) bool {
+		return rv.Features[i].ID < rv.Features[j].ID
+	})
+	return rv
+}
+
+func geoCacheKey(r *http.Request) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s?%s", r.URL.Path, r.URL.RawQuery)
+	return "geo." + hex.EncodeToString(h.Sum(nil))
+}
+
+func serveGeo(w http.ResponseWriter, r *http.Request,
+	group func([]geoSighting) (*geoFeatureCollection, error)) {
+
+	c := appengine.NewContext(r)
+
+	cacheKey := geoCacheKey(r)
+	rv := &geoFeatureCollection{}
+	if err := gzCacheGet(c, cacheKey, rv); err == nil {
+		mustEncode(c, w, r, rv)
+		return
+	}
+
+	f, err := parseGeoFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	sightings, truncated, err := geoSightings(c, f)
+	if err != nil {
+		log.Errorf(c, "Error fetching %v locations: %v", f.What, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv, err = group(sightings)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	rv.Truncated = truncated
+
+	gzCacheSet(c, cacheKey, time.Hour, rv)
+	mustEncode(c, w, r, rv)
+}
+
+// Params:
+// - what: controllers (default), tunes or crashes
+// - zoom: map zoom level to cluster for (default 2)
+// - board, version: optional filters
+// - days or since: time window (default 30 days, at most maxGeoDays)
+func handleGeoPoints(w http.ResponseWriter, r *http.Request) {
+	serveGeo(w, r, func(sightings []geoSighting) (*geoFeatureCollection, error) {
+		zoom := 2
+		if zs := r.FormValue("zoom"); zs != "" {
+			var err error
+			zoom, err = strconv.Atoi(zs)
+			if err != nil || zoom < 0 || zoom > maxGeoZoom {
+				return nil, fmt.Errorf("invalid zoom: %q", zs)
+			}
+		}
+		// Roughly a quarter of a map tile on a side.
+		cell := 360 / math.Pow(2, float64(zoom)) / 4
+
+		return geoCollect(sightings, func(s geoSighting) (string, map[string]interface{}) {
+			if s.Lat == 0 && s.Lon == 0 {
+				return "", nil
+			}
+			x, y := int(math.Floor(s.Lon/cell)), int(math.Floor(s.Lat/cell))
+			return fmt.Sprintf("%d/%d/%d", zoom, x, y), map[string]interface{}{}
+		}), nil
+	})
+}
+
+func handleGeoCountries(w http.ResponseWriter, r *http.Request) {
+	serveGeo(w, r, func(sightings []geoSighting) (*geoFeatureCollection, error) {
+		return geoCollect(sightings, func(s geoSighting) (string, map[string]interface{}) {
+			return s.Country, map[string]interface{}{"country": s.Country}
+		}), nil
+	})
+}
+
+// Params are as for /api/geo/points, with an optional country to
+// restrict the regions to.
+func handleGeoRegions(w http.ResponseWriter, r *http.Request) {
+	country := r.FormValue("country")
+	serveGeo(w, r, func(sightings []geoSighting) (*geoFeatureCollection, error) {
+		return geoCollect(sightings, func(s geoSighting) (string, map[string]interface{}) {
+			if country != "" && !strings.EqualFold(country, s.Country) {
+				return "", nil
+			}
+			return s.Country + "-" + s.Region, map[string]interface{}{
+				"country": s.Country,
+				"region":  s.Region,
+			}
+		}), nil
+	})
+}
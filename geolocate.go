@@ -0,0 +1,311 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// defaultGeoIPPath is where the GeoIP database is looked for.  It's
+// too big to check in (and MaxMind's license wouldn't let us anyway),
+// so fetch the current GeoLite2 City database from MaxMind into geoip/
+// before deploying; appcfg uploads it with the app.  Without it,
+// reports App Engine can't place stay unlocated.
+const defaultGeoIPPath = "geoip/GeoLite2-City.mmdb"
+
+func init() {
+	registerMapper(kindMapper{name: "geolocate", kinds: addrKinds,
+		batchSize: 100, concurrency: 1, mutates: true, f: mapGeolocate})
+}
+
+type geoLocation struct {
+	Country, Region, City string
+	Lat, Lon              float64
+
+	// Which resolver came up with this; empty if none could.
+	Source string
+}
+
+// A geoResolver figures out where a request came from.  Backfills
+// don't have the original request, so h may be nil.
+type geoResolver interface {
+	resolve(c context.Context, h http.Header, addr string) (geoLocation, bool)
+}
+
+var geoResolvers = []geoResolver{
+	headerResolver{},
+	&mmdbResolver{},
+}
+
+// locate asks each resolver in turn where addr is.
+func locate(c context.Context, h http.Header, addr string) geoLocation {
+	for _, r := range geoResolvers {
+		if loc, ok := r.resolve(c, h, addr); ok {
+			return loc
+		}
+	}
+	return geoLocation{}
+}
+
+// headerResolver uses the location App Engine's frontend attaches.
+type headerResolver struct{}
+
+func (headerResolver) resolve(c context.Context, h http.Header, addr string) (geoLocation, bool) {
+	if h == nil {
+		return geoLocation{}, false
+	}
+	loc := geoLocation{
+		Country: h.Get("X-AppEngine-Country"),
+		Region:  h.Get("X-AppEngine-Region"),
+		City:    h.Get("X-AppEngine-City"),
+		Source:  "headers",
+	}
+	if unlocated(loc.Country) {
+		return geoLocation{}, false
+	}
+	fmt.Sscanf(h.Get("X-Appengine-Citylatlong"), "%f,%f", &loc.Lat, &loc.Lon)
+	return loc, true
+}
+
+// unlocated reports whether a country is really no location at all.
+// ZZ is what we get when App Engine doesn't know.
+func unlocated(country string) bool {
+	return country == "" || country == "ZZ"
+}
+
+// mmdbResolver looks addresses up in a MaxMind format city database
+// deployed alongside the app.  GEOIP_DB overrides where it's found.
+type mmdbResolver struct {
+	once sync.Once
+	db   *maxminddb.Reader
+}
+
+type mmdbCity struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+func (m *mmdbResolver) open(c context.Context) {
+	path := os.Getenv("GEOIP_DB")
+	if path == "" {
+		path = defaultGeoIPPath
+	}
+	// Open maps the file rather than reading all of it onto the heap.
+	db, err := maxminddb.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		log.Warningf(c, "No GeoIP database available: %v", err)
+	case err != nil:
+		log.Errorf(c, "Error opening GeoIP database %v: %v", path, err)
+	default:
+		m.db = db
+	}
+}
+
+func (m *mmdbResolver) resolve(c context.Context, h http.Header, addr string) (geoLocation, bool) {
+	m.once.Do(func() { m.open(c) })
+	ip := parseAddr(addr)
+	if m.db == nil || ip == nil {
+		return geoLocation{}, false
+	}
+
+	var rec mmdbCity
+	if err := m.db.Lookup(ip, &rec); err != nil {
+		log.Infof(c, "Error looking up %v: %v", ip, err)
+		return geoLocation{}, false
+	}
+	if rec.Country.ISOCode == "" {
+		return geoLocation{}, false
+	}
+
+	// Match the conventions of the App Engine headers.
+	loc := geoLocation{
+		Country: rec.Country.ISOCode,
+		City:    strings.ToLower(rec.City.Names["en"]),
+		Lat:     rec.Location.Latitude,
+		Lon:     rec.Location.Longitude,
+		Source:  "geoip",
+	}
+	if len(rec.Subdivisions) > 0 {
+		loc.Region = strings.ToLower(rec.Subdivisions[0].ISOCode)
+	}
+	return loc, true
+}
+
+// geolocateControllers places controllers one at a time, moving the
+// usage summary and the daily country counts they've been counted in
+// along with each.
+func geolocateControllers(c context.Context, keys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	privacy := currentPrivacy()
+
+	var located []*datastore.Key
+	for _, k := range keys {
+		// A controller, its summary shard, its config and up to two
+		// daily count shards fit in an XG transaction.
+		did := false
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			did = false
+			fc := &FoundController{}
+			if err := datastore.Get(tc, k, fc); err != nil {
+				return err
+			}
+			if !unlocated(fc.Country) {
+				return nil
+			}
+			loc := locate(tc, nil, fc.Addr)
+			if loc.Source == "" {
+				return nil
+			}
+			cfg, err := loadCountsConfig(tc)
+			if err != nil {
+				return err
+			}
+
+			was := fc.Country
+			fc.Country, fc.Region, fc.City, fc.GeoSource = loc.Country, loc.Region, loc.City, loc.Source
+			fc.Lat, fc.Lon = privacy.coords(loc.Lat, loc.Lon)
+			fc.Addr = privacy.placedAddr(tc, fc.Addr, fc.Timestamp)
+			summary := summaryDeltas(fc, boards)
+			did = true
+			if isDryRun(tc) {
+				return nil
+			}
+
+			if _, err := datastore.Put(tc, k, fc); err != nil {
+				return err
+			}
+			if err := addCounters(tc, usageSummaryKind, usageSummaryGroup, usageSummaryShards, summary); err != nil {
+				return err
+			}
+			bn := fc.CountedBoard
+			if bn == "" {
+				bn = boards.canonical(fc.Name)
+			}
+			day := fc.CountedDay
+			if day == "" {
+				day = fc.Oldest.Format(dayFmt)
+			}
+			deltas := map[string]int64{"country|" + bn + "|" + was: -1, "country|" + bn + "|" + fc.Country: 1}
+			for _, kind := range []string{cfg.Live, cfg.Building} {
+				if kind == "" || !countedInto(fc, kind, cfg) {
+					continue
+				}
+				if err := addCounters(tc, kind, day, dailyCountShards, deltas); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			log.Errorf(c, "Error locating %v: %v", k, err)
+			return err
+		}
+		if did {
+			located = append(located, k)
+		}
+	}
+
+	changed(c, located...)
+	if len(located) > 0 {
+		log.Infof(c, "Located %v of %v controllers", len(located), len(keys))
+	}
+	return nil
+}
+
+func setProp(ps *datastore.PropertyList, name string, v interface{}) {
+	for i := range *ps {
+		if (*ps)[i].Name == name {
+			(*ps)[i].Value = v
+			return
+		}
+	}
+	*ps = append(*ps, datastore.Property{Name: name, Value: v})
+}
+
+// mapGeolocate fills in the location of anything that was stored
+// without one.  This only works for entities that still have a raw
+// address.
+func mapGeolocate(c context.Context, params url.Values, keys []*datastore.Key) error {
+	if keys[0].Kind() == "FoundController" {
+		return geolocateControllers(c, keys)
+	}
+
+	ents := make([]datastore.PropertyList, len(keys))
+	if err := datastore.GetMulti(c, keys, ents); err != nil {
+		log.Errorf(c, "Error fetching entities: %v", err)
+		return err
+	}
+
+	privacy := currentPrivacy()
+	var upkeys []*datastore.Key
+	var upents []datastore.PropertyList
+	for i := range ents {
+		ps := &ents[i]
+		var addr, country string
+		var ts time.Time
+		for _, prop := range *ps {
+			switch prop.Name {
+			case "addr":
+				addr, _ = prop.Value.(string)
+			case "country":
+				country, _ = prop.Value.(string)
+			case "timestamp":
+				ts, _ = prop.Value.(time.Time)
+			}
+		}
+		if !unlocated(country) {
+			continue
+		}
+		loc := locate(c, nil, addr)
+		if loc.Source == "" {
+			continue
+		}
+		loc.Lat, loc.Lon = privacy.coords(loc.Lat, loc.Lon)
+
+		setProp(ps, "country", loc.Country)
+		setProp(ps, "region", loc.Region)
+		setProp(ps, "city", loc.City)
+		setProp(ps, "lat", loc.Lat)
+		setProp(ps, "lon", loc.Lon)
+		setProp(ps, "geo_source", loc.Source)
+		setProp(ps, "addr", privacy.placedAddr(c, addr, ts))
+		upkeys = append(upkeys, keys[i])
+		upents = append(upents, *ps)
+	}
+
+	changed(c, upkeys...)
+	if len(upkeys) > 0 && !isDryRun(c) {
+		log.Infof(c, "Located %v of %v %v entities", len(upkeys), len(keys), keys[0].Kind())
+		if _, err := datastore.PutMulti(c, upkeys, upents); err != nil {
+			log.Errorf(c, "Error storing locations: %v", err)
+			return err
+		}
+	}
+	return nil
+}
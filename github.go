@@ -32,6 +32,8 @@ const (
 	hashURL     = "https://api.github.com/repos/d-ronin/dRonin/commits/"
 	treeURL     = "https://api.github.com/repos/d-ronin/dRonin/git/trees/"
 	blobURL     = "https://api.github.com/repos/d-ronin/dRonin/git/blobs/"
+	compareURL  = "https://api.github.com/repos/d-ronin/dRonin/compare/"
+	releaseURL  = "https://api.github.com/repos/d-ronin/dRonin/releases/tags/"
 
 	maxConcurrent = 8
 )
@@ -94,6 +96,13 @@ type gitBlob struct {
 	Filename string `json:"filename" datastore:"filename,noindex"`
 }
 
+// A githubStatusError is GitHub answering with something other than
+// a 200.
+type githubStatusError struct {
+	status int
+	error
+}
+
 func fetchDecode(c context.Context, u string, ob interface{}) error {
 	log.Infof(c, "Fetching %v", u)
 	defer func(start time.Time) { log.Infof(c, "Fetched %v in %v", u, time.Since(start)) }(time.Now())
@@ -114,8 +123,8 @@ func fetchDecode(c context.Context, u string, ob interface{}) error {
 		limit := res.Header.Get("X-RateLimit-Limit")
 		remaining := res.Header.Get("X-RateLimit-Remaining")
 		reset := res.Header.Get("X-RateLimit-Reset")
-		return httputil.HTTPErrorf(res, "Error grabbing %v (limit=%v, remaining=%v, reset=%v): %S\n%B",
-			u, limit, remaining, reset)
+		return githubStatusError{res.StatusCode, httputil.HTTPErrorf(res, "Error grabbing %v (limit=%v, remaining=%v, reset=%v): %S\n%B",
+			u, limit, remaining, reset)}
 	}
 
 	defer res.Body.Close()
@@ -0,0 +1,592 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/search"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	integrityRunKind   = "IntegrityRun"
+	integrityIssueKind = "IntegrityIssue"
+
+	// How many objects or documents one scan task looks at before
+	// handing on to the next.
+	integrityScanPage = 200
+
+	// Crash blobs are written before their entity, so younger ones
+	// may just not have an entity yet.
+	orphanMinAge = time.Hour
+)
+
+// Each kind the integrity mapper checks, and the search index that
+// should mirror it, if any.
+var integrityKinds = map[string]string{
+	"CrashData":       "",
+	"TuneResults":     "tunes",
+	"UsageStat":       "usage",
+	"FoundController": "",
+}
+
+func init() {
+	var kinds []string
+	for k := range integrityKinds {
+		kinds = append(kinds, k)
+	}
+	registerMapper(kindMapper{name: "integrity", kinds: kinds,
+		batchSize: 20, concurrency: 5, mutates: true, f: mapIntegrity})
+
+	http.HandleFunc("/admin/integrity", handleIntegrity)
+	http.HandleFunc("/admin/integrity/report", handleIntegrityReport)
+	http.HandleFunc("/batch/integrity/blobs", deadLetters(handleScanBlobs))
+	http.HandleFunc("/batch/integrity/docs", deadLetters(handleScanDocs))
+}
+
+// An integrityRun is one pass of the consistency checks.  It starts
+// out only looking, and its Token then repairs what it found by
+// running the checks again for real.  Either way, issues are recorded
+// under the run.
+type integrityRun struct {
+	Started   time.Time        `datastore:"started" json:"started"`
+	Token     string           `datastore:"token" json:"-"`
+	Jobs      []*datastore.Key `datastore:"jobs,noindex" json:"-"`
+	Repairing time.Time        `datastore:"repairing,noindex" json:"repairing"`
+
+	Name string `datastore:"-" json:"name"`
+}
+
+// An integrityIssue is one thing a check found wrong.  Subject is an
+// encoded key, an object name or a document ID depending on the
+// check.
+type integrityIssue struct {
+	Run      string    `datastore:"run" json:"-"`
+	Check    string    `datastore:"check" json:"check"`
+	Subject  string    `datastore:"subject,noindex" json:"subject"`
+	Detail   string    `datastore:"detail,noindex" json:"detail,omitempty"`
+	Repaired bool      `datastore:"repaired,noindex" json:"repaired"`
+	Found    time.Time `datastore:"found,noindex" json:"found"`
+}
+
+// Issues are named after what they're about so rechecking the same
+// chunk doesn't report it twice.
+func recordIssue(c context.Context, run string, is integrityIssue) error {
+	is.Run, is.Found = run, time.Now()
+	k := datastore.NewKey(c, integrityIssueKind, run+"|"+is.Check+"|"+is.Subject, 0, nil)
+	_, err := datastore.Put(c, k, &is)
+	return err
+}
+
+// mapIntegrity checks a batch of one of integrityKinds and, unless
+// it's a dry run, repairs what it can.
+//
+// Params:
+// - run: the integrityRun to report issues under
+func mapIntegrity(c context.Context, params url.Values, keys []*datastore.Key) error {
+	run := params.Get("run")
+	if run == "" {
+		return permanent(fmt.Errorf("no integrity run given"))
+	}
+	switch kind := keys[0].Kind(); kind {
+	case "CrashData":
+		return checkCrashBlobs(c, run, keys)
+	case "FoundController":
+		return checkCounted(c, run, keys)
+	default:
+		return checkIndexed(c, run, integrityKinds[kind], keys)
+	}
+}
+
+// checkCrashBlobs finds crashes whose dump or trace is missing from
+// the bucket.  Repairing drops the dangling reference.
+func checkCrashBlobs(c context.Context, run string, keys []*datastore.Key) error {
+	ents, err := getPropertyLists(c, keys)
+	if err != nil {
+		return err
+	}
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, "")
+	if err != nil {
+		return err
+	}
+
+	for i, ps := range ents {
+		var missing []string
+		for _, prop := range []string{"file", "trace"} {
+			name, _ := getProp(ps, prop).(string)
+			if name == "" {
+				continue
+			}
+			_, err := bucket.Object(name).Attrs(c)
+			if err == storage.ErrObjectNotExist {
+				missing = append(missing, prop)
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		changed(c, keys[i])
+		if !isDryRun(c) {
+			if _, err := datastore.Put(c, keys[i], dropProps(ps, missing...)); err != nil {
+				return err
+			}
+		}
+		err := recordIssue(c, run, integrityIssue{
+			Check:    "missing_blob",
+			Subject:  keys[i].Encode(),
+			Detail:   strings.Join(missing, ", "),
+			Repaired: !isDryRun(c),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIndexed finds entities with no search document.  Repairing
+// indexes them again.
+func checkIndexed(c context.Context, run, indexName string, keys []*datastore.Key) error {
+	index, err := search.Open(indexName)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		var fl search.FieldList
+		err := index.Get(c, k.Encode(), &fl)
+		if err == nil {
+			continue
+		} else if err != search.ErrNoSuchDocument {
+			return err
+		}
+
+		changed(c, k)
+		if !isDryRun(c) {
+			reindex := mapIndexUsage
+			if k.Kind() == "TuneResults" {
+				reindex = mapIndexTunes
+			}
+			if err := reindex(c, nil, []*datastore.Key{k}); err != nil {
+				return err
+			}
+		}
+		err = recordIssue(c, run, integrityIssue{
+			Check:    "unindexed",
+			Subject:  k.Encode(),
+			Detail:   indexName,
+			Repaired: !isDryRun(c),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dayBoardCounts reads the live counts for a day, legacy counts
+// included.
+func dayBoardCounts(c context.Context, cfg *countsConfig, day string) (map[string]int64, error) {
+	counts, err := readCounters(c, cfg.Live, day, dailyCountShards)
+	if err != nil || cfg.Live != dailyCountShardKind {
+		return counts, err
+	}
+	var legacy DailyCounts
+	err = datastore.Get(c, datastore.NewKey(c, "DailyCounts", day, 0, nil), &legacy)
+	if err == datastore.ErrNoSuchEntity {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for k, v := range legacy.Counts {
+		counts[k] += v
+	}
+	return counts, nil
+}
+
+// checkCounted finds controllers marked counted whose board has no
+// count at all on the day they were counted under.  Controllers
+// counted before that was recorded, or last counted into a recompute's
+// counts rather than the live ones, can't be checked.  These are only
+// reported: recounting one would count it again in every other
+// dimension, and there's no telling what's left to take back.
+func checkCounted(c context.Context, run string, keys []*datastore.Key) error {
+	cfg, err := loadCountsConfig(c)
+	if err != nil {
+		return err
+	}
+	fcs := make([]*FoundController, len(keys))
+	if err := datastore.GetMulti(c, keys, fcs); err != nil {
+		return err
+	}
+	days := map[string]map[string]int64{}
+	for i, fc := range fcs {
+		if n := len(fc.CountedIn); n == 0 || fc.CountedIn[n-1] != cfg.Live || fc.CountedDay == "" {
+			continue
+		}
+		day := fc.CountedDay
+		counts, ok := days[day]
+		if !ok {
+			if counts, err = dayBoardCounts(c, cfg, day); err != nil {
+				return err
+			}
+			days[day] = counts
+		}
+		board := fc.CountedBoard
+		if counts[board] > 0 {
+			continue
+		}
+
+		err := recordIssue(c, run, integrityIssue{
+			Check:   "uncounted",
+			Subject: keys[i].Encode(),
+			Detail:  board + " on " + day,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueScan(c context.Context, path, run string, repair bool, start string, extra url.Values) error {
+	v := url.Values{
+		"run":    []string{run},
+		"repair": []string{strconv.FormatBool(repair)},
+		"start":  []string{start},
+	}
+	for k, vs := range extra {
+		v[k] = vs
+	}
+	_, err := taskqueue.Add(c, taskqueue.NewPOSTTask(path, v), mapStage2)
+	return err
+}
+
+// handleScanBlobs pages through crash blobs looking for any no crash
+// refers to.  Repairing deletes them.
+func handleScanBlobs(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	run, start := r.FormValue("run"), r.FormValue("start")
+	repair := r.FormValue("repair") == "true"
+
+	client, err := storage.NewClient(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, "")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	it := bucket.Objects(c, &storage.Query{Prefix: "crash/", StartOffset: start})
+	last := ""
+	for n := 0; n < integrityScanPage; n++ {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			last = ""
+			break
+		} else if err != nil {
+			log.Errorf(c, "Error listing crash blobs: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		last = attrs.Name
+		if time.Since(attrs.Created) < orphanMinAge {
+			continue
+		}
+
+		prop := "file"
+		if strings.HasSuffix(attrs.Name, ".json") {
+			prop = "trace"
+		}
+		n, err := datastore.NewQuery("CrashData").Filter(prop+" =", attrs.Name).KeysOnly().Count(c)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if n > 0 {
+			continue
+		}
+
+		if repair {
+			if err := bucket.Object(attrs.Name).Delete(c); err != nil && err != storage.ErrObjectNotExist {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		err = recordIssue(c, run, integrityIssue{
+			Check:    "orphaned_blob",
+			Subject:  attrs.Name,
+			Detail:   fmt.Sprintf("%d bytes", attrs.Size),
+			Repaired: repair,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	// StartOffset is inclusive, so pick up just past the last one.
+	if last != "" {
+		if err := queueScan(c, r.URL.Path, run, repair, last+"\x00", nil); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// handleScanDocs pages through a search index looking for documents
+// whose entity is gone.  Repairing deletes them.
+func handleScanDocs(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	run, start, indexName := r.FormValue("run"), r.FormValue("start"), r.FormValue("index")
+	repair := r.FormValue("repair") == "true"
+
+	index, err := search.Open(indexName)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var ids []string
+	var keys []*datastore.Key
+	t := index.List(c, &search.ListOptions{StartID: start, Limit: integrityScanPage + 1, IDsOnly: true})
+	for {
+		id, err := t.Next(nil)
+		if err == search.Done {
+			break
+		} else if err != nil {
+			log.Errorf(c, "Error listing %v: %v", indexName, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		ids = append(ids, id)
+	}
+	// The extra one is where the next page starts.
+	next := ""
+	if len(ids) > integrityScanPage {
+		next, ids = ids[integrityScanPage], ids[:integrityScanPage]
+	}
+
+	var orphans []string
+	for _, id := range ids {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			orphans = append(orphans, id)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	ents, err := getPropertyLists(c, keys)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i, ps := range ents {
+		if len(ps) == 0 {
+			orphans = append(orphans, keys[i].Encode())
+		}
+	}
+
+	for _, id := range orphans {
+		if repair {
+			if err := index.Delete(c, id); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		err := recordIssue(c, run, integrityIssue{
+			Check:    "orphaned_doc",
+			Subject:  id,
+			Detail:   indexName,
+			Repaired: repair,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	if next != "" {
+		err := queueScan(c, r.URL.Path, run, repair, next, url.Values{"index": []string{indexName}})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// queueScans starts the checks that page through the bucket and the
+// search indexes rather than the datastore.
+func queueScans(c context.Context, run string, repair bool) error {
+	if err := queueScan(c, "/batch/integrity/blobs", run, repair, "", nil); err != nil {
+		return err
+	}
+	for _, idx := range integrityKinds {
+		if idx == "" {
+			continue
+		}
+		err := queueScan(c, "/batch/integrity/docs", run, repair, "", url.Values{"index": []string{idx}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startIntegrity starts a run that reports issues without touching
+// anything.  The mapper's share runs as dry runs.
+func startIntegrity(c context.Context) (*integrityRun, error) {
+	run := &integrityRun{Started: time.Now()}
+	run.Name = run.Started.UTC().Format("20060102-150405")
+
+	var err error
+	if run.Token, err = newToken(); err != nil {
+		return nil, err
+	}
+	for kind := range integrityKinds {
+		k, err := startPreview(c, mapSpec{Kind: kind, Mapper: "integrity",
+			Params: url.Values{"run": []string{run.Name}}.Encode()})
+		if err != nil {
+			return nil, err
+		}
+		run.Jobs = append(run.Jobs, k)
+	}
+	if err := queueScans(c, run.Name, false); err != nil {
+		return nil, err
+	}
+
+	_, err = datastore.Put(c, datastore.NewKey(c, integrityRunKind, run.Name, 0, nil), run)
+	return run, err
+}
+
+// repairIntegrity confirms a finished report run's dry runs and scans
+// again, this time fixing things.
+func repairIntegrity(c context.Context, token string) (*integrityRun, error) {
+	var runs []*integrityRun
+	keys, err := datastore.NewQuery(integrityRunKind).Filter("token =", token).Limit(1).GetAll(c, &runs)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no integrity run with that token")
+	}
+	run := runs[0]
+	run.Name = keys[0].StringID()
+	if !run.Repairing.IsZero() {
+		return nil, fmt.Errorf("run %v is already being repaired", run.Name)
+	}
+
+	for _, jk := range run.Jobs {
+		j, err := getBatchJob(c, jk)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := confirmPreview(c, j.Token); err != nil {
+			return nil, fmt.Errorf("checking %v: %v", j.Kind, err)
+		}
+	}
+	if err := queueScans(c, run.Name, true); err != nil {
+		return nil, err
+	}
+
+	run.Repairing = time.Now()
+	_, err = datastore.Put(c, keys[0], run)
+	return run, err
+}
+
+// Params:
+// - confirm: the token of a finished report run to repair
+//
+// Without confirm it starts a report run, which changes nothing.
+func handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var run *integrityRun
+	var err error
+	if token := r.FormValue("confirm"); token != "" {
+		run, err = repairIntegrity(c, token)
+	} else {
+		run, err = startIntegrity(c)
+	}
+	if err != nil {
+		log.Errorf(c, "Error starting integrity run: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	log.Infof(c, "Started integrity run %v", run.Name)
+	rv := map[string]interface{}{"run": run}
+	if run.Repairing.IsZero() {
+		rv["confirm"] = run.Token
+	}
+	mustEncode(c, w, r, rv)
+}
+
+// Params:
+// - run: the run to report on (default the latest)
+//
+// Reports how many of each issue were found, along with up to 100 of
+// each.
+func handleIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	name := r.FormValue("run")
+	if name == "" {
+		keys, err := datastore.NewQuery(integrityRunKind).Order("-started").Limit(1).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(keys) == 0 {
+			http.Error(w, "no integrity runs", 404)
+			return
+		}
+		name = keys[0].StringID()
+	}
+
+	type checkReport struct {
+		Count  int              `json:"count"`
+		Issues []integrityIssue `json:"issues"`
+	}
+	report := map[string]*checkReport{}
+	for _, check := range []string{"missing_blob", "orphaned_blob", "unindexed", "orphaned_doc", "uncounted"} {
+		q := datastore.NewQuery(integrityIssueKind).Filter("run =", name).Filter("check =", check)
+		n, err := q.KeysOnly().Count(c)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cr := &checkReport{Count: n, Issues: []integrityIssue{}}
+		if _, err := q.Limit(100).GetAll(c, &cr.Issues); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		report[check] = cr
+	}
+
+	mustEncode(c, w, r, map[string]interface{}{"run": name, "checks": report})
+}
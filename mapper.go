@@ -0,0 +1,277 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// How many times a batch is tried within a chunk before the chunk is
+// failed back to the queue.
+const mapAttempts = 3
+
+// A mapper is a step /batch/map can run over the keys of a kind.
+// Chunks of keys are posted to /batch/<name>, where the framework
+// splits them into batches and hands them to Map.
+type mapper interface {
+	Name() string
+	Accepts(kind string) bool
+
+	// BatchSize is how many keys Map gets at once and Concurrency is
+	// how many batches of a chunk run at the same time.
+	BatchSize() int
+	Concurrency() int
+
+	// Mutates is true of mappers that change or delete what they map
+	// over.  Their Map reports what it changes with changed and, when
+	// isDryRun, changes nothing.
+	Mutates() bool
+
+	Map(c context.Context, params url.Values, keys []*datastore.Key) error
+}
+
+var mappers = map[string]mapper{}
+
+func registerMapper(m mapper) {
+	if _, dup := mappers[m.Name()]; dup {
+		panic("duplicate mapper: " + m.Name())
+	}
+	mappers[m.Name()] = m
+	http.HandleFunc(mapperPath(m.Name()), deadLetters(runMapper(m)))
+}
+
+func mapperPath(name string) string {
+	return "/batch/" + name
+}
+
+// kindMapper is a mapper over a fixed set of kinds, or any kind if
+// none are listed.
+type kindMapper struct {
+	name        string
+	kinds       []string
+	batchSize   int
+	concurrency int
+	mutates     bool
+	f           func(c context.Context, params url.Values, keys []*datastore.Key) error
+}
+
+func (m kindMapper) Name() string     { return m.name }
+func (m kindMapper) BatchSize() int   { return m.batchSize }
+func (m kindMapper) Concurrency() int { return m.concurrency }
+func (m kindMapper) Mutates() bool    { return m.mutates }
+
+func (m kindMapper) Accepts(kind string) bool {
+	if len(m.kinds) == 0 {
+		return true
+	}
+	for _, k := range m.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (m kindMapper) Map(c context.Context, params url.Values, keys []*datastore.Key) error {
+	return m.f(c, params, keys)
+}
+
+type mapperChoice struct {
+	Mapper, Kind string
+}
+
+// mapperChoices lists every mapper and kind that can go together.
+func mapperChoices(kinds []string) []mapperChoice {
+	var names []string
+	for name := range mappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rv []mapperChoice
+	for _, name := range names {
+		for _, kind := range kinds {
+			if mappers[name].Accepts(kind) {
+				rv = append(rv, mapperChoice{name, kind})
+			}
+		}
+	}
+	return rv
+}
+
+// mapWithRetries runs a batch until it works or runs out of
+// attempts.  A reducer's emitted values and a mutating mapper's
+// changes are only kept from the attempt that worked.
+func mapWithRetries(c context.Context, m mapper, params url.Values, keys []*datastore.Key,
+	e *emitter, cs *changeSet, retries *int64) error {
+
+	var err error
+	for i := 0; i < mapAttempts; i++ {
+		if i > 0 {
+			atomic.AddInt64(retries, 1)
+			time.Sleep(time.Duration(i) * 250 * time.Millisecond)
+		}
+		bc, be, bcs := c, newEmitter(), &changeSet{}
+		if e != nil {
+			bc = context.WithValue(bc, emitterKey{}, be)
+		}
+		if cs != nil {
+			bc = context.WithValue(bc, changeSetKey{}, bcs)
+		}
+		if err = m.Map(bc, params, keys); err == nil {
+			if e != nil {
+				e.merge(be)
+			}
+			if cs != nil {
+				cs.merge(bcs)
+			}
+			return nil
+		}
+		log.Warningf(c, "Error mapping %v %v keys with %v (attempt %v): %v",
+			len(keys), keys[0].Kind(), m.Name(), i+1, err)
+	}
+	return err
+}
+
+// mapBatches runs m over keys in batches, returning how many batches
+// needed retrying.  Anything a reducer emits is collected in e, and
+// anything a mutating mapper changes in cs.
+func mapBatches(c context.Context, m mapper, params url.Values, keys []*datastore.Key,
+	e *emitter, cs *changeSet) (int64, error) {
+
+	var retries int64
+	grp, cc := errgroup.WithContext(c)
+	sem := make(chan bool, m.Concurrency())
+	for len(keys) > 0 {
+		n := m.BatchSize()
+		if n > len(keys) {
+			n = len(keys)
+		}
+		todo := keys[:n]
+		grp.Go(func() error {
+			sem <- true
+			defer func() { <-sem }()
+			return mapWithRetries(cc, m, params, todo, e, cs, &retries)
+		})
+		keys = keys[n:]
+	}
+	err := grp.Wait()
+	return retries, err
+}
+
+// runMapper handles the chunks /batch/map queues for m.  Chunks of a
+// cancelled job are dropped unprocessed and everything else is counted
+// against its job, if it has one.
+func runMapper(m mapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		start := time.Now()
+
+		var jobKey *datastore.Key
+		var j *batchJob
+		if ks := r.Header.Get(batchJobHeader); ks != "" {
+			var err error
+			if jobKey, err = datastore.DecodeKey(ks); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			// Without the job we can't tell a dry run from the real thing.
+			j, err = getBatchJob(c, jobKey)
+			if err != nil {
+				log.Errorf(c, "Error looking up job %v: %v", jobKey.IntID(), err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if j.State == "cancelled" {
+				log.Infof(c, "Job %v was cancelled, dropping chunk", jobKey.IntID())
+				w.WriteHeader(204)
+				return
+			}
+		}
+
+		keys, err := decodeKeys(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		for _, k := range keys {
+			if !m.Accepts(k.Kind()) {
+				log.Errorf(c, "%v doesn't map %v", m.Name(), k.Kind())
+				http.Error(w, m.Name()+" doesn't map "+k.Kind(), 400)
+				return
+			}
+		}
+		log.Debugf(c, "Mapping %v keys with %v", len(keys), m.Name())
+
+		var e *emitter
+		if _, ok := m.(reducer); ok {
+			if jobKey == nil {
+				http.Error(w, m.Name()+" can only run as part of a job", 400)
+				return
+			}
+			e = newEmitter()
+		}
+
+		mc := c
+		// Changes are only tracked when there's a preview to compare.
+		var cs *changeSet
+		if m.Mutates() && j != nil && (j.DryRun || j.Preview != nil) {
+			cs = &changeSet{}
+			if j.DryRun {
+				log.Infof(c, "Dry run, nothing will be changed")
+				mc = context.WithValue(c, dryRunKey{}, true)
+			}
+		}
+
+		retries, err := mapBatches(mc, m, r.URL.Query(), keys, e, cs)
+		if err == nil && e != nil {
+			err = storeMapOutput(c, jobKey, keys, e)
+		}
+		if err == nil && cs != nil {
+			err = storeChanged(c, jobKey, keys, cs)
+			if err == nil && j.DryRun && len(cs.keys) > 0 && len(j.Sample) < previewSamples {
+				err = recordSample(c, jobKey, cs.keys)
+			}
+		}
+
+		if jobKey != nil {
+			counts := map[string]int64{
+				"completed": 1,
+				"keys":      int64(len(keys)),
+				"retries":   retries,
+				"ms":        int64(time.Since(start) / time.Millisecond),
+			}
+			if cs != nil {
+				counts["changed"] = int64(len(cs.keys))
+				counts["digest"] = keyDigest(cs.keys)
+			}
+			if err != nil {
+				if err := failChunk(c, jobKey, keys, retries); err != nil {
+					log.Warningf(c, "Error recording progress of job %v: %v", jobKey.IntID(), err)
+				}
+			} else if err = countChunk(c, jobKey, keys, counts); err != nil {
+				// Try the chunk again rather than leave the job
+				// waiting on it forever.
+				err = fmt.Errorf("recording progress of job %v: %v", jobKey.IntID(), err)
+			}
+		}
+
+		if err != nil {
+			log.Errorf(c, "Error mapping with %v: %v", m.Name(), err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,674 @@
+package autotown
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	mapOutputKind  = "MapOutput"
+	mapReducedKind = "MapReduced"
+	mapResultKind  = "MapResult"
+
+	reducePartitions = 10
+	reducePoll       = 15 * time.Second
+
+	// Leave some room under the entity size limit.
+	maxResultSize = 900 << 10
+)
+
+func init() {
+	http.HandleFunc("/batch/reduce", handleReduce)
+	http.HandleFunc("/batch/reducePart", deadLetters(handleReducePart))
+	http.HandleFunc("/admin/mapResult", handleMapResult)
+
+	registerMapper(sumReducer{kindMapper{name: "usageSummary", kinds: []string{"FoundController"},
+		batchSize: 100, concurrency: 1, f: mapUsageSummary}})
+	registerMapper(statsReducer{kindMapper{name: "tuneStats", kinds: []string{"TuneResults"},
+		batchSize: 20, concurrency: 5, f: mapTuneStats}, []string{"country|", "month|"}})
+	registerMapper(sumReducer{kindMapper{name: "crashRates", kinds: []string{"CrashData"},
+		batchSize: 100, concurrency: 1, f: mapCrashRates}})
+}
+
+// A reducer is a mapper whose Map emits key/value pairs (see emit).
+// Once every chunk has been mapped, the values emitted for each key
+// are combined by Reduce and the lot is stored as a MapResult.
+type reducer interface {
+	mapper
+	Reduce(c context.Context, key string, values []float64) (interface{}, error)
+}
+
+type emitter struct {
+	mu   sync.Mutex
+	vals map[string][]float64
+}
+
+func newEmitter() *emitter {
+	return &emitter{vals: map[string][]float64{}}
+}
+
+func (e *emitter) merge(from *emitter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, vs := range from.vals {
+		e.vals[k] = append(e.vals[k], vs...)
+	}
+}
+
+type emitterKey struct{}
+
+// emit records a value for the reduce phase.  It may only be called
+// from a reducer's Map.
+func emit(c context.Context, key string, v float64) {
+	e, ok := c.Value(emitterKey{}).(*emitter)
+	if !ok {
+		panic("emit called outside of a reducer")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vals[key] = append(e.vals[key], v)
+}
+
+func reducePartition(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % reducePartitions)
+}
+
+// mapOutput is one chunk's emitted values for one partition.
+type mapOutput struct {
+	Job  int64  `datastore:"job"`
+	Part int    `datastore:"part"`
+	Data []byte `datastore:"data,noindex"`
+}
+
+func encodeGz(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return gz(j)
+}
+
+func decodeGz(d []byte, v interface{}) error {
+	j, err := ungz(d)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// chunkID names a chunk of keys the same way every time it's
+// delivered.
+func chunkID(keys []*datastore.Key) string {
+	h := sha1.New()
+	for _, k := range keys {
+		fmt.Fprintln(h, k.Encode())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// storeMapOutput saves what a chunk emitted, one root entity per
+// partition so chunks don't share an entity group.  Keys are derived
+// from the chunk, so a redelivered chunk replaces its earlier output.
+// Every partition gets one, even if it's empty, so a reducer can tell
+// when it's seen every completed chunk's.
+func storeMapOutput(c context.Context, jobKey *datastore.Key, keys []*datastore.Key, e *emitter) error {
+	chunk := chunkID(keys)
+
+	parts := make([]map[string][]float64, reducePartitions)
+	for p := range parts {
+		parts[p] = map[string][]float64{}
+	}
+	for k, vs := range e.vals {
+		parts[reducePartition(k)][k] = vs
+	}
+
+	var okeys []*datastore.Key
+	var outs []*mapOutput
+	for p, vals := range parts {
+		d, err := encodeGz(vals)
+		if err != nil {
+			return err
+		}
+		okeys = append(okeys, datastore.NewKey(c, mapOutputKind,
+			fmt.Sprintf("%d-%s-%d", jobKey.IntID(), chunk, p), 0, nil))
+		outs = append(outs, &mapOutput{Job: jobKey.IntID(), Part: p, Data: d})
+	}
+	_, err := datastore.PutMulti(c, okeys, outs)
+	return err
+}
+
+func queueReduce(c context.Context, jobKey *datastore.Key, delay time.Duration) error {
+	t := taskqueue.NewPOSTTask("/batch/reduce", url.Values{"job": []string{jobKey.Encode()}})
+	t.Delay = delay
+	_, err := taskqueue.Add(c, t, "")
+	return err
+}
+
+func reducedKey(c context.Context, job int64, part int) *datastore.Key {
+	return datastore.NewKey(c, mapReducedKind, fmt.Sprintf("%d-%d", job, part), 0, nil)
+}
+
+// handleReduce drives a reducer job: it waits for the map phase to
+// finish, fans out a task per partition and collects their results
+// once they're all in.
+func handleReduce(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	k, err := datastore.DecodeKey(r.FormValue("job"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	j, err := getBatchJob(c, k)
+	if err == nil {
+		err = j.loadCounts(c)
+	}
+	if err != nil {
+		log.Errorf(c, "Error fetching job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if j.State == "cancelled" {
+		log.Infof(c, "Job %v was cancelled, not reducing", k.IntID())
+		w.WriteHeader(204)
+		return
+	}
+	if j.Dead > 0 && j.Phase != "done" {
+		stalled, err := stallReduce(c, k)
+		if err != nil {
+			log.Errorf(c, "Error stalling job %v: %v", k.IntID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if stalled {
+			log.Warningf(c, "Job %v has dead lettered tasks, waiting for them to be replayed", k.IntID())
+			w.WriteHeader(204)
+			return
+		}
+	}
+
+	switch j.Phase {
+	case "map":
+		if !j.Listed || j.Completed < int64(j.Tasks) {
+			break
+		}
+		var tasks []*taskqueue.Task
+		for p := 0; p < reducePartitions; p++ {
+			t := taskqueue.NewPOSTTask("/batch/reducePart", url.Values{
+				"job":  []string{k.Encode()},
+				"part": []string{strconv.Itoa(p)},
+			})
+			// So a dead lettered partition counts against the job.
+			t.Header.Set(batchJobHeader, k.Encode())
+			tasks = append(tasks, t)
+		}
+		if err := queueMany(c, mapStage2, tasks); err == nil {
+			err = setJobPhase(c, k, "reduce", "")
+		}
+		if err != nil {
+			log.Errorf(c, "Error starting reduce of job %v: %v", k.IntID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Infof(c, "Job %v mapped %v keys, reducing", k.IntID(), j.Processed)
+
+	case "reduce":
+		done, err := collectReduced(c, j)
+		if err != nil {
+			log.Errorf(c, "Error collecting results of job %v: %v", k.IntID(), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if done {
+			log.Infof(c, "Job %v stored result %q", k.IntID(), j.Result)
+			w.WriteHeader(204)
+			return
+		}
+
+	default:
+		w.WriteHeader(204)
+		return
+	}
+
+	if err := queueReduce(c, k, reducePoll); err != nil {
+		log.Errorf(c, "Error requeueing reduce of job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// stallReduce marks a job as waiting on its dead letters, so it stops
+// polling until one is replayed (see resumeReduce).  It rechecks the
+// dead count alongside the job, in case they've all just been
+// replayed.
+func stallReduce(c context.Context, k *datastore.Key) (bool, error) {
+	stalled := false
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		counts, err := readCounters(tc, batchJobCountsKind, batchJobGroup(k), batchJobShards)
+		if err != nil || counts["dead"] <= 0 {
+			return err
+		}
+		j := &batchJob{}
+		if err := datastore.Get(tc, k, j); err != nil {
+			return err
+		}
+		j.Stalled, j.Updated = true, time.Now()
+		_, err = datastore.Put(tc, k, j)
+		stalled = err == nil
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return stalled, err
+}
+
+// resumeReduce sets a stalled job polling again.  It's called from
+// the transaction replaying one of its dead letters, and only the
+// first replay needs to.
+func resumeReduce(c context.Context, k *datastore.Key) error {
+	j := &batchJob{}
+	if err := datastore.Get(c, k, j); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !j.Stalled {
+		return nil
+	}
+	j.Stalled, j.Updated = false, time.Now()
+	if _, err := datastore.Put(c, k, j); err != nil {
+		return err
+	}
+	return queueReduce(c, k, 0)
+}
+
+func setJobPhase(c context.Context, k *datastore.Key, phase, state string) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		j := &batchJob{}
+		if err := datastore.Get(tc, k, j); err != nil {
+			return err
+		}
+		j.Phase, j.Updated = phase, time.Now()
+		if state != "" {
+			j.State = state
+		}
+		_, err := datastore.Put(tc, k, j)
+		return err
+	}, nil)
+}
+
+func handleReducePart(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	k, err := datastore.DecodeKey(r.FormValue("job"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	part, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	j, err := getBatchJob(c, k)
+	if err == nil {
+		err = j.loadCounts(c)
+	}
+	if err != nil {
+		log.Errorf(c, "Error fetching job %v: %v", k.IntID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	red, ok := mappers[j.Mapper].(reducer)
+	if !ok {
+		http.Error(w, j.Mapper+" isn't a reducer", 400)
+		return
+	}
+
+	vals := map[string][]float64{}
+	outputs := int64(0)
+	q := datastore.NewQuery(mapOutputKind).Filter("job =", k.IntID()).Filter("part =", part)
+	for t := q.Run(c); ; {
+		var o mapOutput
+		_, err := t.Next(&o)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			log.Errorf(c, "Error fetching map output: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		chunk := map[string][]float64{}
+		if err := decodeGz(o.Data, &chunk); err != nil {
+			log.Errorf(c, "Error decoding map output: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for key, vs := range chunk {
+			vals[key] = append(vals[key], vs...)
+		}
+		outputs++
+	}
+	// The query is eventually consistent, so it may not have caught
+	// up with the last chunks yet.
+	if outputs < j.Completed {
+		log.Infof(c, "Only found %v of %v chunks' output for partition %v of job %v, retrying",
+			outputs, j.Completed, part, k.IntID())
+		http.Error(w, "map output not all visible yet", 503)
+		return
+	}
+
+	results := map[string]interface{}{}
+	for key, vs := range vals {
+		res, err := red.Reduce(c, key, vs)
+		if err != nil {
+			log.Errorf(c, "Error reducing %q: %v", key, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		results[key] = res
+	}
+
+	d, err := encodeGz(results)
+	if err == nil {
+		_, err = datastore.Put(c, reducedKey(c, k.IntID(), part),
+			&mapOutput{Job: k.IntID(), Part: part, Data: d})
+	}
+	if err != nil {
+		log.Errorf(c, "Error storing reduced partition %v: %v", part, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof(c, "Reduced %v keys in partition %v of job %v", len(vals), part, k.IntID())
+	w.WriteHeader(204)
+}
+
+// mapResult is the output of a reducer job, along with where it came
+// from.
+type mapResult struct {
+	Job      string    `datastore:"job,noindex" json:"job"`
+	Kind     string    `datastore:"kind" json:"kind"`
+	Mapper   string    `datastore:"mapper" json:"mapper"`
+	Params   string    `datastore:"params,noindex" json:"params,omitempty"`
+	Filters  []string  `datastore:"filters,noindex" json:"filters,omitempty"`
+	Keys     int64     `datastore:"keys,noindex" json:"keys"`
+	Started  time.Time `datastore:"started" json:"started"`
+	Finished time.Time `datastore:"finished" json:"finished"`
+
+	// Results too big for the entity go in this object in the app's
+	// bucket instead of Data.
+	Blob string `datastore:"blob,noindex" json:"blob,omitempty"`
+
+	Data    []byte                 `datastore:"data,noindex" json:"-"`
+	Results map[string]interface{} `datastore:"-" json:"results"`
+}
+
+func resultObject(name string) string {
+	return "mapresult/" + name + ".json.gz"
+}
+
+// storeResultBlob writes a result's compressed data to its object.
+func storeResultBlob(c context.Context, name string, d []byte) (string, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, "")
+	if err != nil {
+		return "", err
+	}
+
+	wctx, cancel := context.WithCancel(c)
+	defer cancel()
+	obj := resultObject(name)
+	ow := bucket.Object(obj).NewWriter(wctx)
+	ow.ContentType = "application/gzip"
+	if _, err := ow.Write(d); err != nil {
+		return "", err
+	}
+	return obj, ow.Close()
+}
+
+// readResultBlob fetches the compressed data of a result stored as a
+// blob.
+func readResultBlob(c context.Context, obj string) ([]byte, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, "")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := bucket.Object(obj).NewReader(c)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// collectReduced stores the job's result once every partition has
+// been reduced, and cleans up after it.
+func collectReduced(c context.Context, j *batchJob) (bool, error) {
+	keys := make([]*datastore.Key, reducePartitions)
+	for p := range keys {
+		keys[p] = reducedKey(c, j.Key.IntID(), p)
+	}
+	parts := make([]mapOutput, reducePartitions)
+	err := datastore.GetMulti(c, keys, parts)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e == datastore.ErrNoSuchEntity {
+				return false, nil
+			}
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	res := &mapResult{
+		Job:      j.Key.Encode(),
+		Kind:     j.Kind,
+		Mapper:   j.Mapper,
+		Params:   j.Params,
+		Filters:  j.Filters,
+		Keys:     j.Processed,
+		Started:  j.Started,
+		Finished: time.Now(),
+		Results:  map[string]interface{}{},
+	}
+	for _, p := range parts {
+		part := map[string]interface{}{}
+		if err := decodeGz(p.Data, &part); err != nil {
+			return false, err
+		}
+		for k, v := range part {
+			res.Results[k] = v
+		}
+	}
+	if res.Data, err = encodeGz(res.Results); err != nil {
+		return false, err
+	}
+	if len(res.Data) > maxResultSize {
+		log.Infof(c, "Result %q is %v bytes compressed, storing it as a blob", j.Result, len(res.Data))
+		if res.Blob, err = storeResultBlob(c, j.Result, res.Data); err != nil {
+			return false, err
+		}
+		res.Data = nil
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, mapResultKind, j.Result, 0, nil), res); err != nil {
+		return false, err
+	}
+	if err := setJobPhase(c, j.Key, "done", "done"); err != nil {
+		return false, err
+	}
+
+	outs, err := datastore.NewQuery(mapOutputKind).Filter("job =", j.Key.IntID()).KeysOnly().GetAll(c, nil)
+	if err == nil {
+		err = datastore.DeleteMulti(c, append(outs, keys...))
+	}
+	if err != nil {
+		log.Warningf(c, "Error cleaning up after job %v: %v", j.Key.IntID(), err)
+	}
+	return true, nil
+}
+
+// Params:
+// - name: the result to fetch
+func handleMapResult(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	res := &mapResult{}
+	if err := datastore.Get(c, datastore.NewKey(c, mapResultKind, r.FormValue("name"), 0, nil), res); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such result", 404)
+			return
+		}
+		log.Errorf(c, "Error fetching result %q: %v", r.FormValue("name"), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if res.Blob != "" {
+		d, err := readResultBlob(c, res.Blob)
+		if err != nil {
+			log.Errorf(c, "Error fetching result %q from %v: %v", r.FormValue("name"), res.Blob, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		res.Data = d
+	}
+	if err := decodeGz(res.Data, &res.Results); err != nil {
+		log.Errorf(c, "Error decoding result %q: %v", r.FormValue("name"), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	mustEncode(c, w, r, res)
+}
+
+// sumReducer adds up everything emitted for a key.
+type sumReducer struct {
+	kindMapper
+}
+
+func (sumReducer) Reduce(c context.Context, key string, values []float64) (interface{}, error) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum, nil
+}
+
+type numStats struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// statsReducer summarizes the distribution of values for a key.
+type statsReducer struct {
+	kindMapper
+	// Keys with these prefixes are counts, and are just added up.
+	counts []string
+}
+
+func (r statsReducer) Reduce(c context.Context, key string, values []float64) (interface{}, error) {
+	for _, p := range r.counts {
+		if strings.HasPrefix(key, p) {
+			return sumReducer{}.Reduce(c, key, values)
+		}
+	}
+	st := numStats{Count: len(values), Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, v := range values {
+		st.Sum += v
+		st.Min = math.Min(st.Min, v)
+		st.Max = math.Max(st.Max, v)
+	}
+	if st.Count > 0 {
+		st.Mean = st.Sum / float64(st.Count)
+	}
+	return st, nil
+}
+
+// mapUsageSummary emits the same counters as the incremental usage
+// summary, so the two can be checked against each other.
+func mapUsageSummary(c context.Context, params url.Values, keys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	fcs := make([]FoundController, len(keys))
+	if err := datastore.GetMulti(c, keys, fcs); err != nil {
+		return err
+	}
+	for i := range fcs {
+		for _, n := range summaryContrib(&fcs[i], boards) {
+			emit(c, n, 1)
+		}
+	}
+	return nil
+}
+
+func mapTuneStats(c context.Context, params url.Values, keys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	tunes := make([]TuneResults, len(keys))
+	if err := datastore.GetMulti(c, keys, tunes); err != nil {
+		return err
+	}
+	for _, t := range tunes {
+		bn := boards.canonical(t.Board)
+		emit(c, "tau|"+bn, t.Tau)
+		emit(c, "country|"+t.Country, 1)
+		emit(c, "month|"+t.Timestamp.Format("2006-01"), 1)
+	}
+	return nil
+}
+
+// mapCrashRates counts crashes by day and firmware version.
+func mapCrashRates(c context.Context, params url.Values, keys []*datastore.Key) error {
+	crashes := make([]CrashData, len(keys))
+	if err := datastore.GetMulti(c, keys, crashes); err != nil {
+		return err
+	}
+	for _, x := range crashes {
+		s := func(k string) string { v, _ := x.properties[k].(string); return v }
+		ts, _ := x.properties["timestamp"].(time.Time)
+		version := s("gitTag")
+		if version == "" {
+			version = s("gitCommit")
+		}
+		emit(c, ts.Format(dayFmt)+"|"+version, 1)
+	}
+	return nil
+}
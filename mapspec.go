@@ -0,0 +1,198 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var mapFilterRE = regexp.MustCompile(`^\s*([\w.]+)\s*(<=|>=|=|<|>)\s*(.*?)\s*$`)
+
+// mapSpec describes what a batch job maps over and with.
+//
+// Filters look like "timestamp >= 2017-01-01" or `uuid = "abc"` and
+// apply to indexed properties.  Unquoted values that look like a date,
+// number or bool are taken as one.  Only one property (counting the
+// key range) can have inequality filters, and mixing equality and
+// inequality filters needs a matching composite index.
+type mapSpec struct {
+	Kind    string   `datastore:"kind" json:"kind"`
+	Mapper  string   `datastore:"mapper" json:"mapper"`
+	Params  string   `datastore:"params,noindex" json:"params,omitempty"`
+	Filters []string `datastore:"filters,noindex" json:"filters,omitempty"`
+
+	// Keys are either encoded or the name or ID of one of Kind.
+	// KeyStart is inclusive, KeyEnd exclusive.
+	KeyStart string `datastore:"key_start,noindex" json:"key_start,omitempty"`
+	KeyEnd   string `datastore:"key_end,noindex" json:"key_end,omitempty"`
+
+	// At most this many entities are mapped; 0 is no limit.
+	Limit     int    `datastore:"limit,noindex" json:"limit,omitempty"`
+	Namespace string `datastore:"namespace,noindex" json:"namespace,omitempty"`
+
+	// The MapResult a reducer stores its output in; defaults to
+	// the mapper's name.
+	Result string `datastore:"result,noindex" json:"result,omitempty"`
+}
+
+// specFromForm reads a spec from either the batch form, which has one
+// filter per line, or a /batch/map task.
+func specFromForm(r *http.Request) (mapSpec, error) {
+	s := mapSpec{
+		Kind:      r.FormValue("kind"),
+		Mapper:    r.FormValue("mapper"),
+		Params:    r.FormValue("params"),
+		KeyStart:  r.FormValue("key_start"),
+		KeyEnd:    r.FormValue("key_end"),
+		Namespace: r.FormValue("namespace"),
+		Result:    r.FormValue("result"),
+	}
+	if mk := strings.SplitN(r.FormValue("map"), ":", 2); len(mk) == 2 {
+		s.Mapper, s.Kind = mk[0], mk[1]
+	}
+	s.Filters = append(s.Filters, r.Form["filter"]...)
+	for _, f := range strings.Split(r.FormValue("filters"), "\n") {
+		if strings.TrimSpace(f) != "" {
+			s.Filters = append(s.Filters, strings.TrimSpace(f))
+		}
+	}
+	if ls := r.FormValue("limit"); ls != "" {
+		n, err := strconv.Atoi(ls)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("invalid limit: %q", ls)
+		}
+		s.Limit = n
+	}
+
+	if s.Kind == "" || s.Mapper == "" {
+		return s, fmt.Errorf("kind and mapper are required")
+	}
+	if _, err := url.ParseQuery(s.Params); err != nil {
+		return s, fmt.Errorf("invalid params: %v", err)
+	}
+	return s, nil
+}
+
+// legacyNext turns the next param of a /batch/map task queued before
+// maps were described by a mapSpec into the mapper and params it
+// named, so the rest of the map carries on in the new form.
+func legacyNext(r *http.Request) error {
+	next := r.FormValue("next")
+	if next == "" || r.FormValue("mapper") != "" {
+		return nil
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return fmt.Errorf("invalid next: %v", err)
+	}
+	name := strings.TrimPrefix(u.Path, mapperPath(""))
+	if _, ok := mappers[name]; !ok || mapperPath(name) != u.Path {
+		return fmt.Errorf("no mapper at %q", u.Path)
+	}
+	r.Form.Set("mapper", name)
+	r.Form.Set("params", u.RawQuery)
+	r.Form.Del("next")
+	return nil
+}
+
+func (s mapSpec) form() url.Values {
+	v := url.Values{
+		"kind":   []string{s.Kind},
+		"mapper": []string{s.Mapper},
+		"params": []string{s.Params},
+		"filter": s.Filters,
+	}
+	for k, val := range map[string]string{
+		"key_start": s.KeyStart,
+		"key_end":   s.KeyEnd,
+		"namespace": s.Namespace,
+		"result":    s.Result,
+	} {
+		if val != "" {
+			v.Set(k, val)
+		}
+	}
+	if s.Limit > 0 {
+		v.Set("limit", strconv.Itoa(s.Limit))
+	}
+	return v
+}
+
+func parseFilterValue(s string) interface{} {
+	if strings.HasPrefix(s, `"`) {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	for _, layout := range []string{time.RFC3339, dayFmt} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
+
+func (s mapSpec) parseKey(c context.Context, ks string) *datastore.Key {
+	if k, err := datastore.DecodeKey(ks); err == nil {
+		return k
+	}
+	if id, err := strconv.ParseInt(ks, 10, 64); err == nil {
+		return datastore.NewKey(c, s.Kind, "", id, nil)
+	}
+	return datastore.NewKey(c, s.Kind, ks, 0, nil)
+}
+
+// query builds the keys-only query for the spec, along with the
+// context (and so namespace) to run it in.
+func (s mapSpec) query(c context.Context) (*datastore.Query, context.Context, error) {
+	if s.Namespace != "" {
+		var err error
+		if c, err = appengine.Namespace(c, s.Namespace); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	q := datastore.NewQuery(s.Kind).KeysOnly()
+	inequalities := map[string]bool{}
+	for _, f := range s.Filters {
+		m := mapFilterRE.FindStringSubmatch(f)
+		if m == nil {
+			return nil, nil, fmt.Errorf("invalid filter: %q", f)
+		}
+		if m[2] != "=" {
+			inequalities[m[1]] = true
+		}
+		q = q.Filter(m[1]+" "+m[2], parseFilterValue(m[3]))
+	}
+	if s.KeyStart != "" {
+		inequalities["__key__"] = true
+		q = q.Filter("__key__ >=", s.parseKey(c, s.KeyStart))
+	}
+	if s.KeyEnd != "" {
+		inequalities["__key__"] = true
+		q = q.Filter("__key__ <", s.parseKey(c, s.KeyEnd))
+	}
+	if len(inequalities) > 1 {
+		return nil, nil, fmt.Errorf("inequality filters on more than one property")
+	}
+
+	return q, c, nil
+}
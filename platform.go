@@ -0,0 +1,236 @@
+package autotown
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// A gcsPlatform is what the GCS's reported OS, CPU architecture and
+// version strings boil down to.
+type gcsPlatform struct {
+	// Windows, macOS, Linux, Android, BSD or Other.
+	OSFamily  string `datastore:"os_family" json:"os_family,omitempty"`
+	OSDistro  string `datastore:"os_distro" json:"os_distro,omitempty"`
+	OSVersion string `datastore:"os_version" json:"os_version,omitempty"`
+	OSKernel  string `datastore:"os_kernel,noindex" json:"os_kernel,omitempty"`
+	OSBuild   int    `datastore:"os_build" json:"os_build,omitempty"`
+
+	Arch string `datastore:"arch" json:"arch,omitempty"`
+
+	// The GCS version as major.minor.patch, plus whatever git
+	// describe added to it.
+	GCSVersion string `datastore:"gcs_semver" json:"gcs_version,omitempty"`
+	GCSMajor   int    `datastore:"gcs_major,noindex" json:"gcs_major"`
+	GCSMinor   int    `datastore:"gcs_minor,noindex" json:"gcs_minor"`
+	GCSPatch   int    `datastore:"gcs_patch,noindex" json:"gcs_patch"`
+	GCSPre     string `datastore:"gcs_pre" json:"gcs_pre,omitempty"`
+	GCSAhead   int    `datastore:"gcs_ahead,noindex" json:"gcs_ahead,omitempty"`
+	GCSCommit  string `datastore:"gcs_commit" json:"gcs_commit,omitempty"`
+	GCSDirty   bool   `datastore:"gcs_dirty,noindex" json:"gcs_dirty,omitempty"`
+}
+
+var (
+	osNumRe    = regexp.MustCompile(`\d+(?:\.\d+)*`)
+	osParenRe  = regexp.MustCompile(`\(([^)]*)\)\s*$`)
+	osBuildRe  = regexp.MustCompile(`(?i)build\s+(\d+)`)
+	osKernelRe = regexp.MustCompile(`\d+\.\d+(?:\.\d+)?-[\w.+~-]+`)
+)
+
+var bsds = []string{"FreeBSD", "OpenBSD", "NetBSD", "DragonFly"}
+
+// Distributions that don't say Linux in their names.
+var linuxDistros = []string{"Ubuntu", "Debian", "Fedora", "Mint", "openSUSE", "SUSE",
+	"CentOS", "Red Hat", "elementary", "Manjaro", "Gentoo", "Raspbian", "Kubuntu",
+	"Xubuntu", "Lubuntu", "Mageia", "Slackware", "Solus", "Zorin", "Deepin"}
+
+func hasAnyPrefix(s string, ps []string) bool {
+	for _, p := range ps {
+		if strings.HasPrefix(strings.ToLower(s), strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOS picks apart the GCS's description of its OS, which looks
+// like "Windows 10 (10.0.15063)", "macOS Sierra (10.12)", "Ubuntu
+// 16.04.2 LTS" or "Linux 4.4.0-21-generic".
+func (p *gcsPlatform) parseOS(s string) {
+	s = strings.TrimSpace(s)
+	paren := ""
+	if m := osParenRe.FindStringSubmatch(s); m != nil {
+		paren = m[1]
+	}
+	name := strings.TrimSpace(osParenRe.ReplaceAllString(s, ""))
+
+	switch {
+	case s == "":
+	case strings.HasPrefix(s, "Windows"):
+		p.OSFamily = "Windows"
+		if f := strings.Fields(strings.TrimPrefix(name, "Windows")); len(f) > 0 {
+			p.OSVersion = f[0]
+		}
+		if parts := strings.Split(paren, "."); len(parts) == 3 {
+			p.OSBuild, _ = strconv.Atoi(parts[2])
+		}
+		if m := osBuildRe.FindStringSubmatch(s); m != nil {
+			p.OSBuild, _ = strconv.Atoi(m[1])
+		}
+	case hasAnyPrefix(s, []string{"OS X", "Mac OS", "macOS"}):
+		p.OSFamily = "macOS"
+		if osNumRe.MatchString(paren) {
+			p.OSVersion = osNumRe.FindString(paren)
+		} else {
+			p.OSVersion = osNumRe.FindString(name)
+		}
+	case strings.HasPrefix(s, "Android"):
+		p.OSFamily = "Android"
+		p.OSVersion = osNumRe.FindString(name)
+	case hasAnyPrefix(s, bsds):
+		p.OSFamily = "BSD"
+		p.OSDistro = strings.Fields(s)[0]
+		p.OSVersion = osNumRe.FindString(name)
+	case strings.Contains(strings.ToLower(s), "linux"), hasAnyPrefix(s, linuxDistros):
+		p.OSFamily = "Linux"
+		p.OSKernel = osKernelRe.FindString(s)
+		rest := strings.Replace(name, p.OSKernel, "", 1)
+		if i := osNumRe.FindStringIndex(rest); i != nil {
+			p.OSVersion = rest[i[0]:i[1]]
+			rest = rest[:i[0]]
+		}
+		p.OSDistro = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "GNU/Linux"))
+		if p.OSDistro == "Linux" {
+			p.OSDistro = ""
+		}
+	default:
+		p.OSFamily = "Other"
+		p.OSVersion = osNumRe.FindString(name)
+	}
+}
+
+func (p *gcsPlatform) parseArch(s string) {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case "x86_64", "amd64", "x64":
+		p.Arch = "x86_64"
+	case "i386", "i486", "i586", "i686", "x86":
+		p.Arch = "x86"
+	case "arm64", "aarch64":
+		p.Arch = "arm64"
+	default:
+		if strings.HasPrefix(s, "arm") {
+			s = "arm"
+		}
+		p.Arch = s
+	}
+}
+
+// isCommit reports whether a bare version is a commit hash.  Dated
+// versions like 20170412 are all hex too, so it takes a letter.
+func isCommit(s string) bool {
+	return commitRE.MatchString(s) && strings.ContainsAny(s, "abcdef")
+}
+
+func isVersionCore(s string) bool {
+	s = strings.TrimPrefix(s, "v")
+	return s != "" && osNumRe.FindString(s) == s
+}
+
+// parseGCSVersion reads a version like "Release-20170412.1",
+// "1.2.0-rc1" or what git describe makes of them, like
+// "Release-20170412.1-12-g1b2c3d4-dirty".  A name other than Release
+// in front of the version counts as a pre-release.
+func (p *gcsPlatform) parseGCSVersion(s string) {
+	s = strings.TrimSpace(s)
+	if isCommit(s) {
+		p.GCSCommit = s
+		return
+	}
+	parts := strings.Split(s, "-")
+	var pre []string
+	if len(parts) > 1 && !osNumRe.MatchString(parts[0]) && isVersionCore(parts[1]) {
+		if !strings.EqualFold(parts[0], "Release") {
+			pre = append(pre, strings.ToLower(parts[0]))
+		}
+		parts = parts[1:]
+	}
+
+	if !isVersionCore(parts[0]) {
+		return
+	}
+	core := strings.TrimPrefix(parts[0], "v")
+	nums := make([]int, 3)
+	for i, n := range strings.SplitN(core, ".", 3) {
+		nums[i], _ = strconv.Atoi(n)
+	}
+	p.GCSMajor, p.GCSMinor, p.GCSPatch = nums[0], nums[1], nums[2]
+	p.GCSVersion = fmt.Sprintf("%d.%d.%d", nums[0], nums[1], nums[2])
+
+	rest := parts[1:]
+	for i := 0; i < len(rest); i++ {
+		switch r := rest[i]; {
+		case r == "dirty":
+			p.GCSDirty = true
+		case i+1 < len(rest) && strings.HasPrefix(rest[i+1], "g") && commitRE.MatchString(rest[i+1][1:]):
+			if n, err := strconv.Atoi(r); err == nil {
+				p.GCSAhead = n
+				p.GCSCommit = rest[i+1][1:]
+				i++
+				continue
+			}
+			pre = append(pre, r)
+		default:
+			pre = append(pre, r)
+		}
+	}
+	p.GCSPre = strings.Join(pre, "-")
+}
+
+func parsePlatform(os, arch, version string) gcsPlatform {
+	var p gcsPlatform
+	p.parseOS(os)
+	p.parseArch(arch)
+	p.parseGCSVersion(version)
+	return p
+}
+
+// abbrevOS names the OS family the way the stats always have.  Counts
+// are kept by it, so it can't change without recounting them; the
+// platform's OSFamily has the finer split.
+func abbrevOS(s string) string {
+	switch {
+	case strings.HasPrefix(s, "Windows"):
+		return "Windows"
+	case strings.HasPrefix(s, "OS X"):
+		return "Mac"
+	case strings.HasPrefix(s, "macOS"):
+		return "Mac"
+	default:
+		return "Linux"
+	}
+}
+
+// platformProps parses a controller's GCS strings into its platform
+// properties, replacing any it had.
+func platformProps(ps []datastore.Property) ([]datastore.Property, error) {
+	get := func(n string) string {
+		s, _ := getProp(ps, n).(string)
+		return s
+	}
+	pps, err := datastore.SaveStruct(&struct {
+		Platform gcsPlatform `datastore:"platform"`
+	}{parsePlatform(get("gcs_os"), get("gcs_arch"), get("gcs_version"))})
+	if err != nil {
+		return nil, err
+	}
+	var rv []datastore.Property
+	for _, p := range ps {
+		if !strings.HasPrefix(p.Name, "platform.") {
+			rv = append(rv, p)
+		}
+	}
+	return append(rv, pps...), nil
+}
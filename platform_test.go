@@ -0,0 +1,92 @@
+package autotown
+
+import "testing"
+
+func TestParseOS(t *testing.T) {
+	tests := []struct {
+		in   string
+		want gcsPlatform
+	}{
+		{"", gcsPlatform{}},
+		{"Windows 10 (10.0.15063)", gcsPlatform{OSFamily: "Windows", OSVersion: "10", OSBuild: 15063}},
+		{"Windows 7 Build 7601", gcsPlatform{OSFamily: "Windows", OSVersion: "7", OSBuild: 7601}},
+		{"macOS Sierra (10.12)", gcsPlatform{OSFamily: "macOS", OSVersion: "10.12"}},
+		{"OS X 10.11", gcsPlatform{OSFamily: "macOS", OSVersion: "10.11"}},
+		{"Ubuntu 16.04.2 LTS", gcsPlatform{OSFamily: "Linux", OSDistro: "Ubuntu", OSVersion: "16.04.2"}},
+		{"Linux 4.4.0-21-generic", gcsPlatform{OSFamily: "Linux", OSKernel: "4.4.0-21-generic"}},
+		{"Debian GNU/Linux 9 (stretch)", gcsPlatform{OSFamily: "Linux", OSDistro: "Debian", OSVersion: "9"}},
+		{"Android 7.1", gcsPlatform{OSFamily: "Android", OSVersion: "7.1"}},
+		{"FreeBSD 11.0", gcsPlatform{OSFamily: "BSD", OSDistro: "FreeBSD", OSVersion: "11.0"}},
+		{"Haiku R1", gcsPlatform{OSFamily: "Other", OSVersion: "1"}},
+	}
+	for _, test := range tests {
+		var got gcsPlatform
+		got.parseOS(test.in)
+		if got != test.want {
+			t.Errorf("parseOS(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseGCSVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want gcsPlatform
+	}{
+		{"", gcsPlatform{}},
+		{"Release-20170412.1", gcsPlatform{GCSVersion: "20170412.1.0", GCSMajor: 20170412, GCSMinor: 1}},
+		{"20170412", gcsPlatform{GCSVersion: "20170412.0.0", GCSMajor: 20170412}},
+		{"1.2.0-rc1", gcsPlatform{GCSVersion: "1.2.0", GCSMajor: 1, GCSMinor: 2, GCSPre: "rc1"}},
+		{"v1.2.3", gcsPlatform{GCSVersion: "1.2.3", GCSMajor: 1, GCSMinor: 2, GCSPatch: 3}},
+		{"Next-20170412.1", gcsPlatform{GCSVersion: "20170412.1.0", GCSMajor: 20170412, GCSMinor: 1, GCSPre: "next"}},
+		{"Release-20170412.1-12-g1b2c3d4-dirty", gcsPlatform{GCSVersion: "20170412.1.0",
+			GCSMajor: 20170412, GCSMinor: 1, GCSAhead: 12, GCSCommit: "1b2c3d4", GCSDirty: true}},
+		{"1b2c3d4", gcsPlatform{GCSCommit: "1b2c3d4"}},
+		{"nonsense", gcsPlatform{}},
+	}
+	for _, test := range tests {
+		var got gcsPlatform
+		got.parseGCSVersion(test.in)
+		if got != test.want {
+			t.Errorf("parseGCSVersion(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		os, arch, version string
+		want              gcsPlatform
+	}{
+		{"Windows 10 (10.0.15063)", "x86_64", "Release-20170412.1", gcsPlatform{
+			OSFamily: "Windows", OSVersion: "10", OSBuild: 15063, Arch: "x86_64",
+			GCSVersion: "20170412.1.0", GCSMajor: 20170412, GCSMinor: 1}},
+		{"Ubuntu 16.04.2 LTS", "amd64", "1b2c3d4", gcsPlatform{
+			OSFamily: "Linux", OSDistro: "Ubuntu", OSVersion: "16.04.2", Arch: "x86_64",
+			GCSCommit: "1b2c3d4"}},
+		{"Android 7.1", "armv7l", "", gcsPlatform{OSFamily: "Android", OSVersion: "7.1", Arch: "arm"}},
+		{"macOS Sierra (10.12)", "i686", "", gcsPlatform{OSFamily: "macOS", OSVersion: "10.12", Arch: "x86"}},
+	}
+	for _, test := range tests {
+		if got := parsePlatform(test.os, test.arch, test.version); got != test.want {
+			t.Errorf("parsePlatform(%q, %q, %q) = %+v, want %+v",
+				test.os, test.arch, test.version, got, test.want)
+		}
+	}
+}
+
+func TestAbbrevOSKeepsOldBuckets(t *testing.T) {
+	for in, want := range map[string]string{
+		"Windows 10 (10.0.15063)": "Windows",
+		"OS X 10.11":              "Mac",
+		"macOS Sierra (10.12)":    "Mac",
+		"Ubuntu 16.04.2 LTS":      "Linux",
+		"Android 7.1":             "Linux",
+		"FreeBSD 11.0":            "Linux",
+		"":                        "Linux",
+	} {
+		if got := abbrevOS(in); got != want {
+			t.Errorf("abbrevOS(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package autotown
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	privacySaltKind = "PrivacySalt"
+	saltPeriodFmt   = "2006-01"
+)
+
+// Kinds that record where they came from.
+var addrKinds = []string{"TuneResults", "UsageStat", "CrashData", "FoundController"}
+
+func init() {
+	registerMapper(kindMapper{name: "scrubAddrs", kinds: addrKinds,
+		batchSize: 100, concurrency: 1, mutates: true, f: mapScrubAddrs})
+
+	http.HandleFunc("/admin/scrubAddrs", handleScrubAddrs)
+}
+
+// privacyPolicy describes what we're willing to keep about where a
+// request came from.  It's configured through env_variables in the
+// app config:
+//
+//	PRIVACY_IP_MODE         keep, truncate, hash or drop
+//	PRIVACY_GRID            degrees to snap lat/lon to; 0 leaves them be
+//	PRIVACY_RETENTION_DAYS  how long addrs are kept at all; 0 is forever
+type privacyPolicy struct {
+	IPMode    string
+	Grid      float64
+	Retention time.Duration
+}
+
+func currentPrivacy() privacyPolicy {
+	p := privacyPolicy{IPMode: os.Getenv("PRIVACY_IP_MODE")}
+	switch p.IPMode {
+	case "keep", "truncate", "hash", "drop":
+	default:
+		p.IPMode = "keep"
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("PRIVACY_GRID"), 64); err == nil && f > 0 {
+		p.Grid = f
+	}
+	if n, err := strconv.Atoi(os.Getenv("PRIVACY_RETENTION_DAYS")); err == nil && n > 0 {
+		p.Retention = time.Duration(n) * 24 * time.Hour
+	}
+	return p
+}
+
+func parseAddr(addr string) net.IP {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		addr = h
+	}
+	return net.ParseIP(addr)
+}
+
+func truncateIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+type privacySalt struct {
+	Salt []byte `datastore:"salt,noindex"`
+}
+
+// saltPeriodEnd is when a salt period ends.  Once every address the
+// period's salt hashed is past the retention window, the salt is
+// deleted, so what's left of its hashes can't be reversed by trying
+// every address.
+func saltPeriodEnd(period string) (time.Time, error) {
+	t, err := time.Parse(saltPeriodFmt, period)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 1, 0), nil
+}
+
+// saltFor returns the salt for the period containing t, making one
+// up if this is the first time anyone's asked.  There's none for a
+// period that's past the retention window.
+func saltFor(c context.Context, t time.Time) ([]byte, error) {
+	period := t.UTC().Format(saltPeriodFmt)
+	if p := currentPrivacy(); p.Retention > 0 {
+		if end, _ := saltPeriodEnd(period); end.Before(time.Now().Add(-p.Retention)) {
+			return nil, fmt.Errorf("the salt for %v has expired", period)
+		}
+	}
+	ck := "privacySalt." + period
+	if it, err := memcache.Get(c, ck); err == nil {
+		return it.Value, nil
+	}
+
+	k := datastore.NewKey(c, privacySaltKind, period, 0, nil)
+	s := &privacySalt{}
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		err := datastore.Get(tc, k, s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Salt = make([]byte, 32)
+		if _, err := rand.Read(s.Salt); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, k, s)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	memcache.Set(c, &memcache.Item{Key: ck, Value: s.Salt, Expiration: time.Hour})
+	return s.Salt, nil
+}
+
+// expireSalts deletes the salts of periods that ended before cutoff.
+func expireSalts(c context.Context, cutoff time.Time) (int, error) {
+	keys, err := datastore.NewQuery(privacySaltKind).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+	var expired []*datastore.Key
+	var cks []string
+	for _, k := range keys {
+		if end, err := saltPeriodEnd(k.StringID()); err == nil && end.Before(cutoff) {
+			expired = append(expired, k)
+			cks = append(cks, "privacySalt."+k.StringID())
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := datastore.DeleteMulti(c, expired); err != nil {
+		return 0, err
+	}
+	if err := memcache.DeleteMulti(c, cks); err != nil {
+		log.Infof(c, "Error uncaching expired salts: %v", err)
+	}
+	return len(expired), nil
+}
+
+// addr applies the policy to an address as it arrives.  Anything
+// that doesn't look like an IP is assumed to have been dealt with
+// already and is passed through.
+func (p privacyPolicy) addr(c context.Context, addr string, t time.Time) string {
+	ip := parseAddr(addr)
+	if ip == nil {
+		return addr
+	}
+	switch p.IPMode {
+	case "truncate":
+		return truncateIP(ip)
+	case "hash":
+		salt, err := saltFor(c, t)
+		if err != nil {
+			log.Errorf(c, "Error getting privacy salt, dropping address: %v", err)
+			return ""
+		}
+		h := hmac.New(sha256.New, salt)
+		h.Write(ip)
+		return "h:" + hex.EncodeToString(h.Sum(nil))[:16]
+	case "drop":
+		return ""
+	}
+	return addr
+}
+
+// ingestAddr applies the policy to an address as it arrives, given
+// where it was placed.  A hash can't be located afterwards, so in hash
+// mode an address nothing could place is kept truncated instead, which
+// the geolocate backfill and usage replays can still look up.  The
+// backfill drops it once it's placed (see placedAddr); otherwise it
+// goes when the retention window scrubs it.
+func (p privacyPolicy) ingestAddr(c context.Context, addr string, t time.Time, loc geoLocation) string {
+	if ip := parseAddr(addr); ip != nil && p.IPMode == "hash" && loc.Source == "" {
+		return truncateIP(ip)
+	}
+	return p.addr(c, addr, t)
+}
+
+// placedAddr applies the policy to an address the geolocate backfill
+// has just placed.  In hash mode, an address ingestAddr kept truncated
+// has done its job and is dropped, since a hash of it would pass for
+// one client's.
+func (p privacyPolicy) placedAddr(c context.Context, addr string, t time.Time) string {
+	if p.IPMode == "hash" && parseAddr(addr) != nil && !exactAddr(addr) {
+		return ""
+	}
+	return p.addr(c, addr, t)
+}
+
+// exactAddr reports whether a stored address still tells one client
+// from another: a full address or a hash of one, but not a truncated
+// one.  An address that happens to end in zeros looks truncated too.
+func exactAddr(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	ip := parseAddr(addr)
+	if ip == nil {
+		return strings.HasPrefix(addr, "h:")
+	}
+	return truncateIP(ip) != ip.String()
+}
+
+// exportAddr applies the policy to an address on the way out.  It
+// can't hash without knowing which salt applied, so raw addresses
+// that should have been hashed are dropped instead.
+func (p privacyPolicy) exportAddr(addr string) string {
+	ip := parseAddr(addr)
+	if ip == nil {
+		return addr
+	}
+	switch p.IPMode {
+	case "truncate":
+		return truncateIP(ip)
+	case "hash", "drop":
+		return ""
+	}
+	return addr
+}
+
+func (p privacyPolicy) coords(lat, lon float64) (float64, float64) {
+	// 0,0 is how we spell "unknown", so leave it recognizable.
+	if p.Grid <= 0 || (lat == 0 && lon == 0) {
+		return lat, lon
+	}
+	snap := func(f float64) float64 {
+		return math.Floor(f/p.Grid)*p.Grid + p.Grid/2
+	}
+	return snap(lat), snap(lon)
+}
+
+// handleScrubAddrs starts a scrubAddrs job over each kind, mapping
+// only over what's older than the retention window.  Cron's jobs run
+// for real, and first delete the salts of periods past the window;
+// anyone else gets a preview.
+func handleScrubAddrs(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	p := currentPrivacy()
+	if p.Retention == 0 {
+		log.Infof(c, "No retention window configured, nothing to scrub")
+		w.WriteHeader(204)
+		return
+	}
+	start := startPreview
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		start = startBatchJob
+		n, err := expireSalts(c, time.Now().Add(-p.Retention))
+		if err != nil {
+			log.Errorf(c, "Error expiring privacy salts: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Infof(c, "Expired %v privacy salts", n)
+	}
+
+	cutoff := time.Now().Add(-p.Retention).UTC().Format(time.RFC3339)
+	jobs := map[string]string{}
+	for _, kind := range addrKinds {
+		k, err := start(c, mapSpec{
+			Kind:    kind,
+			Mapper:  "scrubAddrs",
+			Filters: []string{"timestamp < " + cutoff},
+		})
+		if err != nil {
+			log.Errorf(c, "Error starting scrub of %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jobs[kind] = k.Encode()
+	}
+
+	log.Infof(c, "Started address scrubs: %v", jobs)
+	mustEncode(c, w, r, jobs)
+}
+
+// scrubAddr clears the addr of an entity older than cutoff, saying
+// whether there was one to clear.
+func scrubAddr(ps datastore.PropertyList, cutoff time.Time) bool {
+	var ts time.Time
+	addr := -1
+	for j, prop := range ps {
+		switch prop.Name {
+		case "timestamp":
+			ts, _ = prop.Value.(time.Time)
+		case "addr":
+			if s, _ := prop.Value.(string); s != "" {
+				addr = j
+			}
+		}
+	}
+	if addr < 0 || ts.IsZero() || ts.After(cutoff) {
+		return false
+	}
+	ps[addr].Value = ""
+	return true
+}
+
+// mapScrubAddrs clears the addr of anything older than the retention
+// window.  Controllers are updated as they report, so each is
+// scrubbed in its own transaction rather than overwritten.
+func mapScrubAddrs(c context.Context, params url.Values, keys []*datastore.Key) error {
+	p := currentPrivacy()
+	if p.Retention == 0 {
+		log.Infof(c, "No retention window configured, nothing to scrub")
+		return nil
+	}
+	cutoff := time.Now().Add(-p.Retention)
+
+	if keys[0].Kind() == "FoundController" {
+		var scrubbed []*datastore.Key
+		for _, k := range keys {
+			did := false
+			err := datastore.RunInTransaction(c, func(tc context.Context) error {
+				var ps datastore.PropertyList
+				if err := datastore.Get(tc, k, &ps); err != nil {
+					return err
+				}
+				did = scrubAddr(ps, cutoff)
+				if !did || isDryRun(tc) {
+					return nil
+				}
+				_, err := datastore.Put(tc, k, &ps)
+				return err
+			}, nil)
+			if err != nil {
+				log.Errorf(c, "Error scrubbing addr of %v: %v", k, err)
+				return err
+			}
+			if did {
+				scrubbed = append(scrubbed, k)
+			}
+		}
+		changed(c, scrubbed...)
+		log.Infof(c, "Scrubbed addrs from %v of %v controllers", len(scrubbed), len(keys))
+		return nil
+	}
+
+	ents := make([]datastore.PropertyList, len(keys))
+	if err := datastore.GetMulti(c, keys, ents); err != nil {
+		log.Errorf(c, "Error fetching entities: %v", err)
+		return err
+	}
+
+	var upkeys []*datastore.Key
+	var upents []datastore.PropertyList
+	for i, ps := range ents {
+		if scrubAddr(ps, cutoff) {
+			upkeys = append(upkeys, keys[i])
+			upents = append(upents, ps)
+		}
+	}
+
+	changed(c, upkeys...)
+	if len(upkeys) > 0 && !isDryRun(c) {
+		log.Infof(c, "Scrubbing addrs from %v %v entities", len(upkeys), upkeys[0].Kind())
+		if _, err := datastore.PutMulti(c, upkeys, upents); err != nil {
+			log.Errorf(c, "Error scrubbing addrs: %v", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,650 @@
+package autotown
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	// Sections are refreshed by cron well before they expire.
+	profileCacheAge = 12 * time.Hour
+
+	// Controllers seen this recently count as active.
+	profileActiveDays = 30
+
+	// How many of the most recent tunes and crashes are looked
+	// through when they can't be queried for directly, and how many
+	// are listed.
+	profileScanLimit = 1000
+	profileRecent    = 20
+
+	// How far back versions have to have been counted to be kept
+	// warm.
+	profileWarmDays = 90
+)
+
+// A profile is everything known about a board or a version, in
+// sections computed and cached separately.
+type profileSection func(c context.Context, p *profileQuery) (interface{}, error)
+
+type profileQuery struct {
+	Name   string
+	boards *boardCatalog
+	gitl   []githubRef
+}
+
+var profileSections = map[string]map[string]profileSection{
+	"board": {
+		"board":       boardInfoSection,
+		"controllers": boardControllersSection,
+		"daily":       boardDailySection,
+		"tunes":       boardTunesSection,
+		"crashes":     boardCrashesSection,
+	},
+	"version": {
+		"version":     versionRefsSection,
+		"controllers": versionControllersSection,
+		"daily":       versionDailySection,
+		"tunes":       versionTunesSection,
+		"crashes":     versionCrashesSection,
+	},
+}
+
+func init() {
+	http.Handle("/api/board/", corsHandleFunc(profileHandler("board")))
+	http.Handle("/api/version/", corsHandleFunc(profileHandler("version")))
+
+	http.HandleFunc("/admin/profiles/warm", handleWarmProfiles)
+	http.HandleFunc("/batch/profile", deadLetters(handleBuildProfile))
+}
+
+type controllerStats struct {
+	Total     int            `json:"total"`
+	Active    int            `json:"active"`
+	Boards    map[string]int `json:"boards,omitempty"`
+	Revisions map[string]int `json:"revisions,omitempty"`
+	Versions  map[string]int `json:"versions,omitempty"`
+	Countries map[string]int `json:"countries"`
+	OS        map[string]int `json:"os"`
+
+	// Whether there were more controllers than were looked at.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func newControllerStats() *controllerStats {
+	return &controllerStats{Countries: map[string]int{}, OS: map[string]int{}}
+}
+
+func (s *controllerStats) add(fc *FoundController) {
+	s.Total++
+	if time.Since(fc.Timestamp) < profileActiveDays*24*time.Hour {
+		s.Active++
+	}
+	s.Countries[fc.Country]++
+	s.OS[abbrevOS(fc.GCSOS)]++
+}
+
+type profileDay struct {
+	Day string `json:"day"`
+	New int64  `json:"new"`
+	// Dimension -> series -> controllers first seen that day.
+	By map[string]map[string]int64 `json:"by,omitempty"`
+}
+
+// dailySeries picks a profile's daily counts out of all of them.  For
+// each count name, pick returns the dimension and series it adds to,
+// if any.  A dimension of "" adds to New.
+func dailySeries(c context.Context, pick func(parts []string) (string, string, bool)) ([]profileDay, error) {
+	cfg, err := loadCountsConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := loadDailyCounts(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []profileDay{}
+	for _, d := range genDates(oldestBoard, time.Now().AddDate(0, 0, -1)) {
+		ds := d.Format(dayFmt)
+		day := profileDay{Day: ds, By: map[string]map[string]int64{}}
+		for k, v := range counts[ds] {
+			dim, series, ok := pick(strings.Split(k, "|"))
+			if !ok {
+				continue
+			}
+			if dim == "" {
+				day.New += v
+				continue
+			}
+			m, ok := day.By[dim]
+			if !ok {
+				m = map[string]int64{}
+				day.By[dim] = m
+			}
+			m[series] += v
+		}
+		if day.New > 0 || len(day.By) > 0 {
+			rv = append(rv, day)
+		}
+	}
+	return rv, nil
+}
+
+type profileTune struct {
+	Key       *datastore.Key `json:"key"`
+	Timestamp time.Time      `json:"timestamp"`
+	Board     string         `json:"board"`
+	Tau       float64        `json:"tau"`
+	Country   string         `json:"country"`
+}
+
+type tuneStats struct {
+	Count     int           `json:"count"`
+	TauMin    float64       `json:"tau_min"`
+	TauMax    float64       `json:"tau_max"`
+	TauMedian float64       `json:"tau_median"`
+	Recent    []profileTune `json:"recent"`
+}
+
+// newTuneStats summarizes tunes, most recent first.
+func newTuneStats(tunes []profileTune) *tuneStats {
+	rv := &tuneStats{Count: len(tunes), Recent: []profileTune{}}
+	if len(tunes) == 0 {
+		return rv
+	}
+	var taus []float64
+	for _, t := range tunes {
+		taus = append(taus, t.Tau)
+	}
+	sort.Float64s(taus)
+	rv.TauMin, rv.TauMax = taus[0], taus[len(taus)-1]
+	rv.TauMedian = taus[len(taus)/2]
+	if len(tunes) > profileRecent {
+		tunes = tunes[:profileRecent]
+	}
+	rv.Recent = tunes
+	return rv
+}
+
+type crashStats struct {
+	Total    int            `json:"total"`
+	Versions map[string]int `json:"versions,omitempty"`
+	Boards   map[string]int `json:"boards,omitempty"`
+	OS       map[string]int `json:"os"`
+	Recent   []CrashData    `json:"recent"`
+}
+
+func newCrashStats() *crashStats {
+	return &crashStats{OS: map[string]int{}, Recent: []CrashData{}}
+}
+
+// add counts a crash, listing it if it's among the most recent.
+// Crashes have to be added most recent first.
+func (s *crashStats) add(x *CrashData, privacy privacyPolicy) {
+	str := func(k string) string { v, _ := x.properties[k].(string); return v }
+	s.Total++
+	s.OS[str("os_abbrev")]++
+	if s.Versions != nil {
+		v := str("gitTag")
+		if v == "" {
+			v = str("gitCommit")
+		}
+		s.Versions[v]++
+	}
+	if s.Boards != nil {
+		for _, b := range crashStrings(x, "boards") {
+			s.Boards[b]++
+		}
+	}
+	if len(s.Recent) < profileRecent {
+		x.redact(privacy)
+		s.Recent = append(s.Recent, *x)
+	}
+}
+
+// boardNames lists the names a board has been reported under.
+func boardNames(boards *boardCatalog, name string) []string {
+	rv := []string{name}
+	if b := boards.info(name); b != nil {
+		rv = append(rv, b.Aliases...)
+	}
+	return rv
+}
+
+func boardInfoSection(c context.Context, p *profileQuery) (interface{}, error) {
+	if b := p.boards.info(p.Name); b != nil {
+		return b, nil
+	}
+	return &boardInfo{Name: p.Name}, nil
+}
+
+func boardControllersSection(c context.Context, p *profileQuery) (interface{}, error) {
+	rv := newControllerStats()
+	rv.Revisions, rv.Versions = map[string]int{}, map[string]int{}
+	for _, n := range boardNames(p.boards, p.Name) {
+		q := datastore.NewQuery("FoundController").Filter("name =", n).
+			Order("-timestamp").Limit(profileScanLimit)
+		scanned := 0
+		for t := q.Run(c); ; {
+			var x FoundController
+			_, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			scanned++
+			rv.add(&x)
+			rv.Revisions[p.boards.revName(p.Name, x.HardwareRev)]++
+			rv.Versions[refLabel(x.GitHash, p.gitl)]++
+		}
+		rv.Truncated = rv.Truncated || scanned == profileScanLimit
+	}
+	return rv, nil
+}
+
+func boardDailySection(c context.Context, p *profileQuery) (interface{}, error) {
+	dims := map[string]string{"rev": "revisions", "country": "countries", "ref": "versions"}
+	return dailySeries(c, func(parts []string) (string, string, bool) {
+		switch {
+		case len(parts) == 1 && parts[0] == p.Name:
+			return "", "", true
+		case len(parts) == 3 && parts[1] == p.Name && dims[parts[0]] != "":
+			series := parts[2]
+			if parts[0] == "rev" {
+				if rev, err := strconv.Atoi(series); err == nil {
+					series = p.boards.revName(p.Name, rev)
+				}
+			}
+			return dims[parts[0]], series, true
+		}
+		return "", "", false
+	})
+}
+
+func boardTunesSection(c context.Context, p *profileQuery) (interface{}, error) {
+	var tunes []profileTune
+	for _, n := range boardNames(p.boards, p.Name) {
+		q := datastore.NewQuery("TuneResults").Filter("board =", n).
+			Order("-timestamp").Limit(profileScanLimit)
+		for t := q.Run(c); ; {
+			var x TuneResults
+			k, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			tunes = append(tunes, profileTune{k, x.Timestamp, p.Name, x.Tau, x.Country})
+		}
+	}
+	sort.Slice(tunes, func(i, j int) bool { return tunes[i].Timestamp.After(tunes[j].Timestamp) })
+	return newTuneStats(tunes), nil
+}
+
+func boardCrashesSection(c context.Context, p *profileQuery) (interface{}, error) {
+	rv := newCrashStats()
+	rv.Versions = map[string]int{}
+	privacy := currentPrivacy()
+	q := datastore.NewQuery("CrashData").Filter("boards =", p.Name).
+		Order("-timestamp").Limit(profileScanLimit)
+	for t := q.Run(c); ; {
+		var x CrashData
+		k, err := t.Next(&x)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		x.Key = k
+		rv.add(&x, privacy)
+	}
+	return rv, nil
+}
+
+// versionLabels returns the git labels a version names, either by
+// label or by a prefix of their commit.
+func versionLabels(ref string, gitl []githubRef) []githubRef {
+	var rv []githubRef
+	for _, l := range gitl {
+		if l.Label == ref || (commitRE.MatchString(ref) && strings.HasPrefix(l.Hash, ref)) {
+			rv = append(rv, l)
+		}
+	}
+	return rv
+}
+
+func versionRefsSection(c context.Context, p *profileQuery) (interface{}, error) {
+	rv := struct {
+		Ref    string      `json:"ref"`
+		Hash   string      `json:"hash,omitempty"`
+		Labels []githubRef `json:"labels"`
+	}{Ref: p.Name, Labels: versionLabels(p.Name, p.gitl)}
+	if len(rv.Labels) > 0 {
+		rv.Hash = rv.Labels[0].Hash
+		// Everything else at the same commit.
+		rv.Labels = gitDescribe(rv.Hash, p.gitl)
+	} else if commitRE.MatchString(p.Name) {
+		rv.Hash = p.Name
+	}
+	if rv.Labels == nil {
+		rv.Labels = []githubRef{}
+	}
+	return rv, nil
+}
+
+// versionControllersSection counts the controllers running firmware
+// of the version.  Controllers may report a shorter hash than the
+// label's, so each label's commit is looked up as the range of its
+// prefixes: anything sorting between a prefix of a hash and the hash
+// starts with that prefix.
+func versionControllersSection(c context.Context, p *profileQuery) (interface{}, error) {
+	var qs []*datastore.Query
+	base := datastore.NewQuery("FoundController")
+	seenHash := map[string]bool{}
+	for _, l := range versionLabels(p.Name, p.gitl) {
+		if len(l.Hash) < 7 || seenHash[l.Hash] {
+			continue
+		}
+		seenHash[l.Hash] = true
+		qs = append(qs, base.Filter("git_hash >=", l.Hash[:7]).Filter("git_hash <=", l.Hash))
+	}
+	if commitRE.MatchString(p.Name) {
+		// 'g' sorts after every hex digit.
+		qs = append(qs, base.Filter("git_hash >=", p.Name).Filter("git_hash <", p.Name+"g"))
+	} else {
+		qs = append(qs, base.Filter("git_tag =", p.Name))
+	}
+
+	rv := newControllerStats()
+	rv.Boards = map[string]int{}
+	seen := map[string]bool{}
+	for _, q := range qs {
+		scanned := 0
+		for t := q.Limit(profileScanLimit).Run(c); ; {
+			var x FoundController
+			k, err := t.Next(&x)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			scanned++
+			if seen[k.Encode()] || !matchesVersion(p.Name, x.GitHash, x.GitTag, p.gitl) {
+				continue
+			}
+			seen[k.Encode()] = true
+			rv.add(&x)
+			rv.Boards[p.boards.canonical(x.Name)]++
+		}
+		rv.Truncated = rv.Truncated || scanned == profileScanLimit
+	}
+	return rv, nil
+}
+
+func versionDailySection(c context.Context, p *profileQuery) (interface{}, error) {
+	// Counts are by the first label at a commit.
+	label := p.Name
+	if ls := versionLabels(p.Name, p.gitl); len(ls) > 0 {
+		label = refLabel(ls[0].Hash, p.gitl)
+	}
+	return dailySeries(c, func(parts []string) (string, string, bool) {
+		if len(parts) == 3 && parts[0] == "ref" && parts[2] == label {
+			return "boards", parts[1], true
+		}
+		return "", "", false
+	})
+}
+
+func versionTunesSection(c context.Context, p *profileQuery) (interface{}, error) {
+	var tunes []profileTune
+	q := datastore.NewQuery("TuneResults").Order("-timestamp").Limit(profileScanLimit)
+	for t := q.Run(c); ; {
+		var x TuneResults
+		k, err := t.Next(&x)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := x.uncompress(); err != nil {
+			log.Infof(c, "Error decompressing: %v", err)
+			continue
+		}
+		if hash, tag := x.firmware(); !matchesVersion(p.Name, hash, tag, p.gitl) {
+			continue
+		}
+		tunes = append(tunes, profileTune{k, x.Timestamp, p.boards.canonical(x.Board), x.Tau, x.Country})
+	}
+	return newTuneStats(tunes), nil
+}
+
+// versionCrashesSection lists crashes of the GCS built from the
+// version.
+func versionCrashesSection(c context.Context, p *profileQuery) (interface{}, error) {
+	rv := newCrashStats()
+	rv.Boards = map[string]int{}
+	privacy := currentPrivacy()
+	q := datastore.NewQuery("CrashData").Order("-timestamp").Limit(profileScanLimit)
+	for t := q.Run(c); ; {
+		var x CrashData
+		k, err := t.Next(&x)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		s := func(k string) string { v, _ := x.properties[k].(string); return v }
+		if !matchesVersion(p.Name, s("gitCommit"), s("gitTag"), p.gitl) {
+			continue
+		}
+		x.Key = k
+		rv.add(&x, privacy)
+	}
+	return rv, nil
+}
+
+func profileCacheKey(kind, name, section string) string {
+	return "profile." + kind + "." + section + "." + url.QueryEscape(name)
+}
+
+// buildProfile returns the named sections of a profile (all of them
+// if none are named), computing any that aren't cached, or all of them
+// if fresh is set.
+func buildProfile(c context.Context, kind, name string, sections []string, fresh bool) (map[string]interface{}, error) {
+	all := profileSections[kind]
+	if len(sections) == 0 {
+		for s := range all {
+			sections = append(sections, s)
+		}
+	}
+
+	p := &profileQuery{Name: name}
+	g, _ := errgroup.WithContext(c)
+	g.Go(func() error {
+		var err error
+		p.boards, err = loadBoards(c)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		if p.gitl, err = gitLabels(c); err != nil {
+			log.Warningf(c, "Couldn't resolve git labels: %v", err)
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if kind == "board" {
+		p.Name = p.boards.canonical(name)
+	}
+
+	var mu sync.Mutex
+	rv := map[string]interface{}{"name": p.Name}
+	g, _ = errgroup.WithContext(c)
+	for _, s := range sections {
+		s := s
+		f := all[s]
+		g.Go(func() error {
+			cacheKey := profileCacheKey(kind, p.Name, s)
+			var ob interface{}
+			var cached json.RawMessage
+			if !fresh && gzCacheGet(c, cacheKey, &cached) == nil && cached != nil {
+				ob = cached
+			} else {
+				var err error
+				if ob, err = f(c, p); err != nil {
+					log.Errorf(c, "Error computing %v section of %v profile %q: %v", s, kind, p.Name, err)
+					return err
+				}
+				gzCacheSet(c, cacheKey, profileCacheAge, ob)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rv[s] = ob
+			return nil
+		})
+	}
+	return rv, g.Wait()
+}
+
+// knownVersion reports whether some tag or branch is, or is at, the
+// named version.  Only those are served, so callers can't have us
+// build a profile of whatever they like.
+func knownVersion(c context.Context, name string) (bool, error) {
+	gitl, err := gitLabels(c)
+	if err != nil {
+		return false, err
+	}
+	return len(versionLabels(name, gitl)) > 0, nil
+}
+
+// Returns the profile of the board or version named by the rest of
+// the path.
+//
+// Params:
+// - sections: comma separated sections to return (default all)
+func profileHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+
+		name := strings.TrimPrefix(r.URL.Path, "/api/"+kind+"/")
+		if name == "" {
+			http.Error(w, "no "+kind+" given", 400)
+			return
+		}
+
+		var sections []string
+		if s := r.FormValue("sections"); s != "" {
+			for _, sec := range strings.Split(s, ",") {
+				if _, ok := profileSections[kind][sec]; !ok {
+					http.Error(w, "invalid section: "+sec, 400)
+					return
+				}
+				sections = append(sections, sec)
+			}
+		}
+
+		if kind == "version" {
+			ok, err := knownVersion(c, name)
+			if err != nil {
+				log.Errorf(c, "Error loading git labels: %v", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !ok {
+				http.Error(w, "unknown version: "+name, 404)
+				return
+			}
+		}
+
+		rv, err := buildProfile(c, kind, name, sections, false)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		mustEncode(c, w, r, rv)
+	}
+}
+
+// handleWarmProfiles queues recomputing the profile of every board
+// that's been counted, and of every version counted recently.
+func handleWarmProfiles(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	cfg, err := loadCountsConfig(c)
+	if err != nil {
+		log.Errorf(c, "Error loading counts config: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	counts, err := loadDailyCounts(c, cfg)
+	if err != nil {
+		log.Errorf(c, "Error loading daily counts: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -profileWarmDays).Format(dayFmt)
+	boards, versions := map[string]bool{}, map[string]bool{}
+	for day, m := range counts {
+		for k := range m {
+			parts := strings.Split(k, "|")
+			switch {
+			case len(parts) == 1:
+				boards[k] = true
+			case len(parts) == 3 && parts[0] == "ref" && parts[2] != "Unknown" && day >= since:
+				versions[parts[2]] = true
+			}
+		}
+	}
+
+	var tasks []*taskqueue.Task
+	for kind, names := range map[string]map[string]bool{"board": boards, "version": versions} {
+		for n := range names {
+			tasks = append(tasks, taskqueue.NewPOSTTask("/batch/profile", url.Values{
+				"kind": []string{kind},
+				"name": []string{n},
+			}))
+		}
+	}
+	if err := queueMany(c, mapStage2, tasks); err != nil {
+		log.Errorf(c, "Error queueing profiles: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof(c, "Warming %v board and %v version profiles", len(boards), len(versions))
+	mustEncode(c, w, r, map[string]int{"boards": len(boards), "versions": len(versions)})
+}
+
+func handleBuildProfile(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	kind, name := r.FormValue("kind"), r.FormValue("name")
+	if _, ok := profileSections[kind]; !ok || name == "" {
+		http.Error(w, "invalid profile", 400)
+		return
+	}
+	if _, err := buildProfile(c, kind, name, nil, true); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
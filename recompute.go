@@ -0,0 +1,440 @@
+package autotown
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	countsConfigKind = "CountsConfig"
+	recomputeJobKind = "RecomputeJob"
+
+	recomputePoll         = 30 * time.Second
+	recomputeStageTimeout = 12 * time.Hour
+)
+
+func init() {
+	http.HandleFunc("/admin/recompute/start", handleRecomputeStart)
+	http.HandleFunc("/admin/recompute/abort", handleRecomputeAbort)
+	http.HandleFunc("/batch/recompute", handleRecomputeStep)
+}
+
+// countsConfig records which DailyCountShard kind /api/boardCounts
+// serves and which one a recompute is building.  Regular counting
+// carries on into the live kind meanwhile; controllers record which
+// kinds they've been counted into, so neither counts one twice.
+type countsConfig struct {
+	Live     string `datastore:"live,noindex"`
+	Building string `datastore:"building,noindex"`
+	Job      string `datastore:"job,noindex"`
+}
+
+func countsConfigKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, countsConfigKind, "daily", 0, nil)
+}
+
+func loadCountsConfig(c context.Context) (*countsConfig, error) {
+	cfg := &countsConfig{}
+	err := datastore.Get(c, countsConfigKey(c), cfg)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	if cfg.Live == "" {
+		cfg.Live = dailyCountShardKind
+	}
+	return cfg, err
+}
+
+// isCountShardKind is true for the live daily count kind and every
+// shadow copy a recompute might have built.
+func isCountShardKind(kind string) bool {
+	return kind == dailyCountShardKind || strings.HasPrefix(kind, dailyCountShardKind+"_")
+}
+
+type recomputeStage struct {
+	Name string `datastore:"name,noindex"`
+	// Map stages run Mapper over every Kind.
+	Kind   string `datastore:"kind,noindex"`
+	Mapper string `datastore:"mapper,noindex"`
+	Params string `datastore:"params,noindex"`
+	Job    string `datastore:"job,noindex"`
+
+	Started  time.Time `datastore:"started,noindex"`
+	Finished time.Time `datastore:"finished,noindex"`
+
+	// Keys the map enumerated, and whatever the stage produced.
+	Keys   int `datastore:"keys,noindex"`
+	Result int `datastore:"result,noindex"`
+}
+
+func (s recomputeStage) Duration() time.Duration {
+	if s.Started.IsZero() {
+		return 0
+	}
+	if s.Finished.IsZero() {
+		return time.Since(s.Started)
+	}
+	return s.Finished.Sub(s.Started)
+}
+
+// recomputeJob rebuilds the daily counts from scratch: count
+// everything into a shadow kind, switch /api/boardCounts over to it
+// and throw away the old counts.  If it fails or is aborted, the
+// shadow is thrown away instead.
+type recomputeJob struct {
+	Shadow  string    `datastore:"shadow,noindex"`
+	State   string    `datastore:"state"`
+	Error   string    `datastore:"error,noindex"`
+	Started time.Time `datastore:"started"`
+	Updated time.Time `datastore:"updated,noindex"`
+
+	Stage     int  `datastore:"stage,noindex"`
+	Submitted bool `datastore:"submitted,noindex"`
+	// Chunks of the current stage's batch job still to finish.
+	Pending int              `datastore:"pending,noindex"`
+	Stages  []recomputeStage `datastore:"stages"`
+
+	Key *datastore.Key `datastore:"-"`
+}
+
+func (j *recomputeJob) Current() *recomputeStage {
+	if j.Stage >= len(j.Stages) {
+		return nil
+	}
+	return &j.Stages[j.Stage]
+}
+
+func newRecomputeJob(cfg *countsConfig, now time.Time) *recomputeJob {
+	shadow := dailyCountShardKind + "_" + now.UTC().Format("20060102150405")
+	j := &recomputeJob{
+		Shadow:  shadow,
+		State:   "running",
+		Started: now,
+		Updated: now,
+		Stages: []recomputeStage{
+			{Name: "count", Kind: "FoundController", Mapper: "countUsage", Params: "into=" + url.QueryEscape(shadow)},
+			{Name: "switch"},
+			{Name: "cleanup", Kind: cfg.Live, Mapper: "destroy"},
+		},
+	}
+	if cfg.Live == dailyCountShardKind {
+		j.Stages = append(j.Stages, recomputeStage{Name: "cleanup legacy", Kind: "DailyCounts", Mapper: "destroy"})
+	}
+	// Whatever an earlier failed recompute left behind.
+	if cfg.Building != "" {
+		j.Stages = append(j.Stages, recomputeStage{Name: "cleanup abandoned", Kind: cfg.Building, Mapper: "destroy"})
+	}
+	return j
+}
+
+func queueRecomputeStep(c context.Context, k *datastore.Key, delay time.Duration) error {
+	t := taskqueue.NewPOSTTask("/batch/recompute", url.Values{"job": []string{k.Encode()}})
+	t.Delay = delay
+	_, err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// stageJob returns the batch job a stage submitted, with its counts.
+func stageJob(c context.Context, st *recomputeStage) (*batchJob, error) {
+	k, err := datastore.DecodeKey(st.Job)
+	if err != nil {
+		return nil, err
+	}
+	j, err := getBatchJob(c, k)
+	if err != nil {
+		return nil, err
+	}
+	return j, j.loadCounts(c)
+}
+
+func sumBoardCounts(counts map[string]map[string]int64) int {
+	n := 0
+	for _, day := range counts {
+		for k, v := range day {
+			if !strings.Contains(k, "|") {
+				n += int(v)
+			}
+		}
+	}
+	return n
+}
+
+// advance does as much of the current stage as it can.  It runs in a
+// transaction on the job, so anything it queues only happens if the
+// job update sticks.
+func (j *recomputeJob) advance(c, tc context.Context) error {
+	st := j.Current()
+	if st == nil {
+		j.State = "done"
+		return nil
+	}
+	if st.Started.IsZero() {
+		st.Started = time.Now()
+	}
+
+	if st.Name == "switch" {
+		counts, err := readAllCounters(c, j.Shadow)
+		if err != nil {
+			return err
+		}
+		st.Keys = len(counts)
+		st.Result = sumBoardCounts(counts)
+
+		cfg, err := loadCountsConfig(tc)
+		if err != nil {
+			return err
+		}
+		if cfg.Building != j.Shadow {
+			return fmt.Errorf("counts config is building %q, not %q", cfg.Building, j.Shadow)
+		}
+		cfg.Live, cfg.Building = j.Shadow, ""
+		if _, err := datastore.Put(tc, countsConfigKey(tc), cfg); err != nil {
+			return err
+		}
+		log.Infof(c, "Switched daily counts to %v (%v controllers over %v days)",
+			j.Shadow, st.Result, st.Keys)
+		j.nextStage()
+		return nil
+	}
+
+	if !j.Submitted {
+		n, err := datastore.NewQuery(st.Kind).KeysOnly().Count(c)
+		if err != nil {
+			return err
+		}
+		st.Keys = n
+		jk, err := startBatchJob(tc, mapSpec{Kind: st.Kind, Mapper: st.Mapper, Params: st.Params})
+		if err != nil {
+			return err
+		}
+		st.Job = jk.Encode()
+		log.Infof(c, "Recompute stage %q submitted over %v %v", st.Name, n, st.Kind)
+		j.Submitted = true
+		return nil
+	}
+
+	bj, err := stageJob(c, st)
+	if err != nil {
+		return err
+	}
+	j.Pending = bj.Tasks - int(bj.Completed)
+	switch {
+	case bj.Dead > 0:
+		return fmt.Errorf("stage %q has %v dead lettered chunks", st.Name, bj.Dead)
+	case bj.State == "cancelled":
+		return fmt.Errorf("stage %q's job was cancelled", st.Name)
+	case bj.State == "failed":
+		return fmt.Errorf("stage %q's job failed with %v chunks discarded", st.Name, bj.Discarded)
+	case bj.State != "done":
+		if time.Since(st.Started) > recomputeStageTimeout {
+			return fmt.Errorf("stage %q still has %v chunks pending after %v",
+				st.Name, j.Pending, recomputeStageTimeout)
+		}
+		return nil
+	}
+
+	if st.Name == "count" {
+		counts, err := readAllCounters(c, j.Shadow)
+		if err != nil {
+			return err
+		}
+		st.Result = sumBoardCounts(counts)
+	}
+	log.Infof(c, "Recompute stage %q finished in %v", st.Name, time.Since(st.Started))
+	j.nextStage()
+	return nil
+}
+
+// abandon stops the current stage and, unless the switch already
+// happened, stops building the shadow and destroys it.
+func (j *recomputeJob) abandon(c context.Context) error {
+	if err := j.cancelStage(c); err != nil {
+		return err
+	}
+	cfg, err := loadCountsConfig(c)
+	if err != nil {
+		return err
+	}
+	if cfg.Building != j.Shadow {
+		return nil
+	}
+	cfg.Building = ""
+	if _, err := datastore.Put(c, countsConfigKey(c), cfg); err != nil {
+		return err
+	}
+	_, err = startBatchJob(c, mapSpec{Kind: j.Shadow, Mapper: "destroy"})
+	return err
+}
+
+// cancelStage stops whatever batch job the current stage is waiting
+// on, if it's still running.
+func (j *recomputeJob) cancelStage(c context.Context) error {
+	st := j.Current()
+	if st == nil || st.Job == "" {
+		return nil
+	}
+	k, err := datastore.DecodeKey(st.Job)
+	if err != nil {
+		return err
+	}
+	bj, err := getBatchJob(c, k)
+	if err != nil || bj.State != "running" {
+		return err
+	}
+	return cancelBatchJob(c, k)
+}
+
+func (j *recomputeJob) nextStage() {
+	j.Stages[j.Stage].Finished = time.Now()
+	j.Stage++
+	j.Submitted, j.Pending = false, 0
+	if j.Stage >= len(j.Stages) {
+		j.State = "done"
+	}
+}
+
+func handleRecomputeStep(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	k, err := datastore.DecodeKey(r.FormValue("job"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		j := &recomputeJob{}
+		if err := datastore.Get(tc, k, j); err != nil {
+			return err
+		}
+		if j.State != "running" {
+			log.Infof(c, "Recompute %v is %v, nothing to do", k.StringID(), j.State)
+			return nil
+		}
+
+		if err := j.advance(c, tc); err != nil {
+			// The live counts are as they were, so only the
+			// shadow needs throwing away.
+			log.Errorf(c, "Recompute %v failed: %v", k.StringID(), err)
+			j.State, j.Error = "failed", err.Error()
+			if err := j.abandon(tc); err != nil {
+				return err
+			}
+		}
+		j.Updated = time.Now()
+		if _, err := datastore.Put(tc, k, j); err != nil {
+			return err
+		}
+		if j.State == "running" {
+			return queueRecomputeStep(tc, k, recomputePoll)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Errorf(c, "Error running recompute step: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func handleRecomputeStart(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var j *recomputeJob
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		cfg, err := loadCountsConfig(tc)
+		if err != nil {
+			return err
+		}
+		if cfg.Job != "" {
+			pk, err := datastore.DecodeKey(cfg.Job)
+			if err != nil {
+				return err
+			}
+			prev := &recomputeJob{}
+			if err := datastore.Get(tc, pk, prev); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if prev.State == "running" {
+				return fmt.Errorf("recompute %v is already running", pk.StringID())
+			}
+		}
+
+		now := time.Now()
+		j = newRecomputeJob(cfg, now)
+		j.Key = datastore.NewKey(tc, recomputeJobKind, j.Shadow, 0, nil)
+		cfg.Building, cfg.Job = j.Shadow, j.Key.Encode()
+		if _, err := datastore.Put(tc, j.Key, j); err != nil {
+			return err
+		}
+		if _, err := datastore.Put(tc, countsConfigKey(tc), cfg); err != nil {
+			return err
+		}
+		return queueRecomputeStep(tc, j.Key, 0)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Errorf(c, "Error starting recompute: %v", err)
+		http.Redirect(w, r, "/admin/batchForm?msg="+url.QueryEscape(err.Error()), http.StatusFound)
+		return
+	}
+
+	log.Infof(c, "Started recompute into %v", j.Shadow)
+	http.Redirect(w, r, "/admin/batchForm?msg=Recompute+started", http.StatusFound)
+}
+
+// handleRecomputeAbort stops a recompute and the batch job of its
+// current stage.  Like a failure, it throws away the shadow.
+func handleRecomputeAbort(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	k, err := datastore.DecodeKey(r.FormValue("job"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		j := &recomputeJob{}
+		if err := datastore.Get(tc, k, j); err != nil {
+			return err
+		}
+		if j.State != "running" {
+			return nil
+		}
+		j.State, j.Error, j.Updated = "aborted", "aborted by admin", time.Now()
+		if err := j.abandon(tc); err != nil {
+			return err
+		}
+		_, err := datastore.Put(tc, k, j)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Errorf(c, "Error aborting recompute: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/batchForm?msg=Recompute+aborted", http.StatusFound)
+}
+
+func latestRecompute(c context.Context) (*recomputeJob, error) {
+	var jobs []recomputeJob
+	keys, err := datastore.NewQuery(recomputeJobKind).Order("-started").Limit(1).GetAll(c, &jobs)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	jobs[0].Key = keys[0]
+	return &jobs[0], nil
+}
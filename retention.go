@@ -0,0 +1,482 @@
+package autotown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/search"
+)
+
+const (
+	archivePrefix      = "archives/"
+	retentionStateKind = "RetentionState"
+)
+
+// How each kind's records can be expired.  payload is the property
+// holding the raw report, blobs are properties naming bucket objects,
+// index is the search index with a document per record, and compact,
+// if set, boils a record's payload down to a summary.  Archived
+// records keep that summary too.
+type retentionKind struct {
+	payload string
+	blobs   []string
+	index   string
+	compact func(c context.Context, ps datastore.PropertyList) (datastore.PropertyList, error)
+	// Entities recording that a record was counted, which go when
+	// it does.
+	markers func(c context.Context, keys []*datastore.Key) []*datastore.Key
+}
+
+var retentionKinds = map[string]retentionKind{
+	"UsageStat": {payload: "data", index: "usage", compact: compactUsage, markers: usageMarkers},
+	"CrashData": {blobs: []string{"file", "trace"}, compact: compactCrash, markers: noMarkers},
+}
+
+func init() {
+	var kinds []string
+	for k := range retentionKinds {
+		kinds = append(kinds, k)
+	}
+	registerMapper(sumReducer{kindMapper{name: "retention", kinds: kinds,
+		batchSize: 20, concurrency: 5, mutates: true, f: mapRetention}})
+
+	http.HandleFunc("/admin/retention", handleRetention)
+}
+
+// A retentionPolicy says what happens to records of a kind once
+// they're older than Age.  Policies are configured through the
+// RETENTION_POLICIES env_variable in the default module's config, as
+// space separated kind:days:action, and passed along to the worker in
+// each job's params.  action is one of
+//
+//	delete   remove the record, along with any bucket objects
+//	compact  drop the raw payload or blobs and keep a summary
+//	archive  move the record to NDJSON in the bucket, leaving the
+//	         record behind with its payload replaced by a pointer
+//	         and, where the kind has one, a summary
+type retentionPolicy struct {
+	Kind   string
+	Age    time.Duration
+	Action string
+}
+
+func currentRetention(c context.Context) map[string]retentionPolicy {
+	rv := map[string]retentionPolicy{}
+	for _, s := range strings.Fields(os.Getenv("RETENTION_POLICIES")) {
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 {
+			log.Warningf(c, "Ignoring retention policy %q", s)
+			continue
+		}
+		p, err := parseRetention(parts[0], parts[1], parts[2])
+		if err != nil {
+			log.Warningf(c, "Ignoring retention policy %q: %v", s, err)
+			continue
+		}
+		rv[p.Kind] = p
+	}
+	return rv
+}
+
+func parseRetention(kind, days, action string) (retentionPolicy, error) {
+	rk, known := retentionKinds[kind]
+	n, err := strconv.Atoi(days)
+	switch {
+	case !known:
+		return retentionPolicy{}, fmt.Errorf("no retention for %v", kind)
+	case err != nil, n <= 0:
+		return retentionPolicy{}, fmt.Errorf("invalid days: %q", days)
+	case action == "compact" && rk.compact == nil,
+		action == "archive" && rk.payload == "",
+		action != "delete" && action != "compact" && action != "archive":
+		return retentionPolicy{}, fmt.Errorf("%v can't %v", kind, action)
+	}
+	return retentionPolicy{kind, time.Duration(n) * 24 * time.Hour, action}, nil
+}
+
+// params describes the policy to the retention mapper.
+func (p retentionPolicy) params() string {
+	return url.Values{
+		"days":   []string{strconv.Itoa(int(p.Age / (24 * time.Hour)))},
+		"action": []string{p.Action},
+	}.Encode()
+}
+
+func getProp(ps datastore.PropertyList, name string) interface{} {
+	for _, p := range ps {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+func dropProps(ps datastore.PropertyList, names ...string) datastore.PropertyList {
+	var rv datastore.PropertyList
+	for _, p := range ps {
+		keep := true
+		for _, n := range names {
+			if p.Name == n {
+				keep = false
+			}
+		}
+		if keep {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+func payloadSize(ps datastore.PropertyList, name string) int {
+	b, _ := getProp(ps, name).([]byte)
+	return len(b)
+}
+
+// compactUsage replaces a UsageStat's report with what the rollups
+// look at.
+func compactUsage(c context.Context, ps datastore.PropertyList) (datastore.PropertyList, error) {
+	b, _ := getProp(ps, "data").([]byte)
+	d, err := ungz(b)
+	if err != nil {
+		return nil, err
+	}
+	rec := struct {
+		CurrentArch string   `json:"currentArch,omitempty"`
+		CurrentOS   string   `json:"currentOS,omitempty"`
+		GCSVersion  string   `json:"gcs_version,omitempty"`
+		Boards      []string `json:"boards,omitempty"`
+	}{}
+	var seen struct {
+		BoardsSeen []usageSeenBoard `json:"boardsSeen"`
+	}
+	if err := json.Unmarshal(d, &rec); err != nil {
+		log.Infof(c, "Couldn't parse usage report, compacting to nothing: %v", err)
+	}
+	json.Unmarshal(d, &seen)
+	for _, b := range seen.BoardsSeen {
+		rec.Boards = append(rec.Boards, b.Name)
+	}
+	summary, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	ps = dropProps(ps, "data", "summary", "retention")
+	return append(ps,
+		datastore.Property{Name: "summary", Value: string(summary), NoIndex: true},
+		datastore.Property{Name: "retention", Value: "compacted", NoIndex: true}), nil
+}
+
+func noMarkers(c context.Context, keys []*datastore.Key) []*datastore.Key { return nil }
+
+func usageMarkers(c context.Context, keys []*datastore.Key) []*datastore.Key {
+	var rv []*datastore.Key
+	for _, k := range keys {
+		rv = append(rv, debugLogMarkerKey(c, k))
+	}
+	return rv
+}
+
+// deleteDocs removes the search documents of deleted records.
+func deleteDocs(c context.Context, indexName string, keys []*datastore.Key) error {
+	if indexName == "" {
+		return nil
+	}
+	index, err := search.Open(indexName)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := index.Delete(c, k.Encode()); err != nil && err != search.ErrNoSuchDocument {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactCrash keeps a crash's details but not its dump or trace.
+func compactCrash(c context.Context, ps datastore.PropertyList) (datastore.PropertyList, error) {
+	ps = dropProps(ps, "file", "trace", "retention")
+	return append(ps, datastore.Property{Name: "retention", Value: "compacted", NoIndex: true}), nil
+}
+
+// blobShared reports whether a record outside of expired still names
+// a blob.  Crash dumps are named by their contents, so identical dumps
+// share an object.
+func blobShared(c context.Context, kind, prop, name string, expired map[string]bool) (bool, error) {
+	keys, err := datastore.NewQuery(kind).Filter(prop+" =", name).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if !expired[k.Encode()] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteBlobs removes a record's bucket objects that no record outside
+// of expired uses, returning how many bytes that freed.  In a dry run
+// it only adds them up.  done keeps track of the objects already dealt
+// with in this batch.
+func deleteBlobs(c context.Context, bucket *storage.BucketHandle, kind string, ps datastore.PropertyList,
+	names []string, expired, done map[string]bool) (int64, error) {
+
+	var freed int64
+	for _, n := range names {
+		name, _ := getProp(ps, n).(string)
+		if name == "" || done[name] {
+			continue
+		}
+		done[name] = true
+		if shared, err := blobShared(c, kind, n, name, expired); err != nil {
+			return freed, err
+		} else if shared {
+			log.Debugf(c, "Keeping %v, another record uses it", name)
+			continue
+		}
+		o := bucket.Object(name)
+		attrs, err := o.Attrs(c)
+		if err == storage.ErrObjectNotExist {
+			continue
+		} else if err != nil {
+			return freed, err
+		}
+		if !isDryRun(c) {
+			if err := o.Delete(c); err != nil && err != storage.ErrObjectNotExist {
+				return freed, err
+			}
+		}
+		freed += attrs.Size
+	}
+	return freed, nil
+}
+
+// mapRetention applies the kind's retention policy to a batch,
+// emitting how many records went which way and how many bytes of
+// datastore and bucket space that reclaimed.
+func mapRetention(c context.Context, params url.Values, keys []*datastore.Key) error {
+	kind := keys[0].Kind()
+	p, err := parseRetention(kind, params.Get("days"), params.Get("action"))
+	if err != nil {
+		return permanent(err)
+	}
+	rk := retentionKinds[kind]
+	cutoff := time.Now().Add(-p.Age)
+
+	ents, err := getPropertyLists(c, keys)
+	if err != nil {
+		return err
+	}
+
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	bucket, err := storageBucket(c, client, "")
+	if err != nil {
+		return err
+	}
+
+	var expired []*datastore.Key
+	var expiredEnts []datastore.PropertyList
+	for i, ps := range ents {
+		ts, _ := getProp(ps, "timestamp").(time.Time)
+		done, _ := getProp(ps, "retention").(string)
+		if len(ps) == 0 || ts.IsZero() || ts.After(cutoff) || done != "" {
+			continue
+		}
+		expired = append(expired, keys[i])
+		expiredEnts = append(expiredEnts, ps)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	changed(c, expired...)
+
+	// Archived records keep their blobs.
+	var blobBytes int64
+	expiredSet, doneBlobs := map[string]bool{}, map[string]bool{}
+	for _, k := range expired {
+		expiredSet[k.Encode()] = true
+	}
+	for i := 0; p.Action != "archive" && i < len(expiredEnts); i++ {
+		n, err := deleteBlobs(c, bucket, kind, expiredEnts[i], rk.blobs, expiredSet, doneBlobs)
+		blobBytes += n
+		if err != nil {
+			return err
+		}
+	}
+
+	var dsBytes int
+	var upkeys []*datastore.Key
+	var upents []datastore.PropertyList
+	switch p.Action {
+	case "delete":
+		for _, ps := range expiredEnts {
+			dsBytes += payloadSize(ps, rk.payload)
+		}
+	case "compact":
+		for i, ps := range expiredEnts {
+			before := payloadSize(ps, rk.payload)
+			cps, err := rk.compact(c, ps)
+			if err != nil {
+				return err
+			}
+			dsBytes += before
+			if s, ok := getProp(cps, "summary").(string); ok {
+				dsBytes -= len(s)
+			}
+			upkeys, upents = append(upkeys, expired[i]), append(upents, cps)
+		}
+	case "archive":
+		filename := fmt.Sprintf("%s%s/%s/%s.ndjson.gz", archivePrefix, kind,
+			time.Now().UTC().Format(saltPeriodFmt), chunkID(expired))
+		if !isDryRun(c) {
+			if _, err := writeNDJSON(c, bucket, filename, expired, expiredEnts); err != nil {
+				return err
+			}
+		}
+		for i, ps := range expiredEnts {
+			dsBytes += payloadSize(ps, rk.payload)
+			if rk.compact != nil {
+				var err error
+				if ps, err = rk.compact(c, ps); err != nil {
+					return err
+				}
+				if s, ok := getProp(ps, "summary").(string); ok {
+					dsBytes -= len(s)
+				}
+			}
+			ps = append(dropProps(ps, rk.payload, "retention", "archive"),
+				datastore.Property{Name: "retention", Value: "archived", NoIndex: true},
+				datastore.Property{Name: "archive", Value: filename, NoIndex: true})
+			upkeys, upents = append(upkeys, expired[i]), append(upents, ps)
+		}
+	}
+
+	emit(c, p.Action, float64(len(expired)))
+	emit(c, "datastore_bytes", float64(dsBytes))
+	emit(c, "bucket_bytes", float64(blobBytes))
+	if isDryRun(c) {
+		return nil
+	}
+
+	log.Infof(c, "Retention: %v %v of %v %v records", p.Action, len(expired), len(keys), kind)
+	if p.Action == "delete" {
+		if err := datastore.DeleteMulti(c, append(expired, rk.markers(c, expired)...)); err != nil {
+			return err
+		}
+		return deleteDocs(c, rk.index, expired)
+	}
+	_, err = datastore.PutMulti(c, upkeys, upents)
+	return err
+}
+
+// retentionState remembers a kind's last retention run, so the next
+// one can skip what that one already got through.
+type retentionState struct {
+	Job    *datastore.Key `datastore:"job,noindex"`
+	Action string         `datastore:"action,noindex"`
+	Cutoff time.Time      `datastore:"cutoff,noindex"`
+	// Everything before this had been dealt with when Job started.
+	Through time.Time `datastore:"through,noindex"`
+}
+
+// retentionFrom returns how far back a run of p needs to look: up to
+// the last run's cutoff, if that run applied the same action and
+// finished without anything left dead lettered.
+func retentionFrom(c context.Context, st *retentionState, p retentionPolicy) (time.Time, error) {
+	if st.Job == nil || st.Action != p.Action {
+		return time.Time{}, nil
+	}
+	j, err := getBatchJob(c, st.Job)
+	if err == datastore.ErrNoSuchEntity {
+		return time.Time{}, nil
+	} else if err == nil {
+		err = j.loadCounts(c)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if j.State == "done" && j.Dead == 0 {
+		return st.Cutoff, nil
+	}
+	return st.Through, nil
+}
+
+// handleRetention starts a retention job for each configured policy,
+// mapping over everything older than its cutoff that earlier runs
+// haven't already seen to.  Results are stored as retention-<kind>.
+// Cron's jobs run for real; anyone else gets a preview.
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	policies := currentRetention(c)
+	cron := r.Header.Get("X-Appengine-Cron") == "true"
+	start := startPreview
+	if cron {
+		start = startBatchJob
+	}
+
+	jobs := map[string]string{}
+	for kind, p := range policies {
+		sk := datastore.NewKey(c, retentionStateKind, kind, 0, nil)
+		st := &retentionState{}
+		if err := datastore.Get(c, sk, st); err != nil && err != datastore.ErrNoSuchEntity {
+			log.Errorf(c, "Error fetching retention state of %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		from, err := retentionFrom(c, st, p)
+		if err != nil {
+			log.Errorf(c, "Error checking last retention run of %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		cutoff := time.Now().Add(-p.Age).UTC()
+		spec := mapSpec{
+			Kind:    kind,
+			Mapper:  "retention",
+			Params:  p.params(),
+			Filters: []string{"timestamp < " + cutoff.Format(time.RFC3339)},
+			Result:  "retention-" + kind,
+		}
+		if !from.IsZero() {
+			spec.Filters = append(spec.Filters, "timestamp >= "+from.UTC().Format(time.RFC3339))
+		}
+		k, err := start(c, spec)
+		if err != nil {
+			log.Errorf(c, "Error starting retention for %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jobs[kind] = k.Encode()
+
+		if cron {
+			st = &retentionState{Job: k, Action: p.Action, Cutoff: cutoff, Through: from}
+			if _, err := datastore.Put(c, sk, st); err != nil {
+				log.Errorf(c, "Error storing retention state of %v: %v", kind, err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+	}
+
+	log.Infof(c, "Started retention jobs: %v", jobs)
+	mustEncode(c, w, r, jobs)
+}
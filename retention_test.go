@@ -0,0 +1,62 @@
+package autotown
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCompactUsageKeepsBoards(t *testing.T) {
+	d, err := gz([]byte(`{
+		"currentOS": "Windows 10 (10.0.15063)",
+		"currentArch": "x86_64",
+		"gcs_version": "Release-20170412.1",
+		"boardsSeen": [
+			{"UUID": "abc", "Name": "Sparky2", "GitHash": "1b2c3d4"},
+			{"UUID": "def", "Name": "CopterControl"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := datastore.PropertyList{
+		{Name: "data", Value: d, NoIndex: true},
+		{Name: "country", Value: "NZ"},
+	}
+
+	cps, err := compactUsage(context.Background(), ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getProp(cps, "data") != nil {
+		t.Errorf("compacted record still has its report")
+	}
+	if got := getProp(cps, "country"); got != "NZ" {
+		t.Errorf("country = %v, want NZ", got)
+	}
+
+	var sum struct {
+		CurrentOS  string   `json:"currentOS"`
+		GCSVersion string   `json:"gcs_version"`
+		Boards     []string `json:"boards"`
+	}
+	s, _ := getProp(cps, "summary").(string)
+	if err := json.Unmarshal([]byte(s), &sum); err != nil {
+		t.Fatalf("bad summary %q: %v", s, err)
+	}
+	if want := []string{"Sparky2", "CopterControl"}; !reflect.DeepEqual(sum.Boards, want) {
+		t.Errorf("boards = %v, want %v", sum.Boards, want)
+	}
+	if sum.CurrentOS != "Windows 10 (10.0.15063)" || sum.GCSVersion != "Release-20170412.1" {
+		t.Errorf("summary lost the GCS details: %+v", sum)
+	}
+
+	u := &UsageStat{Summary: s}
+	if got := usageBoards(u); len(got) != 2 || got[0].Name != "Sparky2" {
+		t.Errorf("usageBoards of compacted report = %+v", got)
+	}
+}
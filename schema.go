@@ -0,0 +1,325 @@
+package autotown
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Every entity of a kind with migrations carries the schema version
+// it was last written at in this property.  Entities from before
+// versioning don't have it and are version 0.
+const schemaProp = "schema"
+
+// A migration brings an entity's properties from one schema version
+// to the next.  Save runs them over what it writes, too, so they have
+// to leave already migrated properties alone.
+type migration func(ps []datastore.Property) ([]datastore.Property, error)
+
+var migrations = map[string][]migration{}
+
+// registerMigration adds the migration producing version of kind.
+// Versions start at 1 and must be registered in order.
+func registerMigration(kind string, version int, m migration) {
+	if version != len(migrations[kind])+1 {
+		panic(fmt.Sprintf("%v migration %v registered out of order", kind, version))
+	}
+	migrations[kind] = append(migrations[kind], m)
+}
+
+func init() {
+	registerMigration("FoundController", 1, renameProps(map[string]string{"gss_arch": "gcs_arch"}))
+	registerMigration("FoundController", 2, platformProps)
+	registerMigration("CrashData", 1, renameProps(crashNameMap))
+	registerMigration("TuneResults", 1, hashTuneUUID)
+
+	// Batches are written in one XG transaction, so stay under its
+	// 25 entity group limit.
+	var kinds []string
+	for k := range migrations {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	registerMapper(kindMapper{name: "migrate", kinds: kinds,
+		batchSize: 20, concurrency: 5, mutates: true, f: mapMigrate})
+
+	http.HandleFunc("/admin/schema", handleSchemaStatus)
+	http.HandleFunc("/admin/schema/migrate", handleMigrate)
+}
+
+func schemaVersion(kind string) int {
+	return len(migrations[kind])
+}
+
+// migrateProps brings properties of kind up to the current schema,
+// returning them without the version property along with the version
+// they were at.
+func migrateProps(kind string, ps []datastore.Property) ([]datastore.Property, int, error) {
+	from := 0
+	var rv []datastore.Property
+	for _, p := range ps {
+		if p.Name == schemaProp {
+			if v, ok := p.Value.(int64); ok {
+				from = int(v)
+			}
+			continue
+		}
+		rv = append(rv, p)
+	}
+	ms := migrations[kind]
+	if from > len(ms) {
+		return nil, from, fmt.Errorf("%v is at schema %v, newer than %v", kind, from, len(ms))
+	}
+	for _, m := range ms[from:] {
+		var err error
+		if rv, err = m(rv); err != nil {
+			return nil, from, err
+		}
+	}
+	return rv, from, nil
+}
+
+func versioned(kind string, ps []datastore.Property) []datastore.Property {
+	return append(ps, datastore.Property{Name: schemaProp, Value: int64(schemaVersion(kind))})
+}
+
+// loadMigrated and saveVersioned are the Load and Save of kinds that
+// are otherwise plain structs.
+func loadMigrated(kind string, dst interface{}, ps []datastore.Property) error {
+	ps, _, err := migrateProps(kind, ps)
+	if err != nil {
+		return err
+	}
+	return datastore.LoadStruct(dst, ps)
+}
+
+func saveVersioned(kind string, src interface{}) ([]datastore.Property, error) {
+	ps, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	ps, _, err = migrateProps(kind, ps)
+	if err != nil {
+		return nil, err
+	}
+	return versioned(kind, ps), nil
+}
+
+func renameProps(names map[string]string) migration {
+	return func(ps []datastore.Property) ([]datastore.Property, error) {
+		for i := range ps {
+			if n, ok := names[ps[i].Name]; ok {
+				ps[i].Name = n
+			}
+		}
+		return ps, nil
+	}
+}
+
+func hashUUID(uuid string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(uuid)))
+}
+
+// hashTuneUUID replaces a raw CPU ID with its hash, both in the uuid
+// property and in the report it was raised from.
+func hashTuneUUID(ps []datastore.Property) ([]datastore.Property, error) {
+	var uuid *datastore.Property
+	var data *datastore.Property
+	for i := range ps {
+		switch ps[i].Name {
+		case "uuid":
+			uuid = &ps[i]
+		case "data":
+			data = &ps[i]
+		}
+	}
+	if uuid == nil {
+		return ps, nil
+	}
+	raw, _ := uuid.Value.(string)
+	if raw == "" || len(raw) == 64 {
+		return ps, nil
+	}
+	uuid.Value = hashUUID(raw)
+
+	if data == nil {
+		return ps, nil
+	}
+	b, _ := data.Value.([]byte)
+	d, err := ungz(b)
+	if err != nil {
+		return nil, err
+	}
+	if d, err = setTuneUUID(d, hashUUID(raw)); err != nil {
+		return nil, err
+	}
+	if data.Value, err = gz(d); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// setTuneUUID replaces the ID in a tune report.  A report that's
+// unreadable has no ID in it to replace, and is returned as is.
+func setTuneUUID(d []byte, uuid string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	m := map[string]interface{}{}
+	if err := dec.Decode(&m); err != nil {
+		return d, nil
+	}
+	m["uniqueId"] = uuid
+	return json.Marshal(m)
+}
+
+// mapMigrate eagerly migrates a batch, writing back anything that
+// wasn't already at the current schema.
+func mapMigrate(c context.Context, params url.Values, keys []*datastore.Key) error {
+	kind := keys[0].Kind()
+	var upkeys []*datastore.Key
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		ents, err := getPropertyLists(tc, keys)
+		if err != nil {
+			return err
+		}
+
+		upkeys = nil
+		var upents []datastore.PropertyList
+		for i, ps := range ents {
+			if len(ps) == 0 {
+				continue
+			}
+			mps, from, err := migrateProps(kind, ps)
+			if err != nil {
+				log.Errorf(c, "Error migrating %v: %v", keys[i].Encode(), err)
+				continue
+			}
+			if from == schemaVersion(kind) {
+				continue
+			}
+			upkeys = append(upkeys, keys[i])
+			upents = append(upents, versioned(kind, mps))
+		}
+
+		if len(upkeys) == 0 || isDryRun(c) {
+			return nil
+		}
+		log.Infof(c, "Migrating %v of %v %v records", len(upkeys), len(keys), kind)
+		_, err = datastore.PutMulti(tc, upkeys, upents)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	changed(c, upkeys...)
+	return nil
+}
+
+// handleSchemaStatus reports, for each kind with migrations, its
+// current schema version and how many entities are at each version.
+func handleSchemaStatus(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	type kindStatus struct {
+		Current  int
+		Versions map[int]int
+	}
+	rv := map[string]kindStatus{}
+	for kind := range migrations {
+		if k := r.FormValue("kind"); k != "" && k != kind {
+			continue
+		}
+		st := kindStatus{schemaVersion(kind), map[int]int{}}
+		total, err := datastore.NewQuery(kind).KeysOnly().Count(c)
+		if err != nil {
+			log.Errorf(c, "Error counting %v: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// Entities without a version property aren't in its index,
+		// so whatever isn't counted at a version is at 0.
+		for v := 1; v <= st.Current; v++ {
+			n, err := datastore.NewQuery(kind).Filter(schemaProp+" =", int64(v)).KeysOnly().Count(c)
+			if err != nil {
+				log.Errorf(c, "Error counting %v at schema %v: %v", kind, v, err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			st.Versions[v] = n
+			total -= n
+		}
+		st.Versions[0] += total
+		rv[kind] = st
+	}
+
+	mustEncode(c, w, r, rv)
+}
+
+// Params:
+// - kind: the kind to migrate (default every kind with migrations)
+// - since: only migrate entities with a timestamp from then on
+// - confirm: the token of a finished preview to run for real
+//
+// Cron runs it for real, weekly, to catch up entities nothing has
+// loaded and saved since; anyone else gets a preview first.
+func handleMigrate(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if tok := r.FormValue("confirm"); tok != "" {
+		k, err := confirmPreview(c, tok)
+		if err != nil {
+			log.Errorf(c, "Error confirming migration: %v", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mustEncode(c, w, r, map[string]string{"job": k.Encode()})
+		return
+	}
+
+	var filters []string
+	if s := r.FormValue("since"); s != "" {
+		t, ok := parseFilterValue(s).(time.Time)
+		if !ok {
+			http.Error(w, "invalid since: "+s, 400)
+			return
+		}
+		filters = append(filters, "timestamp >= "+t.UTC().Format(time.RFC3339))
+	}
+
+	start := startPreview
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		start = startBatchJob
+	}
+
+	jobs := map[string]string{}
+	for kind := range migrations {
+		if k := r.FormValue("kind"); k != "" && k != kind {
+			continue
+		}
+		k, err := start(c, mapSpec{Kind: kind, Mapper: "migrate", Filters: filters})
+		if err != nil {
+			log.Errorf(c, "Error starting %v migration: %v", kind, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jobs[kind] = k.Encode()
+	}
+	if len(jobs) == 0 {
+		http.Error(w, "no migrations for "+r.FormValue("kind"), 400)
+		return
+	}
+
+	log.Infof(c, "Started migrations: %v", jobs)
+	mustEncode(c, w, r, jobs)
+}
@@ -0,0 +1,219 @@
+package autotown
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Crash reports don't say what the GCS was connected to, but the GCS
+// reports usage from the same address around the time it uploads the
+// crash, which is when it starts up again.  Boards in those reports
+// are linked to the crash through its boards and uuids properties.
+// Anyone else behind the same address in the window gets linked too,
+// so it's kept short.
+const crashSessionWindow = time.Hour
+
+// How far back cron relinks crashes.  The usage that follows a crash
+// usually comes in after it, so crashes are linked again once it has.
+const crashRelinkAge = 3 * time.Hour
+
+func init() {
+	// Crashes are written without a transaction, so the batch is
+	// only bounded by how many usage queries it makes.
+	registerMapper(kindMapper{name: "linkCrashes", kinds: []string{"CrashData"},
+		batchSize: 20, concurrency: 5, mutates: true, f: mapLinkCrashes})
+
+	http.HandleFunc("/admin/linkCrashes", handleLinkCrashes)
+}
+
+type sessionBoard struct {
+	UUID            string
+	Name            string
+	GitHash, GitTag string
+}
+
+// usageBoards lists the boards a usage report saw.  Compacted reports
+// only kept the board names, not their IDs or firmware.
+func usageBoards(u *UsageStat) []sessionBoard {
+	var rv []sessionBoard
+	if u.Summary != "" {
+		var sum struct {
+			Boards []string `json:"boards"`
+		}
+		json.Unmarshal([]byte(u.Summary), &sum)
+		for _, n := range sum.Boards {
+			rv = append(rv, sessionBoard{Name: n})
+		}
+		return rv
+	}
+
+	d, err := ungz(u.Data)
+	if err != nil {
+		d = u.Data
+	}
+	var o struct {
+		Boards []usageSeenBoard `json:"boardsSeen"`
+	}
+	if err := json.Unmarshal(d, &o); err != nil {
+		return nil
+	}
+	for _, b := range o.Boards {
+		id := b.UUID
+		if id == "" {
+			id = b.CPU
+		}
+		if isRawUUID(id) {
+			id = hashUUID(id)
+		}
+		rv = append(rv, sessionBoard{id, b.Name, b.GitHash, b.GitTag})
+	}
+	return rv
+}
+
+// sessionBoards finds the boards reported in usage from addr within
+// crashSessionWindow of t.  A truncated address is shared by a whole
+// network, so nothing is linked by one.
+func sessionBoards(c context.Context, addr string, t time.Time) ([]sessionBoard, error) {
+	if !exactAddr(addr) {
+		return nil, nil
+	}
+	q := datastore.NewQuery("UsageStat").
+		Filter("addr =", addr).
+		Filter("timestamp >=", t.Add(-crashSessionWindow)).
+		Filter("timestamp <=", t.Add(crashSessionWindow))
+	var rv []sessionBoard
+	for it := q.Run(c); ; {
+		var u UsageStat
+		_, err := it.Next(&u)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		rv = append(rv, usageBoards(&u)...)
+	}
+	return rv, nil
+}
+
+// linkCrash sets a crash's boards and uuids from the usage around it,
+// reporting whether they changed.
+func linkCrash(c context.Context, x *CrashData, boards *boardCatalog) (bool, error) {
+	addr, _ := x.properties["addr"].(string)
+	ts, _ := x.properties["timestamp"].(time.Time)
+	seen, err := sessionBoards(c, addr, ts)
+	if err != nil {
+		return false, err
+	}
+
+	names, uuids := map[string]bool{}, map[string]bool{}
+	for _, b := range seen {
+		if b.Name != "" {
+			names[boards.canonical(b.Name)] = true
+		}
+		if b.UUID != "" {
+			uuids[b.UUID] = true
+		}
+	}
+	did := false
+	for prop, m := range map[string]map[string]bool{"boards": names, "uuids": uuids} {
+		var l []string
+		for k := range m {
+			l = append(l, k)
+		}
+		if !sameStrings(crashStrings(x, prop), l) {
+			did = true
+		}
+		if len(l) == 0 {
+			delete(x.properties, prop)
+		} else {
+			x.properties[prop] = l
+		}
+	}
+	return did, nil
+}
+
+// crashStrings returns a multi-valued crash property.
+func crashStrings(x *CrashData, prop string) []string {
+	switch vs := x.properties[prop].(type) {
+	case []string:
+		return vs
+	case []interface{}:
+		var rv []string
+		for _, v := range vs {
+			if s, ok := v.(string); ok {
+				rv = append(rv, s)
+			}
+		}
+		return rv
+	}
+	return nil
+}
+
+// mapLinkCrashes links crashes stored before linking, or before the
+// usage after them came in.  Addresses are scrubbed after a while, so
+// older crashes can't be linked at all.
+func mapLinkCrashes(c context.Context, params url.Values, keys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	crashes := make([]CrashData, len(keys))
+	if err := datastore.GetMulti(c, keys, crashes); err != nil {
+		return err
+	}
+
+	var upkeys []*datastore.Key
+	var upents []*CrashData
+	for i := range crashes {
+		did, err := linkCrash(c, &crashes[i], boards)
+		if err != nil {
+			return err
+		}
+		if did {
+			upkeys = append(upkeys, keys[i])
+			upents = append(upents, &crashes[i])
+		}
+	}
+
+	changed(c, upkeys...)
+	if len(upkeys) == 0 || isDryRun(c) {
+		return nil
+	}
+	log.Infof(c, "Linking %v of %v crashes to boards", len(upkeys), len(keys))
+	_, err = datastore.PutMulti(c, upkeys, upents)
+	return err
+}
+
+// handleLinkCrashes starts a linkCrashes job over the crashes of the
+// last crashRelinkAge.  Cron's jobs run for real; anyone else gets a
+// preview.
+func handleLinkCrashes(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	start := startPreview
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		start = startBatchJob
+	}
+	since := time.Now().Add(-crashRelinkAge).UTC().Format(time.RFC3339)
+	k, err := start(c, mapSpec{
+		Kind:    "CrashData",
+		Mapper:  "linkCrashes",
+		Filters: []string{"timestamp >= " + since},
+	})
+	if err != nil {
+		log.Errorf(c, "Error starting crash links: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Infof(c, "Linking crashes since %v as job %v", since, k.IntID())
+	mustEncode(c, w, r, map[string]string{"job": k.Encode()})
+}
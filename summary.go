@@ -0,0 +1,241 @@
+package autotown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	usageSummaryKind   = "UsageSummary"
+	usageSummaryGroup  = "all"
+	usageSummaryShards = 20
+
+	resultsStatsKey = "controllerStats"
+)
+
+func init() {
+	registerMapper(kindMapper{name: "summarizeUsage", kinds: []string{"FoundController"},
+		batchSize: 10, concurrency: 10, mutates: true, f: mapSummarizeUsage})
+}
+
+type usageSummary struct {
+	OSBoard      map[string]map[string]int `json:"os_board"`
+	OSDetail     map[string]int            `json:"os_detail"`
+	Board        map[string]int            `json:"board"`
+	BoardRev     map[string]map[string]int `json:"board_rev"`
+	CountryBoard map[string]map[string]int `json:"country_board"`
+	VersionBoard map[string]map[string]int `json:"version_board"`
+	OSVersion    map[string]map[string]int `json:"os_version"`
+	Arch         map[string]int            `json:"arch"`
+	GCSVersion   map[string]int            `json:"gcs_version"`
+}
+
+func newUsageSummary() *usageSummary {
+	return &usageSummary{
+		OSBoard:      map[string]map[string]int{},
+		OSDetail:     map[string]int{},
+		Board:        map[string]int{},
+		BoardRev:     map[string]map[string]int{},
+		CountryBoard: map[string]map[string]int{},
+		VersionBoard: map[string]map[string]int{},
+		OSVersion:    map[string]map[string]int{},
+		Arch:         map[string]int{},
+		GCSVersion:   map[string]int{},
+	}
+}
+
+func incr2(m map[string]map[string]int, a, b string, n int) {
+	sub, ok := m[a]
+	if !ok {
+		sub = map[string]int{}
+		m[a] = sub
+	}
+	sub[b] += n
+}
+
+// summaryContrib returns the names of all the summary counters a
+// controller contributes one to.  Versions are recorded by git hash
+// and resolved to labels at read time since branch heads move.
+func summaryContrib(fc *FoundController, boards *boardCatalog) []string {
+	bn := boards.canonical(fc.Name)
+	p := parsePlatform(fc.GCSOS, fc.GCSArch, fc.GCSVersion)
+	gcsVer := p.GCSVersion
+	if p.GCSPre != "" {
+		gcsVer += "-" + p.GCSPre
+	}
+	return []string{
+		"board|" + bn,
+		"os_detail|" + fc.GCSOS,
+		"os_board|" + abbrevOS(fc.GCSOS) + "|" + bn,
+		"board_rev|" + bn + "|" + fmt.Sprint(fc.HardwareRev),
+		"country_board|" + fc.Country + "|" + bn,
+		"version_board|" + fc.GitHash + "|" + bn,
+		"os_version|" + p.OSFamily + "|" + p.OSVersion,
+		"arch|" + p.Arch,
+		"gcs_version|" + gcsVer,
+	}
+}
+
+// summaryDeltas moves fc's recorded summary contribution to reflect
+// its current state and returns the counter adjustments required to
+// get there.
+func summaryDeltas(fc *FoundController, boards *boardCatalog) map[string]int64 {
+	deltas := map[string]int64{}
+	for _, s := range fc.Summary {
+		deltas[s]--
+	}
+	now := summaryContrib(fc, boards)
+	for _, s := range now {
+		deltas[s]++
+	}
+	for k, v := range deltas {
+		if v == 0 {
+			delete(deltas, k)
+		}
+	}
+	fc.Summary = now
+	return deltas
+}
+
+func mergeDeltas(into, from map[string]int64) {
+	for k, v := range from {
+		into[k] += v
+	}
+}
+
+func loadUsageSummary(c context.Context) (*usageSummary, error) {
+	var gitl []githubRef
+
+	g, _ := errgroup.WithContext(c)
+	g.Go(func() error {
+		var err error
+		gitl, err = gitLabels(c)
+		if err != nil {
+			log.Errorf(c, "Error getting stuff from github, going without: %v", err)
+		}
+		return nil
+	})
+
+	counts, err := readCounters(c, usageSummaryKind, usageSummaryGroup, usageSummaryShards)
+	if err != nil {
+		return nil, err
+	}
+	g.Wait()
+
+	refs := map[string]string{}
+	results := newUsageSummary()
+	for name, n64 := range counts {
+		n := int(n64)
+		parts := strings.SplitN(name, "|", 3)
+		switch {
+		case parts[0] == "board" && len(parts) == 2:
+			results.Board[parts[1]] += n
+		case parts[0] == "os_detail" && len(parts) == 2:
+			results.OSDetail[parts[1]] += n
+		case parts[0] == "arch" && len(parts) == 2:
+			results.Arch[parts[1]] += n
+		case parts[0] == "gcs_version" && len(parts) == 2:
+			results.GCSVersion[parts[1]] += n
+		case len(parts) != 3:
+			log.Warningf(c, "Unexpected summary counter: %q", name)
+		case parts[0] == "os_board":
+			incr2(results.OSBoard, parts[1], parts[2], n)
+		case parts[0] == "os_version":
+			incr2(results.OSVersion, parts[1], parts[2], n)
+		case parts[0] == "board_rev":
+			incr2(results.BoardRev, parts[1], parts[2], n)
+		case parts[0] == "country_board":
+			incr2(results.CountryBoard, parts[1], parts[2], n)
+		case parts[0] == "version_board":
+			ref, ok := refs[parts[1]]
+			if !ok {
+				ref = "Unknown"
+				if lbls := gitDescribe(parts[1], gitl); lbls != nil {
+					ref = lbls[0].Label
+				}
+				refs[parts[1]] = ref
+			}
+			incr2(results.VersionBoard, ref, parts[2], n)
+		}
+	}
+
+	return results, nil
+}
+
+func handleUsageStatsSummary(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	itm, err := memcache.Get(c, resultsStatsKey)
+	if err == nil {
+		rm := json.RawMessage(itm.Value)
+		mustEncode(c, w, r, &rm)
+		return
+	}
+
+	results, err := loadUsageSummary(c)
+	if err != nil {
+		log.Errorf(c, "Error loading usage summary: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	memcache.JSON.Set(c, &memcache.Item{
+		Key:        resultsStatsKey,
+		Object:     results,
+		Expiration: time.Hour,
+	})
+
+	mustEncode(c, w, r, results)
+}
+
+// mapSummarizeUsage brings the summary contribution of a batch of
+// FoundControllers in line with their current state.  It's safe to
+// run any number of times; after wiping UsageSummary and clearing the
+// count flags it rebuilds the whole summary.
+func mapSummarizeUsage(c context.Context, params url.Values, fckeys []*datastore.Key) error {
+	boards, err := loadBoards(c)
+	if err != nil {
+		return err
+	}
+	var moved []*datastore.Key
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		fcs := make([]*FoundController, len(fckeys))
+		if err := datastore.GetMulti(tc, fckeys, fcs); err != nil {
+			return err
+		}
+		moved = nil
+		deltas := map[string]int64{}
+		for i, fc := range fcs {
+			if d := summaryDeltas(fc, boards); len(d) > 0 {
+				moved = append(moved, fckeys[i])
+				mergeDeltas(deltas, d)
+			}
+		}
+		if len(deltas) == 0 || isDryRun(tc) {
+			return nil
+		}
+		if _, err := datastore.PutMulti(tc, fckeys, fcs); err != nil {
+			return err
+		}
+		return addCounters(tc, usageSummaryKind, usageSummaryGroup, usageSummaryShards, deltas)
+	}, &datastore.TransactionOptions{XG: true, Attempts: 10})
+	if err != nil {
+		return err
+	}
+	changed(c, moved...)
+
+	memcache.Delete(c, resultsStatsKey)
+	return nil
+}
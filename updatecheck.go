@@ -0,0 +1,295 @@
+package autotown
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	releasePageURL = "https://github.com/d-ronin/dRonin/releases/tag/"
+
+	// Release notes and downloads can be edited after the tag is
+	// pushed.  Comparisons between commits never change.
+	releaseCacheAge = 6 * time.Hour
+)
+
+func init() {
+	http.Handle("/api/updateCheck", corsHandleFunc(handleUpdateCheck))
+}
+
+type gitComparison struct {
+	// ahead, behind, identical or diverged, of head relative to
+	// base.
+	Status   string `json:"status"`
+	AheadBy  int    `json:"ahead_by"`
+	BehindBy int    `json:"behind_by"`
+}
+
+type githubRelease struct {
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	HTMLURL     string    `json:"html_url"`
+	PublishedAt time.Time `json:"published_at"`
+	Assets      []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+		Size int64  `json:"size"`
+	} `json:"assets"`
+}
+
+type releaseDownload struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+}
+
+type latestRelease struct {
+	Tag       string            `json:"tag"`
+	Hash      string            `json:"hash"`
+	Version   string            `json:"version"`
+	Name      string            `json:"name,omitempty"`
+	Notes     string            `json:"notes,omitempty"`
+	URL       string            `json:"url"`
+	Published time.Time         `json:"published"`
+	Downloads []releaseDownload `json:"downloads"`
+
+	uavoHash string
+}
+
+// A commitStatus says how a commit someone's running relates to the
+// latest release.  Status is a gitComparison's, or "unknown".
+type commitStatus struct {
+	Commit      string      `json:"commit"`
+	Labels      []githubRef `json:"labels"`
+	Status      string      `json:"status"`
+	AheadBy     int         `json:"ahead_by"`
+	BehindBy    int         `json:"behind_by"`
+	Update      bool        `json:"update"`
+	UAVOChanged bool        `json:"uavo_changed,omitempty"`
+}
+
+// releaseTags returns the tags naming releases, newest first.
+// Anything parsing as a pre-release or a build past a tag isn't one.
+func releaseTags(gitl []githubRef) []githubRef {
+	type rel struct {
+		ref githubRef
+		v   gcsPlatform
+	}
+	var rels []rel
+	for _, r := range gitl {
+		if r.Type != "tag" {
+			continue
+		}
+		var p gcsPlatform
+		p.parseGCSVersion(r.Label)
+		if p.GCSVersion == "" || p.GCSPre != "" || p.GCSAhead > 0 || p.GCSDirty {
+			continue
+		}
+		rels = append(rels, rel{r, p})
+	}
+	sort.Slice(rels, func(i, j int) bool {
+		a, b := rels[i].v, rels[j].v
+		switch {
+		case a.GCSMajor != b.GCSMajor:
+			return a.GCSMajor > b.GCSMajor
+		case a.GCSMinor != b.GCSMinor:
+			return a.GCSMinor > b.GCSMinor
+		}
+		return a.GCSPatch > b.GCSPatch
+	})
+	var rv []githubRef
+	for _, r := range rels {
+		rv = append(rv, r.ref)
+	}
+	return rv
+}
+
+func fetchRelease(c context.Context, tag githubRef) *latestRelease {
+	var p gcsPlatform
+	p.parseGCSVersion(tag.Label)
+	rv := &latestRelease{
+		Tag:       tag.Label,
+		Hash:      tag.Hash,
+		Version:   p.GCSVersion,
+		URL:       releasePageURL + tag.Label,
+		Downloads: []releaseDownload{},
+	}
+
+	var gr githubRelease
+	if err := fetchDecodeOrMiss(c, "release@"+tag.Label, releaseCacheAge, releaseURL+tag.Label, &gr); err != nil {
+		// Not every tag got a release page.
+		log.Infof(c, "No release found for %v: %v", tag.Label, err)
+	} else {
+		rv.Name, rv.Notes, rv.Published = gr.Name, gr.Body, gr.PublishedAt
+		if gr.HTMLURL != "" {
+			rv.URL = gr.HTMLURL
+		}
+		for _, a := range gr.Assets {
+			rv.Downloads = append(rv.Downloads, releaseDownload{a.Name, a.URL, a.Size})
+		}
+	}
+
+	// The release's UAVOs are whatever a controller running it
+	// reported.
+	var fcs []FoundController
+	q := datastore.NewQuery("FoundController").Filter("git_hash =", tag.Hash).Limit(1)
+	if _, err := q.GetAll(c, &fcs); err != nil {
+		log.Warningf(c, "Error looking up UAVOs of %v: %v", tag.Label, err)
+	} else if len(fcs) > 0 {
+		rv.uavoHash = fcs[0].UAVOHash
+	}
+	return rv
+}
+
+// fetchDecodeOrMiss is fetchDecodeCached that also remembers, for
+// releaseCacheAge, that GitHub has nothing there.  Otherwise a missing
+// release page or a bad commit has every GCS start asking GitHub
+// again.  Any other failure may be gone by the next request, so it
+// isn't remembered.
+func fetchDecodeOrMiss(c context.Context, k string, age time.Duration, u string, ob interface{}) error {
+	var missed string
+	if gzCacheGet(c, k+".miss", &missed) == nil && missed != "" {
+		return errors.New(missed)
+	}
+	err := fetchDecodeCached(c, k, age, u, ob)
+	if se, ok := err.(githubStatusError); ok && (se.status == 404 || se.status == 422) {
+		gzCacheSet(c, k+".miss", releaseCacheAge, err.Error())
+	}
+	return err
+}
+
+// compareCommits compares the release to a commit.  A commit the
+// release is ahead of should be updated.  One that's diverged from it,
+// like a build of an older release branch, should be too, unless it's
+// further along than the release is.
+//
+// A short hash is only compared if some tag or branch points at the
+// commit it names, so it's resolved to exactly one full hash.  A full
+// hash, like a nightly or PR build's, is compared as it is.  Anything
+// GitHub can't compare is "unknown".
+func compareCommits(c context.Context, commit string, rel *latestRelease, gitl []githubRef) *commitStatus {
+	rv := &commitStatus{Commit: commit, Labels: gitDescribe(commit, gitl), Status: "unknown"}
+	if rv.Labels == nil {
+		rv.Labels = []githubRef{}
+	}
+	full := ""
+	if len(commit) == 40 {
+		full = commit
+	}
+	for i, l := range rv.Labels {
+		if i == 0 {
+			full = l.Hash
+		} else if l.Hash != full {
+			// Too short to say which commit it is.
+			return rv
+		}
+	}
+	if full == "" {
+		return rv
+	}
+
+	var cmp gitComparison
+	k := "compare@" + full + "..." + rel.Hash
+	if err := fetchDecodeOrMiss(c, k, 0, compareURL+full+"..."+rel.Hash, &cmp); err != nil {
+		log.Warningf(c, "Error comparing %v to %v: %v", commit, rel.Tag, err)
+		return rv
+	}
+	rv.Status, rv.AheadBy, rv.BehindBy = cmp.Status, cmp.AheadBy, cmp.BehindBy
+	switch cmp.Status {
+	case "ahead":
+		rv.Update = true
+	case "diverged":
+		rv.Update = cmp.AheadBy > cmp.BehindBy
+	}
+	return rv
+}
+
+// Params:
+// - gcs: the commit the GCS was built from
+// - fw: the commit of a connected board's firmware (repeatable)
+// - uavo: the UAVO hash of the board at the same position in fw
+// - crashes: if true, summarize crashes of the GCS's version
+func handleUpdateCheck(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	gcs := r.FormValue("gcs")
+	fws := r.Form["fw"]
+	for _, h := range append([]string{gcs}, fws...) {
+		if h != "" && !commitRE.MatchString(h) {
+			http.Error(w, "invalid commit: "+h, 400)
+			return
+		}
+	}
+	if gcs == "" && len(fws) == 0 {
+		http.Error(w, "no commits given", 400)
+		return
+	}
+
+	gitl, err := gitLabels(c)
+	if err != nil {
+		log.Errorf(c, "Error loading git labels: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := struct {
+		Update   bool           `json:"update"`
+		Latest   *latestRelease `json:"latest"`
+		GCS      *commitStatus  `json:"gcs,omitempty"`
+		Firmware []commitStatus `json:"firmware,omitempty"`
+		Crashes  interface{}    `json:"crashes,omitempty"`
+	}{}
+
+	rels := releaseTags(gitl)
+	if len(rels) == 0 {
+		mustEncode(c, w, r, rv)
+		return
+	}
+	rv.Latest = fetchRelease(c, rels[0])
+
+	if gcs != "" {
+		rv.GCS = compareCommits(c, gcs, rv.Latest, gitl)
+		rv.Update = rv.GCS.Update
+	}
+
+	uavos := r.Form["uavo"]
+	for i, fw := range fws {
+		st := compareCommits(c, fw, rv.Latest, gitl)
+		if i < len(uavos) && uavos[i] != "" && rv.Latest.uavoHash != "" {
+			st.UAVOChanged = uavos[i] != rv.Latest.uavoHash
+		}
+		rv.Update = rv.Update || st.Update
+		rv.Firmware = append(rv.Firmware, *st)
+	}
+
+	if gcs != "" && r.FormValue("crashes") == "true" {
+		// Crash reports may carry a shorter hash than we were given.
+		ref := gcs
+		if len(ref) > 7 {
+			ref = ref[:7]
+		}
+		// As with /api/version/, only labelled versions get profiles.
+		if len(versionLabels(ref, gitl)) > 0 {
+			p, err := buildProfile(c, "version", ref, []string{"crashes"}, false)
+			if err != nil {
+				log.Warningf(c, "Error summarizing crashes of %v: %v", gcs, err)
+			} else {
+				rv.Crashes = p["crashes"]
+			}
+		}
+	}
+
+	mustEncode(c, w, r, rv)
+}
@@ -56,11 +56,11 @@ var (
 
 func init() {
 	http.HandleFunc("/storeTune", handleStoreTune)
-	http.HandleFunc("/asyncStoreTune", handleAsyncStoreTune)
+	http.HandleFunc("/asyncStoreTune", deadLetters(handleAsyncStoreTune))
 	http.HandleFunc("/storeCrash", handleStoreCrash)
 	http.HandleFunc("/storeTrace/", handleStoreTrace)
 	http.HandleFunc("/usageStats", handleUsageStats)
-	http.HandleFunc("/batch/asyncUsageStats", handleAsyncUsageStats)
+	http.HandleFunc("/batch/asyncUsageStats", deadLetters(handleAsyncUsageStats))
 	http.HandleFunc("/exportTunes", handleExportTunes)
 	http.HandleFunc("/uavos/", handleUAVOs)
 
@@ -131,20 +131,36 @@ func handleStoreTune(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Hashed up front so the entity, the cache and the search
+	// document all agree, and saving doesn't have to rewrite the
+	// report.
+	if isRawUUID(fields.UUID) {
+		fields.UUID = hashUUID(fields.UUID)
+		d, err := setTuneUUID(rawJson, fields.UUID)
+		if err != nil {
+			log.Errorf(c, "Error hashing tune UUID: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		rawJson = json.RawMessage(d)
+	}
+
+	privacy := currentPrivacy()
+	now := time.Now()
+	loc := locate(c, r.Header, r.RemoteAddr)
 	t := TuneResults{
 		Data:      []byte(rawJson),
-		Timestamp: time.Now(),
-		Addr:      r.RemoteAddr,
-		Country:   r.Header.Get("X-AppEngine-Country"),
-		Region:    r.Header.Get("X-AppEngine-Region"),
-		City:      r.Header.Get("X-AppEngine-City"),
+		Timestamp: now,
+		Addr:      privacy.ingestAddr(c, r.RemoteAddr, now, loc),
+		Country:   loc.Country,
+		Region:    loc.Region,
+		City:      loc.City,
+		GeoSource: loc.Source,
 		UUID:      fields.UUID,
 		Board:     fields.Vehicle.Firmware.Board,
 		Tau:       fields.Identification.Tau,
 	}
-
-	fmt.Sscanf(r.Header.Get("X-Appengine-Citylatlong"),
-		"%f,%f", &t.Lat, &t.Lon)
+	t.Lat, t.Lon = privacy.coords(loc.Lat, loc.Lon)
 
 	oldSize := len(t.Data)
 	if err := t.compress(); err != nil {
@@ -207,7 +223,7 @@ func handleAsyncStoreTune(w http.ResponseWriter, r *http.Request) {
 	var t TuneResults
 	if err := gob.NewDecoder(r.Body).Decode(&t); err != nil {
 		log.Errorf(c, "Error decoding tune results: %v", err)
-		http.Error(w, "error decoding gob", 500)
+		http.Error(w, "error decoding gob", 400)
 		return
 	}
 
@@ -297,6 +313,7 @@ func exportTunesCSV(c context.Context, w http.ResponseWriter, r *http.Request) {
 	q := datastore.NewQuery("TuneResults").
 		Order("timestamp")
 
+	privacy := currentPrivacy()
 	for t := q.Run(c); ; {
 		var x TuneResults
 		k, err := t.Next(&x)
@@ -315,6 +332,7 @@ func exportTunesCSV(c context.Context, w http.ResponseWriter, r *http.Request) {
 			log.Infof(c, "Error extracting fields from %s: %v", x.Data, err)
 			continue
 		}
+		x.Lat, x.Lon = privacy.coords(x.Lat, x.Lon)
 
 		cw.Write(append([]string{
 			x.Timestamp.Format(time.RFC3339), k.Encode(), x.UUID,
@@ -332,6 +350,7 @@ func exportTunesJSON(c context.Context, w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	j := json.NewEncoder(w)
 
+	privacy := currentPrivacy()
 	for t := q.Run(c); ; {
 		type TuneResult struct {
 			ID        string           `json:"id"`
@@ -356,10 +375,11 @@ func exportTunesJSON(c context.Context, w http.ResponseWriter, r *http.Request)
 			continue
 		}
 
+		x.Lat, x.Lon = privacy.coords(x.Lat, x.Lon)
 		err = j.Encode(TuneResult{
 			Timestamp: x.Timestamp,
 			ID:        x.UUID,
-			Addr:      x.Addr,
+			Addr:      privacy.exportAddr(x.Addr),
 			Country:   x.Country,
 			Region:    x.Region,
 			City:      x.City,
@@ -441,17 +461,24 @@ func handleStoreCrash(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "error closing blob store", 500)
 		return
 	}
+	privacy := currentPrivacy()
+	now := time.Now()
 	crash.properties["file"] = filename
-	crash.properties["timestamp"] = time.Now()
-	crash.properties["addr"] = r.RemoteAddr
-	crash.properties["country"] = r.Header.Get("X-AppEngine-Country")
-	crash.properties["region"] = r.Header.Get("X-AppEngine-Region")
-	crash.properties["city"] = r.Header.Get("X-AppEngine-City")
+	crash.properties["timestamp"] = now
+
+	loc := locate(c, r.Header, r.RemoteAddr)
+	crash.properties["addr"] = privacy.ingestAddr(c, r.RemoteAddr, now, loc)
+	crash.properties["country"] = loc.Country
+	crash.properties["region"] = loc.Region
+	crash.properties["city"] = loc.City
+	crash.properties["geo_source"] = loc.Source
+	crash.properties["lat"], crash.properties["lon"] = privacy.coords(loc.Lat, loc.Lon)
 
-	var lat, lon float64
-	fmt.Sscanf(r.Header.Get("X-Appengine-Citylatlong"), "%f,%f", &lat, &lon)
-	crash.properties["lat"] = lat
-	crash.properties["lon"] = lon
+	if boards, err := loadBoards(c); err != nil {
+		log.Warningf(c, "Error loading boards, not linking crash: %v", err)
+	} else if _, err := linkCrash(c, crash, boards); err != nil {
+		log.Warningf(c, "Error linking crash to boards: %v", err)
+	}
 
 	k, err := datastore.Put(c, datastore.NewIncompleteKey(c, "CrashData", nil), crash)
 	if err != nil {
@@ -577,10 +604,17 @@ func handleRecentTunes(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	boards, err := loadBoards(c)
+	if err != nil {
+		log.Errorf(c, "Error loading boards: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	rv := []*TuneResults{}
 	seen := map[string]*TuneResults{}
 	for _, t := range res {
-		t.Board = canonicalBoard(t.Board)
+		t.Board = boards.canonical(t.Board)
 		tune, ok := seen[t.UUID]
 		if ok {
 			tune.Older = append(tune.Older, timestampedTau{t.Tau, t.Timestamp, t.Key})
@@ -756,6 +790,10 @@ func handleUsageDetail(w http.ResponseWriter, r *http.Request) {
 	usage.uncompress()
 	usage.Orig = (*json.RawMessage)(&usage.Data)
 
+	privacy := currentPrivacy()
+	usage.Addr = privacy.exportAddr(usage.Addr)
+	usage.Lat, usage.Lon = privacy.coords(usage.Lat, usage.Lon)
+
 	mustEncode(c, w, r, usage)
 }
 
@@ -767,6 +805,7 @@ type relatedTune struct {
 	City      string    `datastore:"city"`
 	Lat       float64   `datastore:"lat"`
 	Lon       float64   `datastore:"lon"`
+	GeoSource string    `datastore:"geo_source" json:"-"`
 
 	Orig *json.RawMessage
 
@@ -840,6 +879,11 @@ func handleRecentCrashes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	privacy := currentPrivacy()
+	for i := range res {
+		res[i].redact(privacy)
+	}
+
 	mustEncode(c, w, r, res)
 }
 
@@ -862,6 +906,7 @@ func handleCrash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	crash.Key = k
+	crash.redact(currentPrivacy())
 
 	mustEncode(c, w, r, crash)
 }
@@ -990,7 +1035,11 @@ func handleStoreTrace(w http.ResponseWriter, r *http.Request) {
 }
 
 type asyncUsageData struct {
+	// Encoded key of the UsageStat this came from, if it's been stored.
+	Key string
+
 	IP, Country, Region, City string
+	GeoSource                 string
 	Lat, Lon                  float64
 	Timestamp                 time.Time
 	RawData                   *json.RawMessage
@@ -999,14 +1048,18 @@ type asyncUsageData struct {
 func handleUsageStats(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
+	privacy := currentPrivacy()
+	now := time.Now()
+	loc := locate(c, r.Header, r.RemoteAddr)
 	data := &asyncUsageData{
-		IP:        r.RemoteAddr,
-		Country:   r.Header.Get("X-AppEngine-Country"),
-		Region:    r.Header.Get("X-AppEngine-Region"),
-		City:      r.Header.Get("X-AppEngine-City"),
-		Timestamp: time.Now(),
+		IP:        privacy.ingestAddr(c, r.RemoteAddr, now, loc),
+		Country:   loc.Country,
+		Region:    loc.Region,
+		City:      loc.City,
+		GeoSource: loc.Source,
+		Timestamp: now,
 	}
-	fmt.Sscanf(r.Header.Get("X-Appengine-Citylatlong"), "%f,%f", &data.Lat, &data.Lon)
+	data.Lat, data.Lon = privacy.coords(loc.Lat, loc.Lon)
 
 	if err := json.NewDecoder(r.Body).Decode(&data.RawData); err != nil {
 		log.Infof(c, "Error handling input JSON: %v", err)
@@ -1112,97 +1165,157 @@ func handleAsyncUsageStats(w http.ResponseWriter, r *http.Request) {
 	br, err := gzip.NewReader(r.Body)
 	if err != nil {
 		log.Errorf(c, "Error initializing ungzip: %v", err)
-		http.Error(w, "error ungzipping", 500)
+		http.Error(w, "error ungzipping", 400)
 		return
 	}
 	if err := json.NewDecoder(br).Decode(&d); err != nil {
 		log.Errorf(c, "Error decoding async json data: %v", err)
-		http.Error(w, "error decoding json", 500)
+		http.Error(w, "error decoding json", 400)
 		return
 	}
 
-	g, _ := errgroup.WithContext(c)
-
-	g.Go(func() error {
-		return asyncRollup(c, &d)
-	})
+	k := usageStatKey(c, &d)
+	d.Key = k.Encode()
 
-	g.Go(func() error {
-		preSize := len(*d.RawData)
-
-		u := UsageStat{
-			Data:      []byte(*d.RawData),
-			Timestamp: d.Timestamp,
-			Addr:      d.IP,
-			Country:   d.Country,
-			Region:    d.Region,
-			City:      d.City,
-			Lat:       d.Lat,
-			Lon:       d.Lon,
-		}
+	fresh, err := storeUsageStat(c, k, &d)
+	if err != nil {
+		log.Warningf(c, "Error storing usage data: %v", err)
+		http.Error(w, "error storing usage data", 500)
+		return
+	}
 
-		if err := u.compress(); err != nil {
-			log.Errorf(c, "Error compressing: %v", err)
-			return err
-		}
+	rollupErr := make(chan error, 1)
+	go func() { rollupErr <- asyncRollup(c, &d) }()
 
-		log.Debugf(c, "Compressed usage data from %v to %v", preSize, len(u.Data))
+	// This one keeps track of what it's counted, so it's retried
+	// along with the task.
+	debugErr := make(chan error, 1)
+	go func() { debugErr <- debugLogRollup(c, k, d.Timestamp, []byte(*d.RawData)) }()
 
-		_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "UsageStat", nil), &u)
-		if err != nil {
-			log.Warningf(c, "Error storing usage data: %v", err)
-			return err
-		}
-		return nil
-	})
+	g, _ := errgroup.WithContext(c)
 
-	g.Go(func() error {
-		decoded := struct {
-			CurrentOS  string `json:"currentOS"`
-			GCSVersion string `json:"gcs_version"`
-			Boards     []struct {
-				Name string
-			} `json:"boardsSeen"`
-		}{}
-		var boards []string
-		if err := <-fetcherr; err != nil {
-			log.Infof(c, "Couldn't fetch recent values from memcached: %v", err)
-		} else {
-			if err := json.Unmarshal([]byte(*d.RawData), &decoded); err != nil {
-				log.Warningf(c, "Error decoding usage details: %v", err)
-			}
-			m := map[string]bool{}
-			for _, b := range decoded.Boards {
-				m[canonicalBoard(b.Name)] = true
+	// A retried task has already done these.
+	if fresh {
+		g.Go(func() error {
+			decoded := struct {
+				CurrentOS  string `json:"currentOS"`
+				GCSVersion string `json:"gcs_version"`
+				Boards     []struct {
+					Name string
+				} `json:"boardsSeen"`
+			}{}
+			var boards []string
+			if err := <-fetcherr; err != nil {
+				log.Infof(c, "Couldn't fetch recent values from memcached: %v", err)
+			} else {
+				if err := json.Unmarshal([]byte(*d.RawData), &decoded); err != nil {
+					log.Warningf(c, "Error decoding usage details: %v", err)
+				}
+				m := map[string]bool{}
+				bc, err := loadBoards(c)
+				if err != nil {
+					log.Warningf(c, "Error loading boards: %v", err)
+				}
+				for _, b := range decoded.Boards {
+					m[bc.canonical(b.Name)] = true
+				}
+				for b := range m {
+					boards = append(boards, b)
+				}
 			}
-			for b := range m {
-				boards = append(boards, canonicalBoard(b))
+			recent = append(recent, recentUsage{
+				Timestamp: d.Timestamp,
+
+				Country: d.Country,
+				Region:  d.Region,
+				City:    d.City,
+				Lat:     d.Lat,
+				Lon:     d.Lon,
+				OS:      abbrevOS(decoded.CurrentOS),
+				Version: decoded.GCSVersion,
+				Boards:  boards,
+			})
+			if len(recent) > maxRecent {
+				recent = recent[1:]
 			}
-		}
-		recent = append(recent, recentUsage{
-			Timestamp: d.Timestamp,
-
-			Country: d.Country,
-			Region:  d.Region,
-			City:    d.City,
-			Lat:     d.Lat,
-			Lon:     d.Lon,
-			OS:      abbrevOS(decoded.CurrentOS),
-			Version: decoded.GCSVersion,
-			Boards:  boards,
-		})
-		if len(recent) > maxRecent {
-			recent = recent[1:]
-		}
-		return memcache.JSON.Set(c, &memcache.Item{
-			Key:    usageRollupKey,
-			Object: recent,
+			return memcache.JSON.Set(c, &memcache.Item{
+				Key:    usageRollupKey,
+				Object: recent,
+			})
 		})
-	})
+	}
 
 	if err := g.Wait(); err != nil {
 		log.Warningf(c, "Error with storage stuff: %v", err)
 	}
+
+	if err := <-rollupErr; err != nil {
+		log.Errorf(c, "Error doing async rollup: %v", err)
+		http.Error(w, "error doing async rollup: "+err.Error(), errorStatus(err))
+		return
+	}
+	if err := <-debugErr; err != nil {
+		log.Errorf(c, "Error rolling up debug log: %v", err)
+		http.Error(w, "error rolling up debug log: "+err.Error(), errorStatus(err))
+		return
+	}
+}
+
+// usageStatKey names the UsageStat for a report after its contents,
+// so retried tasks land on the same entity.
+func usageStatKey(c context.Context, d *asyncUsageData) *datastore.Key {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %s ", d.Timestamp.Format(time.RFC3339Nano), d.IP)
+	h.Write([]byte(*d.RawData))
+	return datastore.NewKey(c, "UsageStat", hex.EncodeToString(h.Sum(nil)), 0, nil)
+}
+
+// storeUsageStat stores a report, reporting whether this is the
+// first time we've seen it.
+func storeUsageStat(c context.Context, k *datastore.Key, d *asyncUsageData) (bool, error) {
+	// Board IDs are only ever stored hashed.
+	if h, changed, err := hashSeenUUIDs(*d.RawData); err != nil {
+		log.Errorf(c, "Error hashing board IDs: %v", err)
+		return false, err
+	} else if changed {
+		*d.RawData = json.RawMessage(h)
+	}
+	preSize := len(*d.RawData)
+
+	u := UsageStat{
+		Data:      []byte(*d.RawData),
+		Timestamp: d.Timestamp,
+		Addr:      d.IP,
+		Country:   d.Country,
+		Region:    d.Region,
+		City:      d.City,
+		Lat:       d.Lat,
+		Lon:       d.Lon,
+		GeoSource: d.GeoSource,
+	}
+
+	if err := u.compress(); err != nil {
+		log.Errorf(c, "Error compressing: %v", err)
+		return false, err
+	}
+
+	log.Debugf(c, "Compressed usage data from %v to %v", preSize, len(u.Data))
+
+	fresh := false
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		switch err := datastore.Get(tc, k, &UsageStat{}); err {
+		case nil:
+			fresh = false
+			return nil
+		case datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+		fresh = true
+		_, err := datastore.Put(tc, k, &u)
+		return err
+	}, nil)
+	return fresh, err
 }
 
 func handleEntityRedirect(w http.ResponseWriter, r *http.Request) {
@@ -1217,7 +1330,11 @@ func handleEntityRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	parts := []string{k.Namespace(), k.Kind(), "id:" + strconv.FormatInt(k.IntID(), 10)}
+	id := "id:" + strconv.FormatInt(k.IntID(), 10)
+	if k.StringID() != "" {
+		id = "name:" + k.StringID()
+	}
+	parts := []string{k.Namespace(), k.Kind(), id}
 	for i := range parts {
 		parts[i] = strconv.Itoa(len(parts[i])) + "/" + parts[i]
 	}
@@ -1228,106 +1345,6 @@ func handleEntityRedirect(w http.ResponseWriter, r *http.Request) {
 		outk+"&project="+appengine.AppID(c)+"&queryType=kind&kind="+k.Kind(), http.StatusFound)
 }
 
-const resultsStatsKey = "controllerStats"
-
-func handleUsageStatsSummary(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	itm, err := memcache.Get(c, resultsStatsKey)
-	if err == nil {
-		rm := json.RawMessage(itm.Value)
-		mustEncode(c, w, r, &rm)
-		return
-	}
-
-	var gitl []githubRef
-
-	g, _ := errgroup.WithContext(c)
-	g.Go(func() error {
-		var err error
-		gitl, err = gitLabels(c)
-		if err != nil {
-			log.Errorf(c, "Error getting stuff from github, going without: %v", err)
-		}
-		return nil
-	})
-
-	results := struct {
-		OSBoard      map[string]map[string]int `json:"os_board"`
-		OSDetail     map[string]int            `json:"os_detail"`
-		Board        map[string]int            `json:"board"`
-		BoardRev     map[string]map[string]int `json:"board_rev"`
-		CountryBoard map[string]map[string]int `json:"country_board"`
-		VersionBoard map[string]map[string]int `json:"version_board"`
-	}{
-		OSBoard:      map[string]map[string]int{},
-		OSDetail:     map[string]int{},
-		Board:        map[string]int{},
-		BoardRev:     map[string]map[string]int{},
-		CountryBoard: map[string]map[string]int{},
-		VersionBoard: map[string]map[string]int{},
-	}
-
-	q := datastore.NewQuery("FoundController").Order("-timestamp")
-
-	for t := q.Run(c); ; {
-		var x FoundController
-		_, err := t.Next(&x)
-		if err == datastore.Done {
-			break
-		} else if err != nil {
-			panic(err)
-		}
-
-		bn := canonicalBoard(x.Name)
-
-		results.OSDetail[x.GCSOS]++
-		results.Board[bn]++
-
-		cb, ok := results.CountryBoard[x.Country]
-		if !ok {
-			cb = map[string]int{}
-		}
-		cb[bn]++
-		results.CountryBoard[x.Country] = cb
-
-		ob, ok := results.OSBoard[abbrevOS(x.GCSOS)]
-		if !ok {
-			ob = map[string]int{}
-		}
-		ob[bn]++
-		results.OSBoard[abbrevOS(x.GCSOS)] = ob
-
-		br, ok := results.BoardRev[bn]
-		if !ok {
-			br = map[string]int{}
-		}
-		br[fmt.Sprint(x.HardwareRev)]++
-		results.BoardRev[bn] = br
-
-		ref := "Unknown"
-		g.Wait() // Make sure we have git labels
-		if lbls := gitDescribe(x.GitHash, gitl); lbls != nil {
-			ref = lbls[0].Label
-		}
-
-		vb, ok := results.VersionBoard[ref]
-		if !ok {
-			vb = map[string]int{}
-		}
-		vb[bn]++
-		results.VersionBoard[ref] = vb
-	}
-
-	memcache.JSON.Set(c, &memcache.Item{
-		Key:        resultsStatsKey,
-		Object:     results,
-		Expiration: time.Hour,
-	})
-
-	mustEncode(c, w, r, results)
-}
-
 func handleUsageStatsDetails(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
@@ -1335,6 +1352,12 @@ func handleUsageStatsDetails(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Warningf(c, "Couldn't resolve git labels: %v", err)
 	}
+	boards, err := loadBoards(c)
+	if err != nil {
+		log.Errorf(c, "Error loading boards: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	age := 365
 	if i, err := strconv.Atoi(r.FormValue("a")); err == nil {
@@ -1361,6 +1384,7 @@ func handleUsageStatsDetails(w http.ResponseWriter, r *http.Request) {
 		Order("-timestamp").
 		Filter("timestamp > ", oldest)
 
+	privacy := currentPrivacy()
 	for t := q.Run(c); ; {
 		var x FoundController
 		_, err := t.Next(&x)
@@ -1374,11 +1398,12 @@ func handleUsageStatsDetails(w http.ResponseWriter, r *http.Request) {
 		if lbls := gitDescribe(x.GitHash, gitl); lbls != nil {
 			ref = lbls[0].Label
 		}
+		x.Lat, x.Lon = privacy.coords(x.Lat, x.Lon)
 
 		cw.Write(append([]string{
 			x.Timestamp.Format(time.RFC3339), x.Oldest.Format(time.RFC3339),
 			fmt.Sprint(x.Count),
-			canonicalBoard(x.Name), fmt.Sprint(x.HardwareRev), x.GitHash, x.GitTag, ref,
+			boards.canonical(x.Name), fmt.Sprint(x.HardwareRev), x.GitHash, x.GitTag, ref,
 			x.GCSOS, abbrevOS(x.GCSOS), x.GCSVersion,
 			x.Country, x.Region, x.City, fmt.Sprint(x.Lat), fmt.Sprint(x.Lon)},
 		))
@@ -1398,11 +1423,82 @@ func genDates(from, to time.Time) []time.Time {
 	return rv
 }
 
+// loadDailyCounts reads the live and legacy daily counts by day, with firmware by label.
+func loadDailyCounts(c context.Context, cfg *countsConfig) (map[string]map[string]int64, error) {
+	var legacy []DailyCounts
+	var sharded map[string]map[string]int64
+	var gitl []githubRef
+	g, _ := errgroup.WithContext(c)
+	g.Go(func() error {
+		var err error
+		if gitl, err = gitLabels(c); err != nil {
+			log.Warningf(c, "Couldn't resolve git labels: %v", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		// Only counts that predate any recompute need these.
+		if cfg.Live != dailyCountShardKind {
+			return nil
+		}
+		keys, err := datastore.NewQuery("DailyCounts").GetAll(c, &legacy)
+		for i := range keys {
+			legacy[i].Day = keys[i].StringID()
+		}
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		sharded, err = readAllCounters(c, cfg.Live)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, dc := range legacy {
+		m, ok := sharded[dc.Day]
+		if !ok {
+			m = map[string]int64{}
+			sharded[dc.Day] = m
+		}
+		for k, v := range dc.Counts {
+			m[k] += v
+		}
+	}
+	if gitl != nil {
+		for day, m := range sharded {
+			sharded[day] = labelRefs(m, gitl)
+		}
+	}
+	return sharded, nil
+}
+
+// Params:
+// - dimension: what to break counts down by (default "board"), one of
+// the countDimensions
 func handleBoardCounts(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	yesterday := time.Now().AddDate(0, 0, -1)
 
-	cacheKey := "boardCounts." + yesterday.Format(dayFmt)
+	dim := r.FormValue("dimension")
+	if dim == "" {
+		dim = "board"
+	}
+	prefix, ok := countDimensions[dim]
+	if !ok {
+		http.Error(w, "Invalid dimension", 400)
+		return
+	}
+
+	cfg, err := loadCountsConfig(c)
+	if err != nil {
+		log.Errorf(c, "Error loading counts config: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	cacheKey := "boardCounts." + cfg.Live + "." + dim + "." + yesterday.Format(dayFmt)
 	var rv []DailyCounts
 	if _, err := memcache.JSON.Get(c, cacheKey, &rv); err == nil {
 		mustEncode(c, w, r, rv)
@@ -1411,37 +1507,20 @@ func handleBoardCounts(w http.ResponseWriter, r *http.Request) {
 		log.Infof(c, "Cache error: %v", err)
 	}
 
-	var keys []*datastore.Key
-	for _, d := range genDates(oldestBoard, yesterday) {
-		keys = append(keys, datastore.NewKey(c, "DailyCounts", d.Format(dayFmt), 0, nil))
-	}
-
-	vals := make([]DailyCounts, len(keys))
-	err := datastore.GetMulti(c, keys, vals)
-	log.Debugf(c, "Error: %v", err)
-	if merr, ok := err.(appengine.MultiError); ok {
-		for i, e := range merr {
-			switch e {
-			case datastore.ErrNoSuchEntity:
-				// skip
-			case nil:
-				vals[i].Day = keys[i].StringID()
-				rv = append(rv, vals[i])
-			default:
-				break
-			}
-		}
-		err = nil
-	} else {
-		rv = vals
-	}
-
+	sharded, err := loadDailyCounts(c, cfg)
 	if err != nil {
-		log.Errorf(c, "Error loading: %v - keys: %v", err, keys)
-		http.Error(w, err.Error(), 400)
+		log.Errorf(c, "Error loading daily counts: %v", err)
+		http.Error(w, err.Error(), 500)
 		return
 	}
 
+	for _, d := range genDates(oldestBoard, yesterday) {
+		ds := d.Format(dayFmt)
+		if counts, ok := sharded[ds]; ok {
+			rv = append(rv, DailyCounts{Day: ds, Counts: counts}.dimension(prefix))
+		}
+	}
+
 	if err := memcache.JSON.Set(c, &memcache.Item{
 		Key:        cacheKey,
 		Object:     rv,